@@ -2,12 +2,16 @@ package agent
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/bwmarrin/snowflake"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/pkg/errors"
 	"github.com/rs/xid"
@@ -17,9 +21,13 @@ import (
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/schmurfy/sniffit/compression"
+	"github.com/schmurfy/sniffit/config"
 	pb "github.com/schmurfy/sniffit/generated_pb/proto"
 )
 
@@ -29,28 +37,73 @@ var (
 )
 
 type Agent struct {
-	ifName string
-	filter string
-	name   string
+	name     string
+	captures []*capture
 
 	grpcConn   *grpc.ClientConn
 	grpcClient pb.ArchivistClient
 
 	// internals
-	pcapHandle  *pcap.Handle
-	snaplen     int32
+	handles     []*pcap.Handle
 	idGenerator *snowflake.Node
 	batchSize   int
+
+	// nil if the batches are retried until they are sent
+	spool *Spool
+
+	streamWindow int
+	sender       *streamSender
+
+	// sent as a bearer token when set
+	token string
+
+	// used on the stream when the archivist supports them
+	compressor string
+	payloads   *compression.PayloadEncoder
 }
 
-func New(interfaceName string, filter string, archivistAddress string, agentName string, snapLen int32, batchSize int) (*Agent, error) {
+func New(cfg *config.AgentConfig) (*Agent, error) {
 	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	captures, err := loadCaptures(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !compression.Valid(cfg.Compression) {
+		return nil, errors.Errorf("unknown compression: %s", cfg.Compression)
+	}
+
+	var payloads *compression.PayloadEncoder
+	if cfg.CompressionDict != "" {
+		dict, _, err := compression.LoadDictionary(cfg.CompressionDict)
+		if err != nil {
+			return nil, err
+		}
+
+		payloads, err = compression.NewPayloadEncoder(dict)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	creds := insecure.NewCredentials()
+	if cfg.TLSConfig.Enabled() {
+		// the server name defaults to the host of the address
+		clientTLS, err := cfg.TLSConfig.ClientTLS(cfg.TLSServerName)
+		if err != nil {
+			return nil, err
+		}
+
+		creds = credentials.NewTLS(clientTLS)
+	}
+
 	// start grpc client
-	conn, err := grpc.NewClient(archivistAddress,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	conn, err := grpc.NewClient(cfg.ArchivistAddress,
+		grpc.WithTransportCredentials(creds),
 		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithStatsHandler(newWireStats()),
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to connect")
@@ -61,105 +114,239 @@ func New(interfaceName string, filter string, archivistAddress string, agentName
 		return nil, errors.Wrap(err, "failed to connect")
 	}
 
-	return &Agent{
-		ifName:      interfaceName,
-		filter:      filter,
+	ret := &Agent{
+		captures:    captures,
 		grpcConn:    conn,
 		grpcClient:  pb.NewArchivistClient(conn),
-		name:        agentName,
+		name:        cfg.AgentName,
 		idGenerator: node,
-		batchSize:   batchSize,
-		snaplen:     snapLen,
-	}, nil
+		batchSize:   cfg.BatchSize,
+
+		token:        cfg.Token,
+		streamWindow: cfg.StreamWindow,
+		compressor:   cfg.Compression,
+		payloads:     payloads,
+	}
+
+	if cfg.SpoolDir != "" {
+		ret.spool, err = OpenSpool(cfg.SpoolDir, cfg.SpoolMaxSize, cfg.SpoolSegmentSize)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return ret, nil
 }
 
-func (agent *Agent) sendPackets(ctx context.Context, queue chan gopacket.Packet, errorsCh chan error) {
+// send sends a batch with the unary call, it is retried until maxElapsed
+// (0 retries forever).
+func (agent *Agent) send(ctx context.Context, pkts []*pb.Packet, maxElapsed time.Duration) error {
+	ctx, span := _tracer.Start(ctx, "send",
+		trace.WithAttributes(
+			attribute.Int("packets_count", len(pkts)),
+		))
+	defer span.End()
+
+	operation := func() error {
+		batch := &pb.PacketBatch{Packets: pkts}
+		metrics.GetOrCreateCounter(`sent_raw_bytes`).AddInt64(int64(proto.Size(batch)))
+
+		_, err := agent.grpcClient.SendPacket(ctx, batch)
+		return errors.WithStack(err)
+	}
 
-	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(
-		"agent-name", agent.name,
-	))
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = maxElapsed
 
-	batch := NewBatchQueue(agent.batchSize, _batch_timeout, func(pkts []*pb.Packet) {
-		ctx, span := _tracer.Start(ctx, "sendPackets:NewBatchQueue",
-			trace.WithAttributes(
-				attribute.Int("packets_count", len(pkts)),
-			))
-		defer span.End()
+	err := backoff.RetryNotify(operation, backoff.WithContext(retryBackoff, ctx), func(err error, d time.Duration) {
+		span.RecordError(err)
+		fmt.Printf("retrying (%d packets) in %s (err: %s)...\n", len(pkts), d.String(), err.Error())
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+// spoolBatch sends the batch unless older batches are waiting in the
+// spool, it is spooled right away when the archivist has not acknowledged
+// the previous batches so the capture is never blocked.
+func (agent *Agent) spoolBatch(pkts []*pb.Packet) {
+	if agent.spool.Empty() {
+		if _, sent := agent.sender.TrySend(pkts); sent {
+			return
+		}
+	}
+
+	err := agent.spool.Write(&pb.PacketBatch{Packets: pkts})
+	if err != nil {
+		fmt.Printf("failed to spool %d packets: %+v\n", len(pkts), err)
+		metrics.GetOrCreateCounter(`spool_write_errors`).Inc()
+	}
+}
+
+// drainSpool sends the spooled batches in order, up to streamWindow batches
+// wait for their acknowledgement.
+func (agent *Agent) drainSpool(ctx context.Context) {
+	inflight := make(chan (<-chan struct{}), max(agent.streamWindow, 1))
+	go agent.ackSpool(ctx, inflight)
+
+	for {
+		batch, err := agent.spool.Next()
+		if err != nil {
+			fmt.Printf("failed to read spool: %+v\n", err)
+		}
 
-		for {
-			operation := func() error {
-				_, err := agent.grpcClient.SendPacket(ctx, &pb.PacketBatch{Packets: pkts})
-				return errors.WithStack(err)
+		if batch == nil {
+			select {
+			case <-agent.spool.Written():
+			case <-time.After(_batch_timeout):
+			case <-ctx.Done():
+				return
 			}
+			continue
+		}
 
-			retryBackoff := backoff.NewExponentialBackOff()
+		acked, err := agent.sender.Send(ctx, batch.Packets)
+		if err != nil {
+			return
+		}
 
-			err := backoff.RetryNotify(operation, retryBackoff, func(err error, d time.Duration) {
-				span.RecordError(err)
-				fmt.Printf("retrying (%d packets) in %s (err: %s)...\n", len(pkts), d.String(), err.Error())
-			})
+		select {
+		case inflight <- acked:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			if err != nil {
-				fmt.Printf("error: %+v\n", err)
-				span.RecordError(err)
-				// errorsCh <- err
-			} else {
-				break
+// ackSpool removes the batches sent by drainSpool from the spool once they
+// are stored, in the order they were sent.
+func (agent *Agent) ackSpool(ctx context.Context, inflight <-chan (<-chan struct{})) {
+	for {
+		select {
+		case acked := <-inflight:
+			select {
+			case <-acked:
+			case <-ctx.Done():
+				return
 			}
+
+			agent.spool.Ack()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startSending starts sending the batches to the archivist and returns the
+// queue shared by the captures.
+func (agent *Agent) startSending(ctx context.Context) *BatchQueue {
+	// the settings of every capture, in the same order for each key
+	md := metadata.Pairs("agent-name", agent.name)
+	for _, c := range agent.captures {
+		md.Append("agent-interface", c.ifName)
+		md.Append("agent-filter", c.filter)
+		md.Append("agent-snaplen", strconv.Itoa(int(c.snaplen)))
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	if agent.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+agent.token)
+	}
+
+	agent.sender = newStreamSender(agent.grpcClient, agent.streamWindow, func(ctx context.Context, pkts []*pb.Packet) error {
+		return agent.send(ctx, pkts, 0)
+	})
+	agent.sender.SetCompression(agent.compressor, agent.payloads)
+	go agent.sender.Run(ctx)
+
+	if agent.spool != nil {
+		go agent.drainSpool(ctx)
+	}
+
+	return NewBatchQueue(agent.batchSize, _batch_timeout, func(pkts []*pb.Packet) {
+		if agent.spool != nil {
+			agent.spoolBatch(pkts)
+			return
 		}
 
+		// blocks the capture when too many batches are not acknowledged
+		agent.sender.Send(ctx, pkts)
 	})
+}
+
+// capturePackets adds the packets captured on an interface to the batch
+// queue.
+func (agent *Agent) capturePackets(c *capture, linkType layers.LinkType, queue chan gopacket.Packet, batch *BatchQueue) {
+	// the archivist uses 0 for ethernet frames sent by older agents, BSD
+	// loopback captures are converted to their network byte order variant
+	sentLinkType := linkType
+	if linkType == layers.LinkTypeNull {
+		sentLinkType = layers.LinkTypeLoop
+	}
 
 	for pkt := range queue {
 		md := pkt.Metadata()
+		data := pkt.Data()
+
+		if (linkType == layers.LinkTypeNull) && (len(data) >= 4) {
+			family := binary.NativeEndian.Uint32(data[0:4])
+			binary.BigEndian.PutUint32(data[0:4], family)
+		}
 
 		batch.Add(&pb.Packet{
 			Id:            xid.New().String(),
-			Data:          pkt.Data(),
+			Data:          data,
 			TimestampNano: md.Timestamp.UnixNano(),
 			CaptureLength: int64(md.CaptureInfo.CaptureLength),
 			DataLength:    int64(md.CaptureInfo.Length),
+			LinkType:      int32(sentLinkType),
+			Interface:     c.ifName,
 		})
 	}
 }
 
+// Start opens every capture before sending their packets, the agent does
+// not start if one of them fails.
 func (agent *Agent) Start() error {
 	ctx := context.Background()
 	errQueue := make(chan error)
 
-	inactive, err := pcap.NewInactiveHandle(agent.ifName)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	for _, c := range agent.captures {
+		h, err := c.open()
+		if err != nil {
+			return err
+		}
 
-	err = inactive.SetSnapLen(int(agent.snaplen))
-	if err != nil {
-		return errors.WithStack(err)
+		agent.handles = append(agent.handles, h)
 	}
 
-	err = inactive.SetBufferSize(int(agent.snaplen) * 1000)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	batch := agent.startSending(ctx)
 
-	err = inactive.SetTimeout(10 * time.Second)
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	for n, c := range agent.captures {
+		h := agent.handles[n]
+		pktSource := gopacket.NewPacketSource(h, h.LinkType())
 
-	h, err := inactive.Activate()
-	if err != nil {
-		return errors.WithStack(err)
+		go agent.capturePackets(c, h.LinkType(), pktSource.Packets(), batch)
 	}
 
-	pktSource := gopacket.NewPacketSource(h, h.LinkType())
-
-	go agent.sendPackets(ctx, pktSource.Packets(), errQueue)
 	return <-errQueue
 }
 
 func (agent *Agent) Close() {
+	for _, h := range agent.handles {
+		h.Close()
+	}
+
 	if agent.grpcConn != nil {
 		agent.grpcConn.Close()
 	}
+
+	if agent.spool != nil {
+		agent.spool.Close()
+	}
 }
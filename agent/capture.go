@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
+
+	"github.com/schmurfy/sniffit/config"
+)
+
+// capture is an interface listened on by the agent, each one has its own
+// filter and snap length.
+type capture struct {
+	ifName  string
+	filter  string
+	snaplen int32
+}
+
+// loadCaptures returns the interfaces of the interface option, sharing the
+// filter and snap length, followed by the ones of the captures file.
+func loadCaptures(cfg *config.AgentConfig) ([]*capture, error) {
+	var ret []*capture
+
+	if cfg.InterfaceName != "" {
+		for _, ifName := range strings.Split(cfg.InterfaceName, ",") {
+			ret = append(ret, &capture{
+				ifName:  strings.TrimSpace(ifName),
+				filter:  cfg.Filter,
+				snaplen: cfg.SnapLen,
+			})
+		}
+	}
+
+	if cfg.Captures != "" {
+		captures, err := loadCapturesFile(cfg.Captures, cfg.SnapLen)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, captures...)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("no interface to capture, set interface or captures")
+	}
+
+	// the packets are labelled with the interface name
+	names := map[string]bool{}
+	for _, c := range ret {
+		if c.ifName == "" {
+			return nil, errors.New("empty interface name")
+		}
+
+		if names[c.ifName] {
+			return nil, errors.Errorf("interface %s is captured twice", c.ifName)
+		}
+		names[c.ifName] = true
+	}
+
+	return ret, nil
+}
+
+// loadCapturesFile reads a file with one "<interface> <snap len> [filter]"
+// per line, a snap len of 0 uses the default one, empty lines and lines
+// starting with # are ignored.
+func loadCapturesFile(path string, defaultSnaplen int32) ([]*capture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var ret []*capture
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("%s:%d: expected <interface> <snap len> [filter]", path, lineNumber)
+		}
+
+		snaplen, err := strconv.ParseInt(fields[1], 10, 32)
+		if (err != nil) || (snaplen < 0) {
+			return nil, errors.Errorf("%s:%d: invalid snap len: %s", path, lineNumber, fields[1])
+		}
+
+		if snaplen == 0 {
+			snaplen = int64(defaultSnaplen)
+		}
+
+		ret = append(ret, &capture{
+			ifName:  fields[0],
+			snaplen: int32(snaplen),
+			filter:  strings.Join(fields[2:], " "),
+		})
+	}
+
+	return ret, errors.WithStack(scanner.Err())
+}
+
+// open activates the capture handle and applies the filter.
+func (c *capture) open() (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(c.ifName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer inactive.CleanUp()
+
+	err = inactive.SetSnapLen(int(c.snaplen))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = inactive.SetBufferSize(int(c.snaplen) * 1000)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = inactive.SetTimeout(10 * time.Second)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	h, err := inactive.Activate()
+	if err != nil {
+		return nil, errors.Wrap(err, c.ifName)
+	}
+
+	if c.filter != "" {
+		err = h.SetBPFFilter(c.filter)
+		if err != nil {
+			h.Close()
+			return nil, errors.Wrap(err, c.ifName)
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/config"
+)
+
+func TestLoadCaptures(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("loadCaptures", func() {
+		var dir string
+
+		write := func(content string) string {
+			path := filepath.Join(dir, "captures")
+			err := os.WriteFile(path, []byte(content), 0600)
+			require.Nil(g, err)
+			return path
+		}
+
+		g.BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "captures")
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("should share the filter between the listed interfaces", func() {
+			cfg := &config.AgentConfig{InterfaceName: "eth0, eth1", Filter: "tcp"}
+			cfg.SnapLen = 1500
+
+			captures, err := loadCaptures(cfg)
+			require.Nil(g, err)
+			assert.Equal(g, []*capture{
+				{ifName: "eth0", filter: "tcp", snaplen: 1500},
+				{ifName: "eth1", filter: "tcp", snaplen: 1500},
+			}, captures)
+		})
+
+		g.It("should read the settings of each interface", func() {
+			cfg := &config.AgentConfig{
+				InterfaceName: "mgmt0",
+				Filter:        "not port 22",
+				Captures:      write("# interface snaplen filter\neth1 128   tcp  port 80\n\neth2 0\n"),
+			}
+			cfg.SnapLen = 1500
+
+			captures, err := loadCaptures(cfg)
+			require.Nil(g, err)
+			assert.Equal(g, []*capture{
+				{ifName: "mgmt0", filter: "not port 22", snaplen: 1500},
+				{ifName: "eth1", filter: "tcp port 80", snaplen: 128},
+				{ifName: "eth2", filter: "", snaplen: 1500},
+			}, captures)
+		})
+
+		g.It("should reject invalid captures", func() {
+			_, err := loadCaptures(&config.AgentConfig{})
+			assert.NotNil(g, err)
+
+			_, err = loadCaptures(&config.AgentConfig{InterfaceName: "eth0,eth0"})
+			assert.NotNil(g, err)
+
+			_, err = loadCaptures(&config.AgentConfig{Captures: write("eth1 big tcp\n")})
+			assert.NotNil(g, err)
+
+			_, err = loadCaptures(&config.AgentConfig{Captures: write("eth1\n")})
+			assert.NotNil(g, err)
+		})
+	})
+}
@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+const (
+	_spoolExtension  = ".spool"
+	_spoolHeaderSize = 4
+)
+
+// spoolRecord is the position of a batch sent from the spool.
+type spoolRecord struct {
+	seq uint64
+	end int64
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// Spool stores the batches which could not be sent in segment files so they
+// can be sent in order once the archivist is reachable again, the oldest
+// segments are removed when the spool grows over maxSize.
+// Each record is the size of the batch (4 bytes, big endian) followed by
+// the batch, the batches are sent at least once: the segment being read
+// when the agent stops is sent again from its start.
+// Several batches can be read before the first one is acknowledged, they
+// are acknowledged in the order they were read.
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// oldest first, the last one is written to
+	segments []*spoolSegment
+	size     int64
+	writer   *os.File
+
+	// end of the batches acknowledged in the first segment
+	readOffset int64
+
+	// position of the next batch returned by Next
+	cursorSeq    uint64
+	cursorOffset int64
+
+	// batches returned by Next and not acknowledged yet, in order
+	inflight []spoolRecord
+
+	notify chan struct{}
+}
+
+// OpenSpool opens or creates the spool stored in dir, the segments left by
+// a previous run are sent first.
+func OpenSpool(dir string, maxSize int64, segmentSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("the spool size must be positive")
+	}
+
+	if (segmentSize <= 0) || (segmentSize > maxSize) {
+		segmentSize = maxSize
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		notify:      make(chan struct{}, 1),
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, _spoolExtension) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, _spoolExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		ret.segments = append(ret.segments, &spoolSegment{
+			seq:  seq,
+			path: filepath.Join(dir, name),
+			size: info.Size(),
+		})
+		ret.size += info.Size()
+	}
+
+	sort.Slice(ret.segments, func(i, j int) bool {
+		return ret.segments[i].seq < ret.segments[j].seq
+	})
+
+	metrics.GetOrCreateGauge(`spool_size_bytes`, func() float64 {
+		return float64(ret.Size())
+	})
+
+	return ret, nil
+}
+
+// Write appends a batch to the spool.
+func (s *Spool) Write(batch *pb.PacketBatch) error {
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	record := make([]byte, _spoolHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[_spoolHeaderSize:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// segments left by a previous run are never appended to, their last
+	// record may be incomplete
+	if s.writer == nil {
+		err = s.rotate()
+	} else if current := s.segments[len(s.segments)-1]; current.size+int64(len(record)) > s.segmentSize {
+		err = s.rotate()
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := s.writer.Write(record)
+	s.segments[len(s.segments)-1].size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	metrics.GetOrCreateCounter(`spool_batches_written`).Inc()
+	metrics.GetOrCreateCounter(`spool_bytes_written`).Add(n)
+
+	s.evict()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// rotate starts a new segment, the lock must be held.
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		s.writer = nil
+	}
+
+	// the sequences already read are not reused
+	seq := s.cursorSeq
+	if len(s.segments) > 0 {
+		seq = max(seq, s.segments[len(s.segments)-1].seq+1)
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, _spoolExtension))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.writer = f
+	s.segments = append(s.segments, &spoolSegment{seq: seq, path: path})
+
+	return nil
+}
+
+// evict removes the oldest segments until the spool fits in maxSize, the
+// segment written to is kept, the lock must be held.
+func (s *Spool) evict() {
+	for (s.size > s.maxSize) && (len(s.segments) > 1) {
+		seg := s.segments[0]
+
+		metrics.GetOrCreateCounter(`spool_segments_evicted`).Inc()
+		metrics.GetOrCreateCounter(`spool_bytes_evicted`).Add(int(seg.size - s.readOffset))
+
+		s.removeFirst()
+	}
+}
+
+// removeFirst deletes the oldest segment, the lock must be held.
+func (s *Spool) removeFirst() {
+	seg := s.segments[0]
+
+	if len(s.segments) == 1 && (s.writer != nil) {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	if err := os.Remove(seg.path); err != nil {
+		fmt.Printf("failed to remove spool segment %s: %s\n", seg.path, err.Error())
+	}
+
+	s.size -= seg.size
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+
+	if seg.seq >= s.cursorSeq {
+		s.cursorSeq = seg.seq + 1
+		s.cursorOffset = 0
+	}
+}
+
+// Next returns the oldest batch not returned yet without removing it, nil
+// if there is none, Ack must be called once the batch is sent.
+func (s *Spool) Next() (*pb.PacketBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		seg, last := s.cursorSegment()
+		if seg == nil {
+			return nil, nil
+		}
+
+		if s.cursorOffset >= seg.size {
+			if last {
+				return nil, nil
+			}
+
+			s.cursorSeq++
+			s.cursorOffset = 0
+			s.removeSent()
+			continue
+		}
+
+		batch, length, err := readSpoolRecord(seg.path, s.cursorOffset)
+		if err != nil {
+			// an incomplete or damaged record ends the segment
+			fmt.Printf("skipping the end of spool segment %s: %s\n", seg.path, err.Error())
+			s.cursorOffset = seg.size
+			continue
+		}
+
+		s.cursorOffset += length
+		s.inflight = append(s.inflight, spoolRecord{seq: seg.seq, end: s.cursorOffset})
+		return batch, nil
+	}
+}
+
+// cursorSegment returns the segment read by Next and whether the batches
+// written later go to it, the cursor moves to the next segment when its
+// segment was removed. The lock must be held.
+func (s *Spool) cursorSegment() (*spoolSegment, bool) {
+	for i, seg := range s.segments {
+		if seg.seq < s.cursorSeq {
+			continue
+		}
+
+		if seg.seq != s.cursorSeq {
+			s.cursorSeq = seg.seq
+			s.cursorOffset = 0
+		}
+
+		return seg, (i == len(s.segments)-1) && (s.writer != nil)
+	}
+
+	return nil, false
+}
+
+// removeSent deletes the segments read by Next and fully acknowledged, the
+// lock must be held.
+func (s *Spool) removeSent() {
+	for (len(s.segments) > 0) && (s.segments[0].seq < s.cursorSeq) {
+		if (len(s.inflight) > 0) && (s.inflight[0].seq <= s.segments[0].seq) {
+			return
+		}
+
+		s.removeFirst()
+	}
+}
+
+func readSpoolRecord(path string, offset int64) (*pb.PacketBatch, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	header := make([]byte, _spoolHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := f.ReadAt(data, offset+_spoolHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, errors.WithStack(err)
+	}
+
+	batch := &pb.PacketBatch{}
+	if err := proto.Unmarshal(data, batch); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	return batch, int64(_spoolHeaderSize + len(data)), nil
+}
+
+// Ack removes the oldest batch returned by Next, the segments are deleted
+// once all their batches are sent.
+func (s *Spool) Ack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.inflight) == 0 {
+		return
+	}
+
+	record := s.inflight[0]
+	s.inflight = s.inflight[1:]
+
+	// the segment may have been evicted while the batch was sent
+	if (len(s.segments) == 0) || (s.segments[0].seq != record.seq) {
+		return
+	}
+
+	s.readOffset = record.end
+
+	metrics.GetOrCreateCounter(`spool_batches_sent`).Inc()
+
+	if s.readOffset >= s.segments[0].size {
+		s.removeFirst()
+	}
+
+	s.removeSent()
+}
+
+// Empty returns true if every spooled batch was sent.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return (len(s.segments) == 0) ||
+		((len(s.segments) == 1) && (s.readOffset >= s.segments[0].size))
+}
+
+// Size returns the size of the segments on disk.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// Written is notified when a batch is written.
+func (s *Spool) Written() <-chan struct{} {
+	return s.notify
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer != nil {
+		err := s.writer.Close()
+		s.writer = nil
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+func TestSpool(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Spool", func() {
+		var dir string
+		var s *Spool
+
+		batch := func(id string) *pb.PacketBatch {
+			return &pb.PacketBatch{Packets: []*pb.Packet{
+				{Id: id, Data: make([]byte, 100)},
+			}}
+		}
+
+		// sends everything left in the spool and returns the ids
+		drain := func() []string {
+			ret := []string{}
+
+			for {
+				b, err := s.Next()
+				require.Nil(g, err)
+				if b == nil {
+					return ret
+				}
+
+				ret = append(ret, b.Packets[0].Id)
+				s.Ack()
+			}
+		}
+
+		segments := func() []string {
+			files, err := filepath.Glob(filepath.Join(dir, "*"+_spoolExtension))
+			require.Nil(g, err)
+			return files
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "spool")
+			require.Nil(g, err)
+
+			s, err = OpenSpool(dir, 10000, 300)
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			s.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should return the batches in order", func() {
+			assert.True(g, s.Empty())
+
+			for _, id := range []string{"b1", "b2", "b3", "b4"} {
+				require.Nil(g, s.Write(batch(id)))
+			}
+
+			assert.False(g, s.Empty())
+			assert.Len(g, segments(), 2)
+
+			// the batches stay in the spool until they are acknowledged, the
+			// next ones can be read meanwhile
+			b, err := s.Next()
+			require.Nil(g, err)
+			assert.Equal(g, "b1", b.Packets[0].Id)
+
+			b, err = s.Next()
+			require.Nil(g, err)
+			assert.Equal(g, "b2", b.Packets[0].Id)
+
+			s.Ack()
+			assert.Len(g, segments(), 2)
+			s.Ack()
+			assert.Len(g, segments(), 1)
+
+			assert.Equal(g, []string{"b3", "b4"}, drain())
+			assert.True(g, s.Empty())
+			assert.Empty(g, segments())
+			assert.Equal(g, int64(0), s.Size())
+
+			// and can be used again
+			require.Nil(g, s.Write(batch("b5")))
+			assert.Equal(g, []string{"b5"}, drain())
+		})
+
+		g.It("should acknowledge the batches read across segments in order", func() {
+			for _, id := range []string{"b1", "b2", "b3", "b4", "b5"} {
+				require.Nil(g, s.Write(batch(id)))
+			}
+			require.Len(g, segments(), 3)
+
+			for _, id := range []string{"b1", "b2", "b3", "b4"} {
+				b, err := s.Next()
+				require.Nil(g, err)
+				assert.Equal(g, id, b.Packets[0].Id)
+			}
+
+			// nothing is removed before the acknowledgements
+			assert.Len(g, segments(), 3)
+
+			s.Ack()
+			s.Ack()
+			s.Ack()
+			assert.Len(g, segments(), 2)
+			assert.False(g, s.Empty())
+
+			s.Ack()
+			assert.Equal(g, []string{"b5"}, drain())
+			assert.True(g, s.Empty())
+			assert.Empty(g, segments())
+		})
+
+		g.It("should ignore the acknowledgements of evicted batches", func() {
+			var err error
+
+			s.Close()
+			s, err = OpenSpool(dir, 500, 200)
+			require.Nil(g, err)
+
+			require.Nil(g, s.Write(batch("b1")))
+
+			b, err := s.Next()
+			require.Nil(g, err)
+			assert.Equal(g, "b1", b.Packets[0].Id)
+
+			for _, id := range []string{"b2", "b3", "b4", "b5", "b6"} {
+				require.Nil(g, s.Write(batch(id)))
+			}
+
+			// b1 was evicted while being sent
+			s.Ack()
+			assert.Equal(g, []string{"b3", "b4", "b5", "b6"}, drain())
+		})
+
+		g.It("should keep the batches across restarts", func() {
+			for _, id := range []string{"b1", "b2", "b3"} {
+				require.Nil(g, s.Write(batch(id)))
+			}
+
+			_, err := s.Next()
+			require.Nil(g, err)
+			s.Ack()
+
+			require.Nil(g, s.Close())
+
+			s, err = OpenSpool(dir, 10000, 300)
+			require.Nil(g, err)
+
+			require.Nil(g, s.Write(batch("b4")))
+
+			// the first segment was not fully sent, it is sent again
+			assert.Equal(g, []string{"b1", "b2", "b3", "b4"}, drain())
+			assert.Empty(g, segments())
+		})
+
+		g.It("should evict the oldest segments", func() {
+			var err error
+
+			s.Close()
+			s, err = OpenSpool(dir, 500, 200)
+			require.Nil(g, err)
+
+			for _, id := range []string{"b1", "b2", "b3", "b4", "b5", "b6"} {
+				require.Nil(g, s.Write(batch(id)))
+			}
+
+			assert.LessOrEqual(g, s.Size(), int64(500))
+			assert.Equal(g, []string{"b3", "b4", "b5", "b6"}, drain())
+		})
+
+		g.It("should skip incomplete records", func() {
+			require.Nil(g, s.Write(batch("b1")))
+			require.Nil(g, s.Close())
+
+			files := segments()
+			require.Len(g, files, 1)
+
+			// a crash while writing the last record
+			info, err := os.Stat(files[0])
+			require.Nil(g, err)
+			require.Nil(g, os.Truncate(files[0], info.Size()-10))
+
+			s, err = OpenSpool(dir, 10000, 300)
+			require.Nil(g, err)
+
+			require.Nil(g, s.Write(batch("b2")))
+			assert.Equal(g, []string{"b2"}, drain())
+		})
+	})
+}
@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/schmurfy/sniffit/compression"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+var (
+	// returned when the stream must be reopened to use the compressor
+	// accepted by the archivist
+	errRenegotiate = errors.New("renegotiate")
+)
+
+type pendingBatch struct {
+	msg   *pb.StreamBatch
+	acked chan struct{}
+}
+
+// streamSender sends the batches on a StreamPackets stream without waiting
+// for each acknowledgement, at most window batches are waiting for their
+// acknowledgement. The batches not acknowledged are resent when the stream
+// is reopened, archivists without the stream are sent the batches one at a
+// time with unary.
+type streamSender struct {
+	client pb.ArchivistClient
+	unary  func(context.Context, []*pb.Packet) error
+	id     string
+
+	// one token per batch waiting for its acknowledgement
+	slots  chan struct{}
+	queued chan struct{}
+
+	mu sync.Mutex
+	// in sequence order
+	pending []*pendingBatch
+	// number of pending batches sent on the current stream
+	sent    int
+	nextSeq uint64
+
+	// compressor and dictionary configured, used once the archivist
+	// advertises them in the stream header
+	compressor    string
+	payloads      *compression.PayloadEncoder
+	useCompressor bool
+	useDict       bool
+}
+
+func newStreamSender(client pb.ArchivistClient, window int, unary func(context.Context, []*pb.Packet) error) *streamSender {
+	if window <= 0 {
+		window = 1
+	}
+
+	return &streamSender{
+		client:  client,
+		unary:   unary,
+		id:      xid.New().String(),
+		slots:   make(chan struct{}, window),
+		queued:  make(chan struct{}, 1),
+		nextSeq: 1,
+	}
+}
+
+// SetCompression sets the compressor and dictionary used when the archivist
+// supports them, it must be called before Run.
+func (s *streamSender) SetCompression(compressor string, payloads *compression.PayloadEncoder) {
+	s.compressor = compressor
+	s.payloads = payloads
+}
+
+// Send queues a batch and returns a channel closed once the batch is
+// acknowledged, it blocks while window batches are not acknowledged.
+func (s *streamSender) Send(ctx context.Context, pkts []*pb.Packet) (<-chan struct{}, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	return s.queue(pkts), nil
+}
+
+// TrySend is Send without blocking, the batch is not queued when window
+// batches are not acknowledged.
+func (s *streamSender) TrySend(pkts []*pb.Packet) (<-chan struct{}, bool) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	return s.queue(pkts), true
+}
+
+// queue adds the batch to the pending ones, a slot must have been taken.
+func (s *streamSender) queue(pkts []*pb.Packet) <-chan struct{} {
+	// the slice is reused by the batch queue
+	batch := &pendingBatch{
+		msg: &pb.StreamBatch{
+			Batch: &pb.PacketBatch{Packets: append([]*pb.Packet{}, pkts...)},
+		},
+		acked: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	batch.msg.Sequence = s.nextSeq
+	s.nextSeq++
+	s.pending = append(s.pending, batch)
+	s.mu.Unlock()
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+
+	return batch.acked
+}
+
+// ack releases the batches up to sequence.
+func (s *streamSender) ack(sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for (n < len(s.pending)) && (s.pending[n].msg.Sequence <= sequence) {
+		close(s.pending[n].acked)
+		<-s.slots
+		n++
+	}
+
+	s.pending = s.pending[n:]
+	s.sent = max(s.sent-n, 0)
+}
+
+// Run sends the batches until the context is cancelled, the stream is
+// reopened after errors.
+func (s *streamSender) Run(ctx context.Context) {
+	ctx = metadata.AppendToOutgoingContext(ctx, "agent-stream", s.id)
+
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = 0
+
+	for ctx.Err() == nil {
+		err := s.runStream(ctx, retryBackoff)
+
+		if err == errRenegotiate {
+			continue
+		}
+
+		// the archivist refused the compressor it advertised, try without
+		if (status.Code(err) == codes.Unimplemented) && s.compressing() {
+			fmt.Printf("archivist refused %s compression (err: %s)\n", s.compressor, err.Error())
+			s.mu.Lock()
+			s.compressor = ""
+			s.useCompressor = false
+			s.mu.Unlock()
+			continue
+		}
+
+		if status.Code(err) == codes.Unimplemented {
+			fmt.Printf("archivist does not support streams, sending batches one by one\n")
+			s.runUnary(ctx)
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		d := retryBackoff.NextBackOff()
+		fmt.Printf("stream failed, reconnecting in %s (err: %s)...\n", d.String(), err.Error())
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *streamSender) compressing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.useCompressor
+}
+
+// negotiate records what the archivist supports, it returns true if the
+// stream must be reopened with the compressor.
+func (s *streamSender) negotiate(header metadata.MD) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.useDict = false
+	if s.payloads != nil {
+		id := compression.FormatDictionaryID(s.payloads.DictionaryID())
+		for _, accepted := range header.Get(compression.DictionariesHeader) {
+			if accepted == id {
+				s.useDict = true
+			}
+		}
+	}
+
+	if (s.compressor == "") || s.useCompressor {
+		return false
+	}
+
+	for _, accepted := range header.Get(compression.CompressorsHeader) {
+		if accepted == s.compressor {
+			s.useCompressor = true
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *streamSender) runStream(ctx context.Context, retryBackoff backoff.BackOff) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var opts []grpc.CallOption
+	if s.compressing() {
+		opts = append(opts, grpc.UseCompressor(s.compressor))
+	}
+
+	stream, err := s.client.StreamPackets(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	negotiating := (s.compressor != "") || (s.payloads != nil)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		// older archivists send no header before the first acknowledgement,
+		// the batches are sent uncompressed meanwhile
+		if negotiating {
+			header, err := stream.Header()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			if s.negotiate(header) {
+				recvErr <- errRenegotiate
+				return
+			}
+		}
+
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			retryBackoff.Reset()
+			s.ack(ack.Sequence)
+		}
+	}()
+
+	// everything not acknowledged is sent again
+	s.mu.Lock()
+	s.sent = 0
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		batches := append([]*pendingBatch{}, s.pending[s.sent:]...)
+		s.sent = len(s.pending)
+		useDict := s.useDict
+		s.mu.Unlock()
+
+		for _, batch := range batches {
+			if err := s.sendBatch(ctx, stream, batch.msg, useDict); err != nil {
+				// the cause is returned by Recv
+				return <-recvErr
+			}
+		}
+
+		select {
+		case <-s.queued:
+		case err := <-recvErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendBatch sends a batch, its packets are compressed with the dictionary
+// if the archivist knows it.
+func (s *streamSender) sendBatch(ctx context.Context, stream pb.Archivist_StreamPacketsClient, msg *pb.StreamBatch, useDict bool) (err error) {
+	_, span := _tracer.Start(ctx, "sendBatch",
+		trace.WithAttributes(
+			attribute.Int64("sequence", int64(msg.Sequence)),
+			attribute.Int("packets_count", len(msg.Batch.Packets)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	rawSize := proto.Size(msg)
+	metrics.GetOrCreateCounter(`sent_raw_bytes`).AddInt64(int64(rawSize))
+
+	// the pending batch is kept raw as it may be resent on a stream where
+	// the dictionary is not accepted
+	if useDict {
+		msg = &pb.StreamBatch{
+			Sequence: msg.Sequence,
+			Batch:    &pb.PacketBatch{Packets: s.payloads.Encode(msg.Batch.Packets)},
+		}
+	}
+
+	encodedSize := proto.Size(msg)
+
+	span.SetAttributes(
+		attribute.String("compressor", s.compressorInUse()),
+		attribute.Bool("dictionary", useDict),
+		attribute.Int("raw_bytes", rawSize),
+		attribute.Int("encoded_bytes", encodedSize),
+	)
+	if encodedSize > 0 {
+		span.SetAttributes(attribute.Float64("dictionary_ratio", float64(rawSize)/float64(encodedSize)))
+	}
+
+	err = stream.Send(msg)
+	return
+}
+
+func (s *streamSender) compressorInUse() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.useCompressor {
+		return s.compressor
+	}
+
+	return ""
+}
+
+func (s *streamSender) runUnary(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		var batch *pendingBatch
+		if len(s.pending) > 0 {
+			batch = s.pending[0]
+		}
+		s.mu.Unlock()
+
+		if batch == nil {
+			select {
+			case <-s.queued:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := s.unary(ctx, batch.msg.Batch.Packets); err != nil {
+			return
+		}
+
+		s.ack(batch.msg.Sequence)
+	}
+}
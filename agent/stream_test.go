@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/schmurfy/sniffit/compression"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+// fakeArchivist records the sequences received, the stream handler is
+// replaced by each test
+type fakeArchivist struct {
+	pb.UnimplementedArchivistServer
+
+	mu       sync.Mutex
+	received []uint64
+	unary    int
+	handler  func(pb.Archivist_StreamPacketsServer) error
+}
+
+func (f *fakeArchivist) SendPacket(ctx context.Context, batch *pb.PacketBatch) (*pb.SendPacketResp, error) {
+	f.mu.Lock()
+	f.unary++
+	f.mu.Unlock()
+
+	return &pb.SendPacketResp{}, nil
+}
+
+func (f *fakeArchivist) StreamPackets(stream pb.Archivist_StreamPacketsServer) error {
+	return f.handler(stream)
+}
+
+func (f *fakeArchivist) record(seq uint64) {
+	f.mu.Lock()
+	f.received = append(f.received, seq)
+	f.mu.Unlock()
+}
+
+func (f *fakeArchivist) Received() []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]uint64{}, f.received...)
+}
+
+// withoutStream hides StreamPackets like an older archivist
+type withoutStream struct {
+	pb.UnimplementedArchivistServer
+	*fakeArchivist
+}
+
+func (w *withoutStream) StreamPackets(stream pb.Archivist_StreamPacketsServer) error {
+	return w.UnimplementedArchivistServer.StreamPackets(stream)
+}
+
+func (w *withoutStream) SendPacket(ctx context.Context, batch *pb.PacketBatch) (*pb.SendPacketResp, error) {
+	return w.fakeArchivist.SendPacket(ctx, batch)
+}
+
+func TestStreamSender(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("streamSender", func() {
+		var server *grpc.Server
+		var archivist *fakeArchivist
+		var sender *streamSender
+		var ctx context.Context
+		var cancel context.CancelFunc
+		var compressor string
+
+		start := func(srv pb.ArchivistServer, window int) {
+			lis := bufconn.Listen(1 << 20)
+
+			server = grpc.NewServer()
+			pb.RegisterArchivistServer(server, srv)
+			go server.Serve(lis)
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return lis.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.Nil(g, err)
+
+			client := pb.NewArchivistClient(conn)
+			sender = newStreamSender(client, window, func(ctx context.Context, pkts []*pb.Packet) error {
+				_, err := client.SendPacket(ctx, &pb.PacketBatch{Packets: pkts})
+				return err
+			})
+			sender.SetCompression(compressor, nil)
+
+			go sender.Run(ctx)
+		}
+
+		// acknowledges every batch received
+		ackAll := func(stream pb.Archivist_StreamPacketsServer) error {
+			for {
+				msg, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				archivist.record(msg.Sequence)
+
+				err = stream.Send(&pb.StreamAck{Sequence: msg.Sequence})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		send := func(id string) <-chan struct{} {
+			acked, err := sender.Send(ctx, []*pb.Packet{{Id: id}})
+			require.Nil(g, err)
+			return acked
+		}
+
+		wait := func(acked <-chan struct{}) {
+			select {
+			case <-acked:
+			case <-time.After(5 * time.Second):
+				g.Fail("batch not acknowledged")
+			}
+		}
+
+		g.BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+			compressor = ""
+			archivist = &fakeArchivist{handler: ackAll}
+		})
+
+		g.AfterEach(func() {
+			cancel()
+			server.Stop()
+		})
+
+		g.It("should send batches without waiting for their acknowledgement", func() {
+			start(archivist, 8)
+
+			acks := []<-chan struct{}{send("p1"), send("p2"), send("p3")}
+			for _, acked := range acks {
+				wait(acked)
+			}
+
+			assert.Equal(g, []uint64{1, 2, 3}, archivist.Received())
+		})
+
+		g.It("should block when the window is full", func() {
+			// never acknowledges
+			archivist.handler = func(stream pb.Archivist_StreamPacketsServer) error {
+				<-stream.Context().Done()
+				return nil
+			}
+			start(archivist, 2)
+
+			send("p1")
+			send("p2")
+
+			sendCtx, sendCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer sendCancel()
+
+			_, err := sender.Send(sendCtx, []*pb.Packet{{Id: "p3"}})
+			assert.NotNil(g, err)
+		})
+
+		g.It("should not queue the batch when the window is full without blocking", func() {
+			// never acknowledges
+			archivist.handler = func(stream pb.Archivist_StreamPacketsServer) error {
+				<-stream.Context().Done()
+				return nil
+			}
+			start(archivist, 2)
+
+			_, sent := sender.TrySend([]*pb.Packet{{Id: "p1"}})
+			assert.True(g, sent)
+			send("p2")
+
+			_, sent = sender.TrySend([]*pb.Packet{{Id: "p3"}})
+			assert.False(g, sent)
+		})
+
+		g.It("should resend the batches not acknowledged after a reconnection", func() {
+			streams := 0
+			archivist.handler = func(stream pb.Archivist_StreamPacketsServer) error {
+				archivist.mu.Lock()
+				streams++
+				first := streams == 1
+				archivist.mu.Unlock()
+
+				if !first {
+					return ackAll(stream)
+				}
+
+				// acknowledges the first batch and fails on the second one
+				msg, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				archivist.record(msg.Sequence)
+				stream.Send(&pb.StreamAck{Sequence: msg.Sequence})
+
+				msg, err = stream.Recv()
+				if err != nil {
+					return err
+				}
+				archivist.record(msg.Sequence)
+				return io.ErrUnexpectedEOF
+			}
+			start(archivist, 8)
+
+			wait(send("p1"))
+			wait(send("p2"))
+			wait(send("p3"))
+
+			assert.Equal(g, []uint64{1, 2, 2, 3}, archivist.Received())
+		})
+
+		g.It("should reopen the stream with the compressor accepted by the archivist", func() {
+			streams := 0
+			archivist.handler = func(stream pb.Archivist_StreamPacketsServer) error {
+				archivist.mu.Lock()
+				streams++
+				archivist.mu.Unlock()
+
+				err := stream.SendHeader(metadata.Pairs(compression.CompressorsHeader, compression.Zstd))
+				if err != nil {
+					return err
+				}
+
+				return ackAll(stream)
+			}
+
+			compressor = compression.Zstd
+			start(archivist, 8)
+
+			wait(send("p1"))
+			wait(send("p2"))
+
+			assert.Equal(g, compression.Zstd, sender.compressorInUse())
+
+			archivist.mu.Lock()
+			defer archivist.mu.Unlock()
+			assert.Equal(g, 2, streams)
+		})
+
+		g.It("should send batches one by one to older archivists", func() {
+			start(&withoutStream{fakeArchivist: archivist}, 8)
+
+			wait(send("p1"))
+			wait(send("p2"))
+
+			archivist.mu.Lock()
+			defer archivist.mu.Unlock()
+			assert.Equal(g, 2, archivist.unary)
+		})
+	})
+}
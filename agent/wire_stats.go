@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+)
+
+// wireStats counts the bytes sent to the archivist once compressed, the
+// compression ratio compares them to the batches before any compression
+// (sent_raw_bytes).
+type wireStats struct{}
+
+func newWireStats() *wireStats {
+	metrics.GetOrCreateGauge(`compression_ratio`, func() float64 {
+		compressed := metrics.GetOrCreateCounter(`sent_compressed_bytes`).Get()
+		if compressed == 0 {
+			return 1
+		}
+
+		return float64(metrics.GetOrCreateCounter(`sent_raw_bytes`).Get()) / float64(compressed)
+	})
+
+	return &wireStats{}
+}
+
+func (w *wireStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (w *wireStats) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	out, ok := s.(*stats.OutPayload)
+	if !ok {
+		return
+	}
+
+	metrics.GetOrCreateCounter(`sent_message_bytes`).Add(out.Length)
+	metrics.GetOrCreateCounter(`sent_compressed_bytes`).Add(out.CompressedLength)
+	metrics.GetOrCreateCounter(`sent_wire_bytes`).Add(out.WireLength)
+
+	trace.SpanFromContext(ctx).AddEvent("payload sent", trace.WithAttributes(
+		attribute.Int("message_bytes", out.Length),
+		attribute.Int("compressed_bytes", out.CompressedLength),
+		attribute.Int("wire_bytes", out.WireLength),
+	))
+}
+
+func (w *wireStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (w *wireStats) HandleConn(context.Context, stats.ConnStats) {}
@@ -0,0 +1,145 @@
+package archivist
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+type flushFunc func(context.Context, []*models.Packet) error
+
+type pendingBatch struct {
+	pkts    []*models.Packet
+	waiters []*waiter
+}
+
+// waiter is a caller waiting for the flush of the count packets it added.
+type waiter struct {
+	count int
+	done  chan error
+}
+
+// accumulator coalesces the batches received from the agents so the stores
+// receive fewer and larger writes, a batch is flushed when it holds maxSize
+// packets or when its oldest packets waited for maxDelay.
+// The callers wait until their packets are flushed so the agents are only
+// acknowledged once the packets are stored.
+type accumulator struct {
+	mu       sync.Mutex
+	pending  *pendingBatch
+	timer    *time.Timer
+	maxSize  int
+	maxDelay time.Duration
+	flush    flushFunc
+}
+
+func newAccumulator(maxSize int, maxDelay time.Duration, flush flushFunc) *accumulator {
+	return &accumulator{
+		pending:  &pendingBatch{},
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		flush:    flush,
+	}
+}
+
+// Add queues the packets and returns the result of their flush, when the
+// context is cancelled first the packets are taken back unless their flush
+// already started.
+func (a *accumulator) Add(ctx context.Context, pkts []*models.Packet) error {
+	w := &waiter{count: len(pkts), done: make(chan error, 1)}
+
+	a.mu.Lock()
+	batch := a.pending
+	batch.pkts = append(batch.pkts, pkts...)
+	batch.waiters = append(batch.waiters, w)
+
+	if len(batch.pkts) >= a.maxSize {
+		a.take()
+		a.mu.Unlock()
+
+		// the batch is shared with other agents, it should not be
+		// cancelled with this request
+		a.run(context.WithoutCancel(ctx), batch)
+	} else {
+		if a.timer == nil {
+			a.timer = time.AfterFunc(a.maxDelay, a.flushPending)
+		}
+		a.mu.Unlock()
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the agent sends the packets again after an error, they must not be
+	// stored by this flush too
+	if a.remove(batch, w) {
+		return ctx.Err()
+	}
+
+	return <-w.done
+}
+
+// remove takes the packets of the waiter back out of the batch, it returns
+// false if the batch is already being flushed.
+func (a *accumulator) remove(batch *pendingBatch, w *waiter) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending != batch {
+		return false
+	}
+
+	offset := 0
+	for i, other := range batch.waiters {
+		if other == w {
+			batch.pkts = append(batch.pkts[:offset], batch.pkts[offset+w.count:]...)
+			batch.waiters = append(batch.waiters[:i], batch.waiters[i+1:]...)
+			break
+		}
+
+		offset += other.count
+	}
+
+	if (len(batch.waiters) == 0) && (a.timer != nil) {
+		a.timer.Stop()
+		a.timer = nil
+	}
+
+	return true
+}
+
+func (a *accumulator) flushPending() {
+	a.mu.Lock()
+	batch := a.take()
+	a.mu.Unlock()
+
+	a.run(context.Background(), batch)
+}
+
+// take returns the pending batch and starts a new one, the lock must be held.
+func (a *accumulator) take() *pendingBatch {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+
+	ret := a.pending
+	a.pending = &pendingBatch{}
+	return ret
+}
+
+func (a *accumulator) run(ctx context.Context, batch *pendingBatch) {
+	if len(batch.waiters) == 0 {
+		return
+	}
+
+	err := a.flush(ctx, batch.pkts)
+	for _, w := range batch.waiters {
+		w.done <- err
+	}
+}
@@ -0,0 +1,146 @@
+// +build test
+
+package archivist
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+func TestAccumulator(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("accumulator", func() {
+		var flushed [][]*models.Packet
+		var flushErr error
+		var mu sync.Mutex
+
+		flush := func(ctx context.Context, pkts []*models.Packet) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			flushed = append(flushed, pkts)
+			return flushErr
+		}
+
+		packets := func(ids ...string) []*models.Packet {
+			ret := make([]*models.Packet, len(ids))
+			for i, id := range ids {
+				ret[i] = &models.Packet{Id: id}
+			}
+			return ret
+		}
+
+		g.BeforeEach(func() {
+			flushed = nil
+			flushErr = nil
+		})
+
+		g.It("should flush when the batch is full", func() {
+			acc := newAccumulator(3, time.Hour, flush)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.Nil(g, acc.Add(context.Background(), packets("p1", "p2")))
+			}()
+
+			// wait for the first batch to be queued
+			require.Eventually(g, func() bool {
+				acc.mu.Lock()
+				defer acc.mu.Unlock()
+				return len(acc.pending.pkts) == 2
+			}, time.Second, time.Millisecond)
+
+			err := acc.Add(context.Background(), packets("p3"))
+			require.Nil(g, err)
+			wg.Wait()
+
+			require.Len(g, flushed, 1)
+			assert.Len(g, flushed[0], 3)
+		})
+
+		g.It("should flush after the delay", func() {
+			acc := newAccumulator(100, 10*time.Millisecond, flush)
+
+			err := acc.Add(context.Background(), packets("p1"))
+			require.Nil(g, err)
+
+			require.Len(g, flushed, 1)
+			assert.Len(g, flushed[0], 1)
+		})
+
+		g.It("should not store the packets of a cancelled caller", func() {
+			acc := newAccumulator(100, 50*time.Millisecond, flush)
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.Nil(g, acc.Add(context.Background(), packets("p1")))
+			}()
+
+			require.Eventually(g, func() bool {
+				acc.mu.Lock()
+				defer acc.mu.Unlock()
+				return len(acc.pending.pkts) == 1
+			}, time.Second, time.Millisecond)
+
+			cancel()
+			err := acc.Add(ctx, packets("p2", "p3"))
+			assert.Equal(g, context.Canceled, err)
+
+			wg.Wait()
+
+			require.Len(g, flushed, 1)
+			require.Len(g, flushed[0], 1)
+			assert.Equal(g, "p1", flushed[0][0].Id)
+		})
+
+		g.It("should wait for a flush already started", func() {
+			started := make(chan struct{})
+			release := make(chan struct{})
+
+			acc := newAccumulator(100, time.Millisecond, func(ctx context.Context, pkts []*models.Packet) error {
+				close(started)
+				<-release
+				return flush(ctx, pkts)
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			result := make(chan error, 1)
+			go func() {
+				result <- acc.Add(ctx, packets("p1"))
+			}()
+
+			<-started
+			cancel()
+			close(release)
+
+			// the packets were stored, the caller is not told otherwise
+			assert.Nil(g, <-result)
+			require.Len(g, flushed, 1)
+		})
+
+		g.It("should return the flush error", func() {
+			flushErr = errors.New("store failed")
+			acc := newAccumulator(1, time.Hour, flush)
+
+			err := acc.Add(context.Background(), packets("p1"))
+			assert.Equal(g, flushErr, err)
+		})
+	})
+}
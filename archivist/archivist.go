@@ -2,8 +2,11 @@ package archivist
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
@@ -13,8 +16,10 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 
+	"github.com/schmurfy/sniffit/compression"
 	"github.com/schmurfy/sniffit/config"
 	pb "github.com/schmurfy/sniffit/generated_pb/proto"
 	"github.com/schmurfy/sniffit/models"
@@ -31,15 +36,99 @@ type Archivist struct {
 	indexStore store.IndexInterface
 	stats      *stats.Stats
 	retention  time.Duration
+
+	// nil if the data store cannot persist flows
+	flowStore store.FlowInterface
+	flows     *flowTable
+
+	// nil if the batches are stored as they are received
+	accumulator *accumulator
+
+	// nil if the duplicates are not detected
+	dedup *deduplicator
+
+	streams *streamSessions
+
+	// nil if no dictionary is configured
+	payloads *compression.PayloadDecoder
+
+	// nil to serve in plaintext
+	serverTLS *tls.Config
+
+	// nil if the agents are not authenticated
+	auth *authenticator
 }
 
-func New(store store.StoreInterface, idx store.IndexInterface, st *stats.Stats, cfg *config.ArchivistConfig) (*Archivist, error) {
-	return &Archivist{
-		dataStore:  store,
+func New(dataStore store.StoreInterface, idx store.IndexInterface, st *stats.Stats, cfg *config.ArchivistConfig) (*Archivist, error) {
+	ret := &Archivist{
+		dataStore:  dataStore,
 		indexStore: idx,
 		stats:      st,
 		retention:  cfg.DataRetention,
-	}, nil
+		streams:    newStreamSessions(),
+	}
+
+	if cfg.FlowIdleTimeout > 0 {
+		flowStore, ok := dataStore.(store.FlowInterface)
+		if !ok {
+			return nil, errors.New("the store does not support flows, set flow_idle_timeout to 0")
+		}
+
+		ret.flowStore = flowStore
+		ret.flows = newFlowTable(cfg.FlowIdleTimeout)
+	}
+
+	if cfg.DedupWindow > 0 {
+		dedup, err := newDeduplicator(cfg.DedupMode, cfg.DedupWindow)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.dedup = dedup
+	}
+
+	if cfg.CompressionDicts != "" {
+		var dicts [][]byte
+		for _, path := range strings.Split(cfg.CompressionDicts, ",") {
+			dict, _, err := compression.LoadDictionary(strings.TrimSpace(path))
+			if err != nil {
+				return nil, err
+			}
+
+			dicts = append(dicts, dict)
+		}
+
+		payloads, err := compression.NewPayloadDecoder(dicts...)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.payloads = payloads
+	}
+
+	if cfg.TLSConfig.Enabled() {
+		serverTLS, err := cfg.TLSConfig.ServerTLS()
+		if err != nil {
+			return nil, err
+		}
+
+		ret.serverTLS = serverTLS
+	}
+
+	if (cfg.AgentTokens != "") || (cfg.AgentTokenSecret != "") {
+		auth, err := newAuthenticator(cfg.AgentTokens, cfg.AgentTokenSecret, cfg.UnknownAgents, st)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.auth = auth
+	}
+
+	if cfg.StoreBatchSize > 0 {
+		ret.accumulator = newAccumulator(cfg.StoreBatchSize, cfg.StoreBatchDelay, ret.storePackets)
+	}
+
+	return ret, nil
 }
 
 func (ar *Archivist) Start(address string) error {
@@ -48,14 +137,33 @@ func (ar *Archivist) Start(address string) error {
 		return errors.WithStack(err)
 	}
 
-	s := grpc.NewServer(
-		grpc.StatsHandler(otelgrpc.NewServerHandler()),
-	)
+	s := grpc.NewServer(ar.serverOptions()...)
 	pb.RegisterArchivistServer(s, ar)
 
 	return s.Serve(lis)
 }
 
+// serverOptions returns the options of the grpc server: TLS and the
+// authentication of the agents when configured.
+func (ar *Archivist) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+	}
+
+	if ar.serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(ar.serverTLS)))
+	}
+
+	if ar.auth != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(ar.auth.unaryInterceptor),
+			grpc.ChainStreamInterceptor(ar.auth.streamInterceptor),
+		)
+	}
+
+	return opts
+}
+
 func (ar *Archivist) handleReceivePackets(ctx context.Context, pbPacketBatch *pb.PacketBatch) (err error) {
 	ctx, span := _tracer.Start(ctx, "handleReceivePackets",
 		trace.WithAttributes(
@@ -68,13 +176,55 @@ func (ar *Archivist) handleReceivePackets(ctx context.Context, pbPacketBatch *pb
 		span.End()
 	}()
 
+	// acknowledged so the agent does not retry, but not stored
+	if quarantined, ok := quarantinedAgent(ctx); ok {
+		span.SetAttributes(attribute.String("quarantined-agent", quarantined))
+		ar.stats.RegisterQuarantinedPackets(quarantined, len(pbPacketBatch.Packets))
+		metrics.GetOrCreateCounter(`packets_quarantined`).AddInt64(int64(len(pbPacketBatch.Packets)))
+		return
+	}
+
+	agentName, err := agentName(ctx)
+	if err != nil {
+		return
+	}
+
 	md, _ := metadata.FromIncomingContext(ctx)
-	agentName := md["agent-name"][0]
 
 	span.SetAttributes(
 		attribute.String("agent-name", agentName),
 	)
 
+	// capture settings are not sent by older agents, the agents capturing
+	// several interfaces send one value per interface for each key
+	interfaces := md.Get("agent-interface")
+	snapLens := md.Get("agent-snaplen")
+	filters := md.Get("agent-filter")
+	for n, ifName := range interfaces {
+		var snapLen int64
+		if n < len(snapLens) {
+			snapLen, _ = strconv.ParseInt(snapLens[n], 10, 32)
+		}
+
+		var filter string
+		if n < len(filters) {
+			filter = filters[n]
+		}
+
+		ar.stats.RegisterCapture(agentName, ifName, filter, int32(snapLen))
+	}
+
+	// the packets of older agents are not labelled with their interface
+	var defaultIfName string
+	if len(interfaces) == 1 {
+		defaultIfName = interfaces[0]
+	}
+
+	err = ar.decodePayloads(pbPacketBatch.Packets)
+	if err != nil {
+		return
+	}
+
 	pkts := make([]*models.Packet, len(pbPacketBatch.Packets))
 	fmt.Printf("received %d packets from %s\n", len(pkts), agentName)
 
@@ -82,6 +232,10 @@ func (ar *Archivist) handleReceivePackets(ctx context.Context, pbPacketBatch *pb
 
 	for n, pbPacket := range pbPacketBatch.Packets {
 		pkts[n] = models.NewPacketFromProto(pbPacket)
+		pkts[n].Agent = agentName
+		if pkts[n].Interface == "" {
+			pkts[n].Interface = defaultIfName
+		}
 		if lastTime.Before(pkts[n].Timestamp) {
 			lastTime = pkts[n].Timestamp
 		}
@@ -91,6 +245,56 @@ func (ar *Archivist) handleReceivePackets(ctx context.Context, pbPacketBatch *pb
 
 	metrics.GetOrCreateCounter(`packets_received`).AddInt64(int64(len(pkts)))
 
+	if ar.dedup != nil {
+		var duplicates int
+		pkts, duplicates = ar.dedup.Filter(pkts)
+
+		span.SetAttributes(attribute.Int("duplicates-count", duplicates))
+		metrics.GetOrCreateCounter(`packets_duplicated`).AddInt64(int64(duplicates))
+
+		if len(pkts) == 0 {
+			return
+		}
+	}
+
+	if ar.accumulator != nil {
+		err = ar.accumulator.Add(ctx, pkts)
+		return
+	}
+
+	err = ar.storePackets(ctx, pkts)
+	return
+}
+
+// decodePayloads decompresses the data of the packets compressed with a
+// dictionary.
+func (ar *Archivist) decodePayloads(pkts []*pb.Packet) error {
+	if ar.payloads != nil {
+		return ar.payloads.Decode(pkts)
+	}
+
+	for _, pkt := range pkts {
+		if pkt.DataEncoding != pb.DataEncoding_RAW {
+			return errors.Errorf("packet %s is compressed but no dictionary is configured", pkt.Id)
+		}
+	}
+
+	return nil
+}
+
+// storePackets stores the packets, their index and updates the conversations.
+func (ar *Archivist) storePackets(ctx context.Context, pkts []*models.Packet) (err error) {
+	ctx, span := _tracer.Start(ctx, "storePackets",
+		trace.WithAttributes(
+			attribute.Int("events-count", len(pkts)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
 	// store the packet data
 	err = errors.WithStack(ar.dataStore.StorePackets(ctx, pkts))
 	if err != nil {
@@ -103,6 +307,18 @@ func (ar *Archivist) handleReceivePackets(ctx context.Context, pbPacketBatch *pb
 		return
 	}
 
+	// finally update the conversations
+	if ar.flowStore != nil {
+		for _, pkt := range pkts {
+			pkt.Decode()
+		}
+
+		err = errors.WithStack(ar.flowStore.StoreFlows(ctx, ar.flows.Update(pkts)))
+		if err != nil {
+			return
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,124 @@
+// +build test
+
+package archivist
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/schmurfy/sniffit/config"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestCaptureInterfaces(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("capture interfaces", func() {
+		var arc *Archivist
+		var st *stats.Stats
+		var dataStore *countingStore
+		var dir string
+
+		addr1 := net.ParseIP("10.0.0.1").To4()
+		addr2 := net.ParseIP("10.0.0.2").To4()
+
+		packet := func(id string, ifName string) *pb.Packet {
+			return &pb.Packet{
+				Id:            id,
+				Data:          store.BuildPacket(addr1, addr2),
+				TimestampNano: time.Now().UnixNano(),
+				Interface:     ifName,
+			}
+		}
+
+		// returns the interface of each stored packet
+		interfaces := func(ids ...string) map[string]string {
+			pkts, err := dataStore.GetPackets(context.Background(), ids, nil)
+			require.Nil(g, err)
+
+			ret := map[string]string{}
+			for _, pkt := range pkts {
+				ret[pkt.Id] = pkt.Interface
+			}
+			return ret
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "archivist")
+			require.Nil(g, err)
+
+			dataStore, err = openCountingStore(dir)
+			require.Nil(g, err)
+
+			st = stats.NewStats()
+			arc, err = New(dataStore, dataStore.BadgerStore, st, &config.ArchivistConfig{DataRetention: time.Hour})
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			dataStore.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should record the interface of each packet", func() {
+			md := metadata.Pairs("agent-name", "agent1")
+			md.Append("agent-interface", "eth0", "eth1")
+			md.Append("agent-filter", "not port 22", "")
+			md.Append("agent-snaplen", "128", "1500")
+
+			_, err := arc.SendPacket(metadata.NewIncomingContext(context.Background(), md), &pb.PacketBatch{Packets: []*pb.Packet{
+				packet("p1", "eth0"),
+				packet("p2", "eth1"),
+			}})
+			require.Nil(g, err)
+
+			assert.Equal(g, map[string]string{"p1": "eth0", "p2": "eth1"}, interfaces("p1", "p2"))
+
+			src := st.Source("agent1")
+			require.NotNil(g, src)
+
+			ifName, c := src.Capture("eth0")
+			assert.Equal(g, "eth0", ifName)
+			assert.Equal(g, &stats.Capture{Filter: "not port 22", SnapLen: 128}, c)
+
+			_, c = src.Capture("eth1")
+			assert.Equal(g, &stats.Capture{SnapLen: 1500}, c)
+
+			// several interfaces, the packet can not be attributed
+			_, c = src.Capture("")
+			assert.Nil(g, c)
+		})
+
+		g.It("should label the packets of older agents with their interface", func() {
+			md := metadata.Pairs(
+				"agent-name", "agent1",
+				"agent-interface", "eth0",
+				"agent-filter", "tcp",
+				"agent-snaplen", "1500",
+			)
+
+			_, err := arc.SendPacket(metadata.NewIncomingContext(context.Background(), md), &pb.PacketBatch{Packets: []*pb.Packet{
+				packet("p1", ""),
+			}})
+			require.Nil(g, err)
+
+			assert.Equal(g, map[string]string{"p1": "eth0"}, interfaces("p1"))
+
+			ifName, c := st.Source("agent1").Capture("")
+			assert.Equal(g, "eth0", ifName)
+			assert.Equal(g, &stats.Capture{Filter: "tcp", SnapLen: 1500}, c)
+		})
+	})
+}
@@ -0,0 +1,216 @@
+package archivist
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/schmurfy/sniffit/stats"
+)
+
+const (
+	UnknownAgentsReject     = "reject"
+	UnknownAgentsQuarantine = "quarantine"
+)
+
+type authenticatedAgentKey struct{}
+type quarantinedAgentKey struct{}
+
+// authenticator checks the bearer token sent by the agents in the
+// authorization metadata, each token is bound to an agent name: listed in
+// the tokens file or signed with the secret.
+type authenticator struct {
+	// token -> agent name
+	tokens     map[string]string
+	secret     []byte
+	quarantine bool
+	stats      *stats.Stats
+}
+
+func newAuthenticator(tokensPath string, secret string, unknownAgents string, st *stats.Stats) (*authenticator, error) {
+	ret := &authenticator{
+		tokens: map[string]string{},
+		secret: []byte(secret),
+		stats:  st,
+	}
+
+	switch unknownAgents {
+	case UnknownAgentsReject, "":
+	case UnknownAgentsQuarantine:
+		ret.quarantine = true
+	default:
+		return nil, errors.Errorf("unknown mode for the unknown agents: %s", unknownAgents)
+	}
+
+	if tokensPath != "" {
+		err := ret.loadTokens(tokensPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// loadTokens reads a file with one "<agent name> <token>" per line, empty
+// lines and lines starting with # are ignored.
+func (a *authenticator) loadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.Errorf("%s:%d: expected <agent name> <token>", path, lineNumber)
+		}
+
+		a.tokens[fields[1]] = fields[0]
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+// SignToken returns a token for the agent signed with the secret, the
+// archivist accepts it with the same agent_token_secret.
+func SignToken(secret string, agent string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(agent))
+
+	return agent + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the agent the token is bound to.
+func (a *authenticator) verify(token string) (string, bool) {
+	for known, agent := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return agent, true
+		}
+	}
+
+	if len(a.secret) == 0 {
+		return "", false
+	}
+
+	// the signature never contains a dot, the agent name may
+	n := strings.LastIndexByte(token, '.')
+	if n <= 0 {
+		return "", false
+	}
+
+	agent := token[:n]
+	if !hmac.Equal([]byte(SignToken(string(a.secret), agent)), []byte(token)) {
+		return "", false
+	}
+
+	return agent, true
+}
+
+// authenticate returns the context of the request with the agent
+// authenticated, or quarantined if it has no valid token.
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var declared string
+	if values := md.Get("agent-name"); len(values) > 0 {
+		declared = values[0]
+	}
+
+	var reason string
+	values := md.Get("authorization")
+	switch {
+	case len(values) == 0:
+		reason = "missing token"
+
+	case !strings.HasPrefix(values[0], "Bearer "):
+		reason = "not a bearer token"
+
+	default:
+		agent, valid := a.verify(strings.TrimPrefix(values[0], "Bearer "))
+		switch {
+		case !valid:
+			reason = "invalid token"
+		case (declared != "") && (declared != agent):
+			reason = fmt.Sprintf("token of agent %s", agent)
+		default:
+			return context.WithValue(ctx, authenticatedAgentKey{}, agent), nil
+		}
+	}
+
+	var address string
+	if p, ok := peer.FromContext(ctx); ok {
+		address = p.Addr.String()
+	}
+
+	name := declared
+	if name == "" {
+		name = address
+	}
+
+	a.stats.RegisterRejection(name, address, reason, a.quarantine)
+	metrics.GetOrCreateCounter(`agents_rejected`).Inc()
+
+	if a.quarantine && (declared != "") {
+		return context.WithValue(ctx, quarantinedAgentKey{}, declared), nil
+	}
+
+	return nil, status.Error(codes.Unauthenticated, reason)
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// quarantinedAgent returns the name of the agent if it is quarantined.
+func quarantinedAgent(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(quarantinedAgentKey{}).(string)
+	return name, ok
+}
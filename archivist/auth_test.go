@@ -0,0 +1,203 @@
+// +build test
+
+package archivist
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/schmurfy/sniffit/config"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestAgentTokens(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("agent tokens", func() {
+		var server *grpc.Server
+		var client pb.ArchivistClient
+		var dataStore *countingStore
+		var st *stats.Stats
+		var dir string
+
+		start := func(unknownAgents string) {
+			tokens := filepath.Join(dir, "tokens")
+			err := os.WriteFile(tokens, []byte("# agents\nagent1 s3cr3t\n\nagent2 0th3r\n"), 0600)
+			require.Nil(g, err)
+
+			arc, err := New(dataStore, dataStore.BadgerStore, st, &config.ArchivistConfig{
+				DataRetention:    time.Hour,
+				AgentTokens:      tokens,
+				AgentTokenSecret: "secret",
+				UnknownAgents:    unknownAgents,
+			})
+			require.Nil(g, err)
+
+			lis := bufconn.Listen(1 << 20)
+			server = grpc.NewServer(arc.serverOptions()...)
+			pb.RegisterArchivistServer(server, arc)
+			go server.Serve(lis)
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return lis.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.Nil(g, err)
+
+			client = pb.NewArchivistClient(conn)
+		}
+
+		send := func(name string, token string) error {
+			md := metadata.Pairs("agent-name", name)
+			if token != "" {
+				md.Append("authorization", "Bearer "+token)
+			}
+
+			ctx := metadata.NewOutgoingContext(context.Background(), md)
+			_, err := client.SendPacket(ctx, &pb.PacketBatch{Packets: []*pb.Packet{
+				{Id: "p1", Data: store.BuildPacket(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()), TimestampNano: time.Now().UnixNano()},
+			}})
+			return err
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "archivist")
+			require.Nil(g, err)
+
+			dataStore, err = openCountingStore(dir)
+			require.Nil(g, err)
+
+			st = stats.NewStats()
+		})
+
+		g.AfterEach(func() {
+			server.Stop()
+			dataStore.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should accept the tokens of the file", func() {
+			start(UnknownAgentsReject)
+
+			require.Nil(g, send("agent1", "s3cr3t"))
+			assert.Equal(g, []string{"p1"}, dataStore.Stored())
+			assert.NotNil(g, st.Source("agent1"))
+		})
+
+		g.It("should accept the signed tokens", func() {
+			start(UnknownAgentsReject)
+
+			require.Nil(g, send("agent.3", SignToken("secret", "agent.3")))
+			assert.Equal(g, []string{"p1"}, dataStore.Stored())
+		})
+
+		g.It("should reject the agents without a valid token", func() {
+			start(UnknownAgentsReject)
+
+			err := send("agent1", "")
+			assert.Equal(g, codes.Unauthenticated, status.Code(err))
+
+			err = send("agent1", SignToken("other secret", "agent1"))
+			assert.Equal(g, codes.Unauthenticated, status.Code(err))
+
+			// bound to another agent
+			err = send("agent1", "0th3r")
+			assert.Equal(g, codes.Unauthenticated, status.Code(err))
+
+			assert.Empty(g, dataStore.Stored())
+
+			rejection := st.Snapshot().Rejections["agent1"]
+			require.NotNil(g, rejection)
+			assert.Equal(g, 3, rejection.Attempts)
+			assert.Equal(g, "token of agent agent2", rejection.Reason)
+			assert.False(g, rejection.Quarantined)
+		})
+
+		g.It("should quarantine the agents without a valid token", func() {
+			start(UnknownAgentsQuarantine)
+
+			require.Nil(g, send("intruder", "guess"))
+			assert.Empty(g, dataStore.Stored())
+			assert.Nil(g, st.Source("intruder"))
+
+			rejection := st.Snapshot().Rejections["intruder"]
+			require.NotNil(g, rejection)
+			assert.Equal(g, 1, rejection.Attempts)
+			assert.Equal(g, 1, rejection.Packets)
+			assert.True(g, rejection.Quarantined)
+		})
+
+		g.It("should not share the stream sessions with the quarantined agents", func() {
+			start(UnknownAgentsQuarantine)
+
+			open := func(token string) pb.Archivist_StreamPacketsClient {
+				md := metadata.Pairs("agent-name", "agent1", "agent-stream", "s1")
+				if token != "" {
+					md.Append("authorization", "Bearer "+token)
+				}
+
+				ctx := metadata.NewOutgoingContext(context.Background(), md)
+				stream, err := client.StreamPackets(ctx)
+				require.Nil(g, err)
+
+				return stream
+			}
+
+			send := func(stream pb.Archivist_StreamPacketsClient, seq uint64, id string) uint64 {
+				err := stream.Send(&pb.StreamBatch{
+					Sequence: seq,
+					Batch: &pb.PacketBatch{Packets: []*pb.Packet{
+						{Id: id, Data: store.BuildPacket(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()), TimestampNano: time.Now().UnixNano()},
+					}},
+				})
+				require.Nil(g, err)
+
+				ack, err := stream.Recv()
+				require.Nil(g, err)
+
+				return ack.Sequence
+			}
+
+			intruder := open("guess")
+			assert.Equal(g, uint64(1000), send(intruder, 1000, "p1"))
+			require.Nil(g, intruder.CloseSend())
+
+			agent := open("s3cr3t")
+			assert.Equal(g, uint64(1), send(agent, 1, "p2"))
+			require.Nil(g, agent.CloseSend())
+
+			assert.Equal(g, []string{"p2"}, dataStore.Stored())
+		})
+
+		g.It("should reject unknown modes", func() {
+			_, err := New(dataStore, dataStore.BadgerStore, st, &config.ArchivistConfig{
+				AgentTokenSecret: "secret",
+				UnknownAgents:    "ignore",
+			})
+			assert.NotNil(g, err)
+
+			// AfterEach stops it
+			server = grpc.NewServer()
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package archivist
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+const (
+	DedupModeDrop = "drop"
+	DedupModeMark = "mark"
+)
+
+type seenPacket struct {
+	id         string
+	agent      string
+	timestamp  time.Time
+	receivedAt time.Time
+}
+
+type seenHash struct {
+	hash       uint64
+	receivedAt time.Time
+}
+
+// deduplicator finds the packets captured by several agents, a packet is a
+// duplicate when another agent sent the same content with a timestamp
+// within window, the packets are remembered for window after their arrival.
+type deduplicator struct {
+	mu     sync.Mutex
+	mode   string
+	window time.Duration
+	seen   map[uint64]*seenPacket
+	// arrival order, used to forget the old packets
+	queue []seenHash
+	now   func() time.Time
+}
+
+func newDeduplicator(mode string, window time.Duration) (*deduplicator, error) {
+	if (mode != DedupModeDrop) && (mode != DedupModeMark) {
+		return nil, errors.Errorf("unknown dedup mode: %q", mode)
+	}
+
+	return &deduplicator{
+		mode:   mode,
+		window: window,
+		seen:   map[uint64]*seenPacket{},
+		now:    time.Now,
+	}, nil
+}
+
+// Filter returns the packets to store and the number of duplicates found,
+// the duplicates are either removed or marked with the id of the first copy
+// depending on the mode.
+// The first copy is remembered before it is stored: when its batch fails,
+// or once the retention removed it, a marked duplicate references a packet
+// missing from the store. The agent resends a failed batch with the same
+// ids and its own copies are not duplicates, the reference is then valid
+// again.
+func (d *deduplicator) Filter(pkts []*models.Packet) ([]*models.Packet, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.expire(now)
+
+	ret := pkts[:0]
+	duplicates := 0
+
+	for _, pkt := range pkts {
+		hash := packetHash(pkt)
+
+		first, exists := d.seen[hash]
+		if exists && (first.agent != pkt.Agent) && (absDuration(pkt.Timestamp.Sub(first.timestamp)) <= d.window) {
+			duplicates++
+
+			if d.mode == DedupModeDrop {
+				continue
+			}
+
+			pkt.DuplicateOf = first.id
+			ret = append(ret, pkt)
+			continue
+		}
+
+		// the same content sent again by an agent is a retransmission
+		d.seen[hash] = &seenPacket{
+			id:         pkt.Id,
+			agent:      pkt.Agent,
+			timestamp:  pkt.Timestamp,
+			receivedAt: now,
+		}
+		d.queue = append(d.queue, seenHash{hash: hash, receivedAt: now})
+		ret = append(ret, pkt)
+	}
+
+	return ret, duplicates
+}
+
+// expire forgets the packets received more than window ago, the lock must
+// be held.
+func (d *deduplicator) expire(now time.Time) {
+	n := 0
+	for ; n < len(d.queue); n++ {
+		entry := d.queue[n]
+		if now.Sub(entry.receivedAt) <= d.window {
+			break
+		}
+
+		// the hash may have been seen again since
+		if first, exists := d.seen[entry.hash]; exists && !first.receivedAt.After(entry.receivedAt) {
+			delete(d.seen, entry.hash)
+		}
+	}
+
+	d.queue = d.queue[n:]
+}
+
+// packetHash hashes the content of a packet from its network layer, the
+// fields updated by the routers (TTL, hop limit and IPv4 checksum) are
+// ignored so the copies captured on both sides of a router match.
+// Non IP frames are hashed with their link layer.
+func packetHash(pkt *models.Packet) uint64 {
+	h := fnv.New64a()
+
+	packet := gopacket.NewPacket(pkt.Data, pkt.CaptureLinkType(), gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+
+	switch ipLayer := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		header := append([]byte{}, ipLayer.LayerContents()...)
+		if len(header) >= 12 {
+			header[8] = 0
+			header[10], header[11] = 0, 0
+		}
+		h.Write(header)
+		h.Write(ipLayer.LayerPayload())
+
+	case *layers.IPv6:
+		header := append([]byte{}, ipLayer.LayerContents()...)
+		if len(header) >= 8 {
+			header[7] = 0
+		}
+		h.Write(header)
+		h.Write(ipLayer.LayerPayload())
+
+	default:
+		h.Write(pkt.Data)
+	}
+
+	return h.Sum64()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
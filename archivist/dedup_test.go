@@ -0,0 +1,137 @@
+// +build test
+
+package archivist
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestDeduplicator(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("deduplicator", func() {
+		var d *deduplicator
+		var now time.Time
+
+		client := net.ParseIP("10.0.0.2").To4()
+		server := net.ParseIP("10.0.0.53").To4()
+
+		packet := func(id, agent string, ts time.Time) *models.Packet {
+			return &models.Packet{Id: id, Data: store.BuildUDPPacket(client, server, 5353, 53),
+				Timestamp: ts, Agent: agent}
+		}
+
+		ids := func(pkts []*models.Packet) []string {
+			ret := []string{}
+			for _, pkt := range pkts {
+				ret = append(ret, pkt.Id)
+			}
+			return ret
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			now = time.Now()
+			d, err = newDeduplicator(DedupModeMark, time.Second)
+			require.Nil(g, err)
+			d.now = func() time.Time { return now }
+		})
+
+		g.It("should reject unknown modes", func() {
+			_, err := newDeduplicator("merge", time.Second)
+			require.NotNil(g, err)
+		})
+
+		g.It("should mark the copies sent by other agents", func() {
+			pkts, duplicates := d.Filter([]*models.Packet{packet("a1", "agent1", now)})
+			assert.Equal(g, 0, duplicates)
+			assert.Equal(g, []string{"a1"}, ids(pkts))
+
+			pkts, duplicates = d.Filter([]*models.Packet{packet("b1", "agent2", now.Add(100*time.Millisecond))})
+			assert.Equal(g, 1, duplicates)
+			require.Len(g, pkts, 1)
+			assert.Equal(g, "a1", pkts[0].DuplicateOf)
+		})
+
+		g.It("should keep the first copy resent by its agent", func() {
+			// the batch of a1 fails to be stored, b1 references a missing packet
+			d.Filter([]*models.Packet{packet("a1", "agent1", now)})
+
+			pkts, duplicates := d.Filter([]*models.Packet{packet("b1", "agent2", now)})
+			assert.Equal(g, 1, duplicates)
+			require.Len(g, pkts, 1)
+			assert.Equal(g, "a1", pkts[0].DuplicateOf)
+
+			// the resent batch stores a1 with the same id
+			pkts, duplicates = d.Filter([]*models.Packet{packet("a1", "agent1", now)})
+			assert.Equal(g, 0, duplicates)
+			assert.Equal(g, []string{"a1"}, ids(pkts))
+			assert.Empty(g, pkts[0].DuplicateOf)
+		})
+
+		g.It("should drop the copies sent by other agents", func() {
+			d.mode = DedupModeDrop
+
+			pkts, duplicates := d.Filter([]*models.Packet{
+				packet("a1", "agent1", now),
+				packet("b1", "agent2", now),
+			})
+			assert.Equal(g, 1, duplicates)
+			assert.Equal(g, []string{"a1"}, ids(pkts))
+		})
+
+		g.It("should ignore the fields updated by routers", func() {
+			routed := packet("b1", "agent2", now)
+
+			// other MAC addresses, TTL and IPv4 checksum
+			routed.Data[0], routed.Data[6] = 0xaa, 0xbb
+			routed.Data[22]--
+			routed.Data[24], routed.Data[25] = 0x12, 0x34
+
+			_, duplicates := d.Filter([]*models.Packet{packet("a1", "agent1", now), routed})
+			assert.Equal(g, 1, duplicates)
+
+			// the UDP payload differs, after the ethernet, IPv4 and UDP headers
+			other := packet("c1", "agent2", now)
+			other.Data[14+20+8]++
+
+			_, duplicates = d.Filter([]*models.Packet{other})
+			assert.Equal(g, 0, duplicates)
+		})
+
+		g.It("should keep retransmissions and packets outside the window", func() {
+			pkts, duplicates := d.Filter([]*models.Packet{
+				packet("a1", "agent1", now),
+				packet("a2", "agent1", now),
+				packet("b1", "agent2", now.Add(2*time.Second)),
+			})
+			assert.Equal(g, 0, duplicates)
+			assert.Equal(g, []string{"a1", "a2", "b1"}, ids(pkts))
+			for _, pkt := range pkts {
+				assert.Empty(g, pkt.DuplicateOf)
+			}
+		})
+
+		g.It("should forget old packets", func() {
+			d.Filter([]*models.Packet{packet("a1", "agent1", now)})
+
+			// same capture time, received later
+			now = now.Add(2 * time.Second)
+
+			_, duplicates := d.Filter([]*models.Packet{packet("b1", "agent2", now.Add(-2*time.Second))})
+			assert.Equal(g, 0, duplicates)
+			assert.Len(g, d.seen, 1)
+			assert.Len(g, d.queue, 1)
+		})
+	})
+}
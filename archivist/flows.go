@@ -0,0 +1,86 @@
+package archivist
+
+import (
+	"sync"
+	"time"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+type flowEntry struct {
+	record    *models.FlowRecord
+	updatedAt time.Time
+}
+
+// flowTable aggregates the received packets in flow records, a record is
+// closed when no packet was received for idleTimeout and a new one is
+// started if the conversation resumes.
+type flowTable struct {
+	mu          sync.Mutex
+	flows       map[string]*flowEntry
+	idleTimeout time.Duration
+	lastSweep   time.Time
+	now         func() time.Time
+}
+
+func newFlowTable(idleTimeout time.Duration) *flowTable {
+	return &flowTable{
+		flows:       map[string]*flowEntry{},
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+	}
+}
+
+// Update adds the packets to their flow records and returns a copy of the
+// records updated, the packets must have been decoded.
+func (ft *flowTable) Update(pkts []*models.Packet) []*models.FlowRecord {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	now := ft.now()
+	updated := map[string]*flowEntry{}
+
+	for _, pkt := range pkts {
+		flow := pkt.Flow()
+		if flow == nil {
+			continue
+		}
+
+		key := flow.ID() + "@" + pkt.Agent
+
+		entry, exists := ft.flows[key]
+		if exists && (pkt.Timestamp.Sub(entry.record.LastSeen) <= ft.idleTimeout) {
+			entry.record.Add(pkt)
+		} else {
+			entry = &flowEntry{record: models.NewFlowRecord(pkt)}
+			ft.flows[key] = entry
+		}
+
+		entry.updatedAt = now
+		updated[key] = entry
+	}
+
+	ret := make([]*models.FlowRecord, 0, len(updated))
+	for _, entry := range updated {
+		record := *entry.record
+		ret = append(ret, &record)
+	}
+
+	if now.Sub(ft.lastSweep) > ft.idleTimeout {
+		ft.sweep(now)
+	}
+
+	return ret
+}
+
+// sweep forgets the flows which were not updated recently, their records
+// are already persisted.
+func (ft *flowTable) sweep(now time.Time) {
+	for key, entry := range ft.flows {
+		if now.Sub(entry.updatedAt) > ft.idleTimeout {
+			delete(ft.flows, key)
+		}
+	}
+
+	ft.lastSweep = now
+}
@@ -0,0 +1,138 @@
+// +build test
+
+package archivist
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/config"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestFlowTable(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("flowTable", func() {
+		var ft *flowTable
+		var now time.Time
+
+		client := net.ParseIP("10.0.0.2").To4()
+		server := net.ParseIP("10.0.0.53").To4()
+
+		packet := func(src, dst net.IP, srcPort, dstPort uint16, ts time.Time) *models.Packet {
+			pkt := &models.Packet{Data: store.BuildUDPPacket(src, dst, srcPort, dstPort),
+				Timestamp: ts, Agent: "agent1"}
+			pkt.Decode()
+			return pkt
+		}
+
+		g.BeforeEach(func() {
+			now = time.Now()
+			ft = newFlowTable(time.Minute)
+			ft.now = func() time.Time { return now }
+		})
+
+		g.It("should aggregate both directions", func() {
+			records := ft.Update([]*models.Packet{
+				packet(client, server, 5353, 53, now),
+				packet(server, client, 53, 5353, now.Add(time.Second)),
+			})
+
+			require.Len(g, records, 1)
+			assert.Equal(g, uint64(2), records[0].Packets)
+			assert.Equal(g, now, records[0].FirstSeen)
+			assert.Equal(g, now.Add(time.Second), records[0].LastSeen)
+
+			// following batches update the same record
+			records = ft.Update([]*models.Packet{
+				packet(client, server, 5353, 53, now.Add(2*time.Second)),
+			})
+
+			require.Len(g, records, 1)
+			assert.Equal(g, uint64(3), records[0].Packets)
+			assert.Equal(g, now, records[0].FirstSeen)
+		})
+
+		g.It("should start a new record after the idle timeout", func() {
+			ft.Update([]*models.Packet{
+				packet(client, server, 5353, 53, now),
+			})
+
+			records := ft.Update([]*models.Packet{
+				packet(client, server, 5353, 53, now.Add(2*time.Minute)),
+			})
+
+			require.Len(g, records, 1)
+			assert.Equal(g, uint64(1), records[0].Packets)
+			assert.Equal(g, now.Add(2*time.Minute), records[0].FirstSeen)
+		})
+
+		g.It("should forget idle flows", func() {
+			ft.Update([]*models.Packet{
+				packet(client, server, 5353, 53, now),
+			})
+
+			now = now.Add(5 * time.Minute)
+			ft.Update([]*models.Packet{
+				packet(client, server, 123, 123, now),
+			})
+
+			assert.Len(g, ft.flows, 1)
+		})
+
+		g.It("should ignore non IP packets", func() {
+			mac, _ := net.ParseMAC("02:00:5e:10:00:01")
+			arp := &models.Packet{Data: store.BuildARPPacket(mac, mac), Timestamp: now}
+			arp.Decode()
+
+			records := ft.Update([]*models.Packet{arp})
+			assert.Empty(g, records)
+		})
+	})
+	g.Describe("flows", func() {
+		var dataStore *countingStore
+		var dir string
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "archivist")
+			require.Nil(g, err)
+
+			dataStore, err = openCountingStore(dir)
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			dataStore.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should refuse an idle timeout with a store without flows", func() {
+			// only exposes the methods of the interface
+			flowless := struct{ store.StoreInterface }{dataStore}
+
+			_, err := New(flowless, dataStore.BadgerStore, stats.NewStats(), &config.ArchivistConfig{
+				DataRetention:   time.Hour,
+				FlowIdleTimeout: time.Minute,
+			})
+			require.NotNil(g, err)
+
+			arc, err := New(dataStore, dataStore.BadgerStore, stats.NewStats(), &config.ArchivistConfig{
+				DataRetention:   time.Hour,
+				FlowIdleTimeout: time.Minute,
+			})
+			require.Nil(g, err)
+			assert.NotNil(g, arc.flows)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package archivist
+
+import (
+	"context"
+	"crypto/x509"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// agentName returns the name of the agent sending the request: the agent
+// its token is bound to or the identity of its certificate when verified by
+// the CA, the agent-name metadata otherwise.
+func agentName(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var name string
+	if values := md.Get("agent-name"); len(values) > 0 {
+		name = values[0]
+	}
+
+	if cert := peerCertificate(ctx); cert != nil {
+		identity := certificateIdentity(cert)
+		if identity == "" {
+			return "", status.Error(codes.PermissionDenied, "certificate without identity")
+		}
+
+		// an agent configured with another name would mislabel its packets
+		if (name != "") && (name != identity) {
+			return "", status.Errorf(codes.PermissionDenied, "agent-name %q does not match the certificate (%s)", name, identity)
+		}
+
+		name = identity
+	}
+
+	if authenticated, ok := ctx.Value(authenticatedAgentKey{}).(string); ok {
+		if (name != "") && (name != authenticated) {
+			return "", status.Errorf(codes.PermissionDenied, "agent %q does not match the token (%s)", name, authenticated)
+		}
+
+		name = authenticated
+	}
+
+	if name == "" {
+		return "", status.Error(codes.InvalidArgument, "missing agent-name")
+	}
+
+	return name, nil
+}
+
+// peerCertificate returns the verified certificate of the agent, nil
+// without mutual TLS.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+
+	if (len(info.State.VerifiedChains) == 0) || (len(info.State.VerifiedChains[0]) == 0) {
+		return nil
+	}
+
+	return info.State.VerifiedChains[0][0]
+}
+
+// certificateIdentity returns the common name of the certificate or its
+// first DNS name.
+func certificateIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	return ""
+}
@@ -0,0 +1,198 @@
+// +build test
+
+package archivist
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/schmurfy/sniffit/config"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+// writeCertificate writes a certificate signed by parent (self signed if
+// nil) and its key as PEM files in dir.
+func writeCertificate(dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("mutual TLS", func() {
+		var server *grpc.Server
+		var lis *bufconn.Listener
+		var dataStore *countingStore
+		var dir string
+
+		tlsConfig := func(name string) config.TLSConfig {
+			return config.TLSConfig{
+				TLSCert: filepath.Join(dir, name+".crt"),
+				TLSKey:  filepath.Join(dir, name+".key"),
+				TLSCA:   filepath.Join(dir, "ca.crt"),
+			}
+		}
+
+		send := func(cfg config.TLSConfig, name string) error {
+			clientTLS, err := cfg.ClientTLS("archivist")
+			require.Nil(g, err)
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return lis.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)),
+			)
+			require.Nil(g, err)
+			defer conn.Close()
+
+			ctx := context.Background()
+			if name != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "agent-name", name)
+			}
+
+			_, err = pb.NewArchivistClient(conn).SendPacket(ctx, &pb.PacketBatch{Packets: []*pb.Packet{
+				{Id: "p1", Data: store.BuildPacket(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()), TimestampNano: time.Now().UnixNano()},
+			}})
+			return err
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "archivist")
+			require.Nil(g, err)
+
+			ca, caKey, err := writeCertificate(dir, "ca", &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "sniffit"},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}, nil, nil)
+			require.Nil(g, err)
+
+			_, _, err = writeCertificate(dir, "archivist", &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				DNSNames:     []string{"archivist"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}, ca, caKey)
+			require.Nil(g, err)
+
+			_, _, err = writeCertificate(dir, "agent1", &x509.Certificate{
+				SerialNumber: big.NewInt(3),
+				Subject:      pkix.Name{CommonName: "agent1"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}, ca, caKey)
+			require.Nil(g, err)
+
+			dataStore, err = openCountingStore(dir)
+			require.Nil(g, err)
+
+			arc, err := New(dataStore, dataStore.BadgerStore, stats.NewStats(), &config.ArchivistConfig{
+				DataRetention: time.Hour,
+				TLSConfig:     tlsConfig("archivist"),
+			})
+			require.Nil(g, err)
+
+			lis = bufconn.Listen(1 << 20)
+			server = grpc.NewServer(arc.serverOptions()...)
+			pb.RegisterArchivistServer(server, arc)
+			go server.Serve(lis)
+		})
+
+		g.AfterEach(func() {
+			server.Stop()
+			dataStore.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should accept the agent named like its certificate", func() {
+			require.Nil(g, send(tlsConfig("agent1"), "agent1"))
+			assert.Equal(g, []string{"p1"}, dataStore.Stored())
+		})
+
+		g.It("should name the agent after its certificate", func() {
+			require.Nil(g, send(tlsConfig("agent1"), ""))
+			assert.Equal(g, []string{"p1"}, dataStore.Stored())
+		})
+
+		g.It("should reject another agent name", func() {
+			err := send(tlsConfig("agent1"), "agent2")
+			assert.Equal(g, codes.PermissionDenied, status.Code(err))
+			assert.Empty(g, dataStore.Stored())
+		})
+
+		g.It("should reject the agents without certificate", func() {
+			cfg := tlsConfig("agent1")
+			cfg.TLSCert = ""
+			cfg.TLSKey = ""
+
+			assert.NotNil(g, send(cfg, "agent1"))
+			assert.Empty(g, dataStore.Stored())
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package archivist
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/schmurfy/sniffit/compression"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+const (
+	// sessions are forgotten when their agent did not reconnect for this
+	// long, the agent then resends the batches not acknowledged
+	_streamSessionTTL = time.Hour
+)
+
+type streamSession struct {
+	// held while a stream uses the session so a reconnecting agent waits
+	// for its previous stream to finish
+	mu       sync.Mutex
+	last     uint64
+	lastSeen time.Time
+}
+
+// streamSessions remembers the last batch stored for each stream so the
+// batches resent after a reconnection are not stored twice.
+type streamSessions struct {
+	mu        sync.Mutex
+	sessions  map[string]*streamSession
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newStreamSessions() *streamSessions {
+	return &streamSessions{
+		sessions: map[string]*streamSession{},
+		now:      time.Now,
+	}
+}
+
+// Acquire returns the session of a stream, locked, Release must be called
+// once the stream ends.
+func (ss *streamSessions) Acquire(id string) *streamSession {
+	ss.mu.Lock()
+
+	now := ss.now()
+	if now.Sub(ss.lastSweep) > _streamSessionTTL {
+		ss.sweep(now)
+	}
+
+	session, exists := ss.sessions[id]
+	if !exists {
+		session = &streamSession{}
+		ss.sessions[id] = session
+	}
+	session.lastSeen = now
+
+	ss.mu.Unlock()
+
+	session.mu.Lock()
+	return session
+}
+
+func (ss *streamSessions) Release(session *streamSession) {
+	ss.mu.Lock()
+	session.lastSeen = ss.now()
+	ss.mu.Unlock()
+
+	session.mu.Unlock()
+}
+
+// sweep forgets the sessions not used recently, the lock must be held.
+func (ss *streamSessions) sweep(now time.Time) {
+	for id, session := range ss.sessions {
+		if now.Sub(session.lastSeen) > _streamSessionTTL {
+			delete(ss.sessions, id)
+		}
+	}
+
+	ss.lastSweep = now
+}
+
+// StreamPackets stores the batches as they arrive and acknowledges them in
+// order, a batch is only acknowledged once stored.
+func (ar *Archivist) StreamPackets(stream pb.Archivist_StreamPacketsServer) error {
+	ctx := stream.Context()
+
+	name, err := agentName(ctx)
+	if err != nil {
+		return err
+	}
+
+	// agents without a stream id cannot resume, the ids are only unique
+	// for an agent. The name of a quarantined agent is only what it
+	// declared, sharing the session of the real agent would let it skip
+	// the batches of that agent.
+	md, _ := metadata.FromIncomingContext(ctx)
+	_, quarantined := quarantinedAgent(ctx)
+	var session *streamSession
+	if values := md.Get("agent-stream"); (len(values) > 0) && !quarantined {
+		session = ar.streams.Acquire(name + "/" + values[0])
+		defer ar.streams.Release(session)
+	} else {
+		session = &streamSession{}
+	}
+
+	// lets the agent pick a compressor and dictionary for the next streams
+	header := metadata.Pairs()
+	header.Append(compression.CompressorsHeader, compression.Names()...)
+	if ar.payloads != nil {
+		for _, id := range ar.payloads.DictionaryIDs() {
+			header.Append(compression.DictionariesHeader, compression.FormatDictionaryID(id))
+		}
+	}
+
+	err = stream.SendHeader(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if session.last > 0 {
+		err := stream.Send(&pb.StreamAck{Sequence: session.last})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// resent after a reconnection but already stored
+		if msg.Sequence > session.last {
+			batch := msg.Batch
+			if batch == nil {
+				batch = &pb.PacketBatch{}
+			}
+
+			err = ar.handleReceivePackets(ctx, batch)
+			if err != nil {
+				return err
+			}
+
+			session.last = msg.Sequence
+		}
+
+		err = stream.Send(&pb.StreamAck{Sequence: session.last})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
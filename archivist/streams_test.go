@@ -0,0 +1,211 @@
+// +build test
+
+package archivist
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/schmurfy/sniffit/compression"
+	"github.com/schmurfy/sniffit/config"
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+	"github.com/schmurfy/sniffit/index_encoder"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+	badger_store "github.com/schmurfy/sniffit/store/badger"
+)
+
+// countingStore records the ids of the packets stored
+type countingStore struct {
+	*badger_store.BadgerStore
+
+	mu     sync.Mutex
+	stored []string
+}
+
+func (s *countingStore) StorePackets(ctx context.Context, pkts []*models.Packet) error {
+	s.mu.Lock()
+	for _, pkt := range pkts {
+		s.stored = append(s.stored, pkt.Id)
+	}
+	s.mu.Unlock()
+
+	return s.BadgerStore.StorePackets(ctx, pkts)
+}
+
+func (s *countingStore) Stored() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.stored...)
+}
+
+// openCountingStore opens a badger store in dir
+func openCountingStore(dir string) (*countingStore, error) {
+	encoder, err := index_encoder.NewProto()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := badger_store.DefaultOptions
+	opts.Path = dir
+	opts.Encoder = encoder
+	opts.TTL = time.Hour
+
+	badgerStore, err := badger_store.New(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingStore{BadgerStore: badgerStore}, nil
+}
+
+func TestStreamPackets(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("StreamPackets", func() {
+		var server *grpc.Server
+		var client pb.ArchivistClient
+		var dataStore *countingStore
+		var dir string
+
+		addr1 := net.ParseIP("10.0.0.1").To4()
+		addr2 := net.ParseIP("10.0.0.2").To4()
+
+		open := func(streamId string) pb.Archivist_StreamPacketsClient {
+			md := metadata.Pairs("agent-name", "agent1")
+			if streamId != "" {
+				md.Append("agent-stream", streamId)
+			}
+
+			ctx := metadata.NewOutgoingContext(context.Background(), md)
+			stream, err := client.StreamPackets(ctx)
+			require.Nil(g, err)
+
+			return stream
+		}
+
+		send := func(stream pb.Archivist_StreamPacketsClient, seq uint64, id string) uint64 {
+			err := stream.Send(&pb.StreamBatch{
+				Sequence: seq,
+				Batch: &pb.PacketBatch{Packets: []*pb.Packet{
+					{Id: id, Data: store.BuildPacket(addr1, addr2), TimestampNano: time.Now().UnixNano()},
+				}},
+			})
+			require.Nil(g, err)
+
+			ack, err := stream.Recv()
+			require.Nil(g, err)
+
+			return ack.Sequence
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "archivist")
+			require.Nil(g, err)
+
+			dataStore, err = openCountingStore(dir)
+			require.Nil(g, err)
+
+			arc, err := New(dataStore, dataStore.BadgerStore, stats.NewStats(), &config.ArchivistConfig{DataRetention: time.Hour})
+			require.Nil(g, err)
+
+			lis := bufconn.Listen(1 << 20)
+			server = grpc.NewServer()
+			pb.RegisterArchivistServer(server, arc)
+			go server.Serve(lis)
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return lis.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.Nil(g, err)
+
+			client = pb.NewArchivistClient(conn)
+		})
+
+		g.AfterEach(func() {
+			server.Stop()
+			dataStore.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should acknowledge the stored batches", func() {
+			stream := open("s1")
+
+			assert.Equal(g, uint64(1), send(stream, 1, "p1"))
+			assert.Equal(g, uint64(2), send(stream, 2, "p2"))
+			require.Nil(g, stream.CloseSend())
+
+			assert.Equal(g, []string{"p1", "p2"}, dataStore.Stored())
+		})
+
+		g.It("should not store the batches resent after a reconnection", func() {
+			stream := open("s1")
+			assert.Equal(g, uint64(1), send(stream, 1, "p1"))
+			assert.Equal(g, uint64(2), send(stream, 2, "p2"))
+			require.Nil(g, stream.CloseSend())
+
+			// the last stored batch is acknowledged first
+			stream = open("s1")
+			ack, err := stream.Recv()
+			require.Nil(g, err)
+			assert.Equal(g, uint64(2), ack.Sequence)
+
+			assert.Equal(g, uint64(2), send(stream, 2, "p2"))
+			assert.Equal(g, uint64(3), send(stream, 3, "p3"))
+			require.Nil(g, stream.CloseSend())
+
+			// another stream starts from the beginning
+			stream = open("s2")
+			assert.Equal(g, uint64(1), send(stream, 1, "q1"))
+			require.Nil(g, stream.CloseSend())
+
+			assert.Equal(g, []string{"p1", "p2", "p3", "q1"}, dataStore.Stored())
+		})
+
+		g.It("should advertise the compressors", func() {
+			stream := open("s1")
+
+			header, err := stream.Header()
+			require.Nil(g, err)
+			assert.Equal(g, compression.Names(), header.Get(compression.CompressorsHeader))
+			assert.Empty(g, header.Get(compression.DictionariesHeader))
+
+			require.Nil(g, stream.CloseSend())
+		})
+
+		g.It("should reject the packets compressed with an unknown dictionary", func() {
+			stream := open("s1")
+
+			err := stream.Send(&pb.StreamBatch{
+				Sequence: 1,
+				Batch: &pb.PacketBatch{Packets: []*pb.Packet{
+					{Id: "p1", Data: []byte{1, 2, 3}, DataEncoding: pb.DataEncoding_ZSTD},
+				}},
+			})
+			require.Nil(g, err)
+
+			_, err = stream.Recv()
+			assert.NotNil(g, err)
+			assert.Empty(g, dataStore.Stored())
+		})
+	})
+}
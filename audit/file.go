@@ -0,0 +1,320 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+const (
+	// maximum size of an entry read back from the files
+	_maxLineSize = 1 << 20
+)
+
+// FileLog appends the audit entries to a file as JSON lines, the file is
+// renamed with a .1 suffix when it grows over maxSize (the previous .1
+// becomes .2 and so on) and only maxFiles rotated files are kept.
+type FileLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	writer *os.File
+	size   int64
+}
+
+var _ store.AuditInterface = (*FileLog)(nil)
+
+// OpenFileLog opens or creates the log, the entries are appended to an
+// existing file.
+func OpenFileLog(path string, maxSize int64, maxFiles int) (*FileLog, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("the audit log size must be positive")
+	}
+
+	if maxFiles < 0 {
+		maxFiles = 0
+	}
+
+	ret := &FileLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err := ret.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (l *FileLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+
+	l.writer = f
+	l.size = info.Size()
+
+	// the last line may have been cut by a crash, it is ended so the next
+	// entry starts on its own line
+	if l.size > 0 {
+		last := make([]byte, 1)
+		r, err := os.Open(l.path)
+		if err == nil {
+			_, err = r.ReadAt(last, l.size-1)
+			r.Close()
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if last[0] != '\n' {
+			n, err := f.Write([]byte{'\n'})
+			l.size += int64(n)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rotatedPath returns the path of the nth rotated file, 0 is the file
+// written to.
+func (l *FileLog) rotatedPath(n int) string {
+	if n == 0 {
+		return l.path
+	}
+
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate renames the files and starts a new one, the lock must be held.
+func (l *FileLog) rotate() error {
+	if err := l.writer.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	l.writer = nil
+
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return l.open()
+	}
+
+	err := os.Remove(l.rotatedPath(l.maxFiles))
+	if (err != nil) && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	for n := l.maxFiles - 1; n >= 0; n-- {
+		err = os.Rename(l.rotatedPath(n), l.rotatedPath(n+1))
+		if (err != nil) && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return l.open()
+}
+
+func (l *FileLog) StoreAuditEntries(ctx context.Context, entries []*models.AuditEntry) error {
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.writer == nil {
+		return errors.New("audit log closed")
+	}
+
+	if (l.size > 0) && (l.size+int64(len(data)) > l.maxSize) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.writer.Write(data)
+	l.size += int64(n)
+	return errors.WithStack(err)
+}
+
+// FindAuditEntries reads the current file and the rotated ones, the lock is
+// only held while opening them so the entries keep being written during the
+// read.
+func (l *FileLog) FindAuditEntries(ctx context.Context, q *store.AuditQuery) ([]*models.AuditEntry, error) {
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	maxCount := 0
+	if q != nil {
+		maxCount = q.MaxCount
+	}
+
+	ret := []*models.AuditEntry{}
+
+	// newest file first
+	for _, f := range files {
+		remaining := 0
+		if maxCount > 0 {
+			remaining = maxCount - len(ret)
+		}
+
+		entries, err := readEntries(io.NewSectionReader(f, 0, f.size), q, remaining)
+		if err != nil {
+			return nil, err
+		}
+
+		slices.Reverse(entries)
+		ret = append(ret, entries...)
+
+		if (maxCount > 0) && (len(ret) >= maxCount) {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// openedFile is a file of the log with the size it had when opened, the
+// current file is only read up to this size so an entry being written is not
+// read.
+type openedFile struct {
+	*os.File
+	size int64
+}
+
+// openFiles opens the current file and the rotated ones, newest first. An
+// opened file can still be read once rotated.
+func (l *FileLog) openFiles() (ret []*openedFile, err error) {
+	defer func() {
+		if err != nil {
+			for _, f := range ret {
+				f.Close()
+			}
+			ret = nil
+		}
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for n := 0; n <= l.maxFiles; n++ {
+		var f *os.File
+
+		f, err = os.Open(l.rotatedPath(n))
+		if os.IsNotExist(err) {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+		opened := &openedFile{File: f, size: l.size}
+		ret = append(ret, opened)
+
+		if n > 0 {
+			var info os.FileInfo
+
+			info, err = f.Stat()
+			if err != nil {
+				err = errors.WithStack(err)
+				return
+			}
+
+			opened.size = info.Size()
+		}
+	}
+
+	return
+}
+
+// readEntries returns the entries of a file matching the query in the order
+// they were written, only the last maxCount ones are kept if it is positive.
+func readEntries(r io.Reader, q *store.AuditQuery, maxCount int) ([]*models.AuditEntry, error) {
+	var ret []*models.AuditEntry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, _maxLineSize)
+	for scanner.Scan() {
+		var e models.AuditEntry
+		// a line cut by a crash of the archivist is skipped
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+
+		if !q.Match(&e) {
+			continue
+		}
+
+		ret = append(ret, &e)
+
+		// the older entries are dropped from time to time
+		if (maxCount > 0) && (len(ret) >= 2*maxCount) {
+			ret = append(ret[:0], ret[len(ret)-maxCount:]...)
+		}
+	}
+
+	if (maxCount > 0) && (len(ret) > maxCount) {
+		ret = ret[len(ret)-maxCount:]
+	}
+
+	return ret, errors.WithStack(scanner.Err())
+}
+
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.writer == nil {
+		return nil
+	}
+
+	err := l.writer.Close()
+	l.writer = nil
+	return errors.WithStack(err)
+}
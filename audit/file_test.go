@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestFileLog(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("FileLog", func() {
+		var dir string
+		var path string
+		ctx := context.Background()
+		start := time.Date(2025, 11, 9, 11, 0, 0, 0, time.UTC)
+
+		entry := func(n int, user string) *models.AuditEntry {
+			return &models.AuditEntry{
+				Time:   start.Add(time.Duration(n) * time.Minute),
+				User:   user,
+				Route:  "/download/{Address}",
+				Path:   "/download/10.0.0.1",
+				Query:  "proto=tcp",
+				Status: 200,
+			}
+		}
+
+		// returns the minute of each entry
+		minutes := func(entries []*models.AuditEntry) (ret []int) {
+			for _, e := range entries {
+				ret = append(ret, int(e.Time.Sub(start)/time.Minute))
+			}
+			return
+		}
+
+		g.BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "audit")
+			require.Nil(g, err)
+
+			path = filepath.Join(dir, "audit.log")
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("should return the most recent entries first", func() {
+			l, err := OpenFileLog(path, 1<<20, 2)
+			require.Nil(g, err)
+			defer l.Close()
+
+			for i := range 4 {
+				err = l.StoreAuditEntries(ctx, []*models.AuditEntry{entry(i, "alice")})
+				require.Nil(g, err)
+			}
+
+			found, err := l.FindAuditEntries(ctx, &store.AuditQuery{})
+			require.Nil(g, err)
+			assert.Equal(g, []int{3, 2, 1, 0}, minutes(found))
+			assert.Equal(g, "/download/10.0.0.1", found[0].Path)
+
+			found, err = l.FindAuditEntries(ctx, &store.AuditQuery{MaxCount: 2})
+			require.Nil(g, err)
+			assert.Equal(g, []int{3, 2}, minutes(found))
+		})
+
+		g.It("should filter the entries", func() {
+			l, err := OpenFileLog(path, 1<<20, 2)
+			require.Nil(g, err)
+			defer l.Close()
+
+			err = l.StoreAuditEntries(ctx, []*models.AuditEntry{
+				entry(0, "alice"), entry(1, "bob"), entry(2, "alice"), entry(3, "alice"),
+			})
+			require.Nil(g, err)
+
+			found, err := l.FindAuditEntries(ctx, &store.AuditQuery{User: "alice", To: start.Add(2 * time.Minute)})
+			require.Nil(g, err)
+			assert.Equal(g, []int{2, 0}, minutes(found))
+		})
+
+		g.It("should rotate the files", func() {
+			data, err := json.Marshal(entry(0, "alice"))
+			require.Nil(g, err)
+			line := len(data) + 1
+
+			// two entries per file
+			l, err := OpenFileLog(path, int64(2*line), 2)
+			require.Nil(g, err)
+			defer l.Close()
+
+			for i := range 7 {
+				err = l.StoreAuditEntries(ctx, []*models.AuditEntry{entry(i, "alice")})
+				require.Nil(g, err)
+			}
+
+			_, err = os.Stat(path + ".2")
+			assert.Nil(g, err)
+			_, err = os.Stat(path + ".3")
+			assert.True(g, os.IsNotExist(err))
+
+			// the oldest file was dropped
+			found, err := l.FindAuditEntries(ctx, &store.AuditQuery{})
+			require.Nil(g, err)
+			assert.Equal(g, []int{6, 5, 4, 3, 2}, minutes(found))
+		})
+
+		g.It("should stop reading once enough entries are found", func() {
+			data, err := json.Marshal(entry(0, "alice"))
+			require.Nil(g, err)
+			line := len(data) + 1
+
+			// two entries per file
+			l, err := OpenFileLog(path, int64(2*line), 2)
+			require.Nil(g, err)
+			defer l.Close()
+
+			for i := range 5 {
+				err = l.StoreAuditEntries(ctx, []*models.AuditEntry{entry(i, "alice")})
+				require.Nil(g, err)
+			}
+
+			found, err := l.FindAuditEntries(ctx, &store.AuditQuery{MaxCount: 3})
+			require.Nil(g, err)
+			assert.Equal(g, []int{4, 3, 2}, minutes(found))
+
+			// the oldest file cannot be read
+			require.Nil(g, os.Remove(path+".2"))
+			require.Nil(g, os.Mkdir(path+".2", 0o700))
+
+			found, err = l.FindAuditEntries(ctx, &store.AuditQuery{MaxCount: 3})
+			require.Nil(g, err)
+			assert.Equal(g, []int{4, 3, 2}, minutes(found))
+
+			_, err = l.FindAuditEntries(ctx, &store.AuditQuery{})
+			assert.NotNil(g, err)
+		})
+
+		g.It("should append to an existing log", func() {
+			l, err := OpenFileLog(path, 1<<20, 2)
+			require.Nil(g, err)
+
+			err = l.StoreAuditEntries(ctx, []*models.AuditEntry{entry(0, "alice")})
+			require.Nil(g, err)
+			require.Nil(g, l.Close())
+
+			// a line cut by a crash
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+			require.Nil(g, err)
+			_, err = f.WriteString(`{"time":"2025-11`)
+			require.Nil(g, err)
+			require.Nil(g, f.Close())
+
+			l, err = OpenFileLog(path, 1<<20, 2)
+			require.Nil(g, err)
+			defer l.Close()
+
+			err = l.StoreAuditEntries(ctx, []*models.AuditEntry{entry(1, "alice")})
+			require.Nil(g, err)
+
+			found, err := l.FindAuditEntries(ctx, nil)
+			require.Nil(g, err)
+			assert.Equal(g, []int{1, 0}, minutes(found))
+		})
+	})
+}
@@ -6,13 +6,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/uptrace/uptrace-go/uptrace"
 
 	"github.com/schmurfy/sniffit/agent"
 	"github.com/schmurfy/sniffit/archivist"
+	"github.com/schmurfy/sniffit/audit"
 	"github.com/schmurfy/sniffit/config"
 	hs "github.com/schmurfy/sniffit/http"
 	"github.com/schmurfy/sniffit/index_encoder"
@@ -29,7 +32,13 @@ var (
 
 func runArchivist() error {
 	cfg := &config.ArchivistConfig{
-		DataRetention: 7 * 24 * time.Hour, // one week
+		DataRetention:    7 * 24 * time.Hour, // one week
+		FlowIdleTimeout:  2 * time.Minute,
+		StoreBatchDelay:  500 * time.Millisecond,
+		DedupMode:        "mark",
+		UnknownAgents:    archivist.UnknownAgentsReject,
+		AuditLogMaxSize:  100 << 20, // 100MB
+		AuditLogMaxFiles: 10,
 	}
 
 	err := config.Load(cfg)
@@ -77,13 +86,7 @@ func runArchivist() error {
 		dataStore = dataBadgerStore
 
 	case "clickhouse":
-		clickStore, err := clickhouse.New(&clickhouse.Options{
-			Addr:     []string{cfg.ClickhouseAddr},
-			Database: cfg.ClickhouseDatabase,
-			Username: cfg.ClickhouseUsername,
-			Password: cfg.ClickhousePassword,
-			TTL:      cfg.DataRetention,
-		})
+		clickStore, err := clickhouse.New(clickhouseOptions(&cfg.ClickhouseConfig, cfg.DataRetention))
 		if err != nil {
 			return err
 		}
@@ -96,6 +99,19 @@ func runArchivist() error {
 		return fmt.Errorf("unknown store type: %s", cfg.StoreType)
 	}
 
+	var auditLog store.AuditInterface
+	if cfg.AuditLog != "" {
+		fileLog, err := audit.OpenFileLog(cfg.AuditLog, cfg.AuditLogMaxSize, cfg.AuditLogMaxFiles)
+		if err != nil {
+			return err
+		}
+		defer fileLog.Close()
+
+		auditLog = fileLog
+	} else if storeLog, ok := dataStore.(store.AuditInterface); ok {
+		auditLog = storeLog
+	}
+
 	st := stats.NewStats()
 
 	arc, err := archivist.New(dataStore, indexStore, st, cfg)
@@ -104,7 +120,7 @@ func runArchivist() error {
 	}
 
 	go func() {
-		err := hs.Start(cfg.ListenHTTPAddress, arc, indexStore, dataStore, st, cfg)
+		err := hs.Start(cfg.ListenHTTPAddress, arc, indexStore, dataStore, auditLog, st, cfg)
 		if err != nil {
 			fmt.Printf("http server failed to start: %s\n", err.Error())
 		}
@@ -122,7 +138,11 @@ func runArchivist() error {
 }
 
 func runAgent() error {
-	cfg := &config.AgentConfig{}
+	cfg := &config.AgentConfig{
+		SpoolMaxSize:     1 << 30, // 1GB
+		SpoolSegmentSize: 16 << 20,
+		StreamWindow:     8,
+	}
 
 	err := config.Load(cfg)
 	if err != nil {
@@ -131,10 +151,22 @@ func runAgent() error {
 		return err
 	}
 
-	ag, err := agent.New(cfg.InterfaceName, cfg.Filter, cfg.ArchivistAddress, cfg.AgentName, cfg.SnapLen, cfg.BatchSize)
+	ag, err := agent.New(cfg)
 	if err != nil {
 		return err
 	}
+	defer ag.Close()
+
+	if cfg.ListenMetrics != "" {
+		go func() {
+			err := http.ListenAndServe(cfg.ListenMetrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				metrics.WritePrometheus(w, true)
+			}))
+			if err != nil {
+				fmt.Printf("metrics server failed to start: %s\n", err.Error())
+			}
+		}()
+	}
 
 	flush, err := initTracer("agent", &cfg.Config)
 	if err != nil {
@@ -151,8 +183,106 @@ func runAgent() error {
 	return ag.Start()
 }
 
+func runMigrate() error {
+	if len(os.Args) < 2 {
+		usage()
+		return nil
+	}
+
+	action := os.Args[1]
+	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+
+	cfg := &config.MigrateConfig{}
+
+	err := config.Load(cfg)
+	if err != nil {
+		flag.Usage()
+		fmt.Print("\n")
+		return err
+	}
+
+	if cfg.ClickhouseAddr == "" {
+		return fmt.Errorf("%w: clickhouse_addr", _errMissingArgument)
+	}
+
+	clickStore, err := clickhouse.Open(clickhouseOptions(&cfg.ClickhouseConfig, 0))
+	if err != nil {
+		return err
+	}
+	defer clickStore.Close()
+
+	ctx := context.Background()
+
+	switch action {
+	case "status":
+		migrations, err := clickStore.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			state, appliedAt := "pending", "-"
+			if m.Applied() {
+				state, appliedAt = "applied", m.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%-8s %-25s %s\n", state, appliedAt, m.Version)
+		}
+
+	case "up":
+		applied, err := clickStore.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range applied {
+			fmt.Printf("applied %s\n", version)
+		}
+
+		fmt.Printf("%d migration(s) applied\n", len(applied))
+
+	default:
+		usage()
+	}
+
+	return nil
+}
+
+// runToken prints a token for an agent, signed with agent_token_secret.
+func runToken() error {
+	if len(os.Args) < 2 {
+		usage()
+		return nil
+	}
+
+	agentName := os.Args[1]
+	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+
+	cfg := &config.TokenConfig{}
+
+	err := config.Load(cfg)
+	if err != nil {
+		flag.Usage()
+		fmt.Print("\n")
+		return err
+	}
+
+	fmt.Println(archivist.SignToken(cfg.AgentTokenSecret, agentName))
+	return nil
+}
+
+func clickhouseOptions(cfg *config.ClickhouseConfig, ttl time.Duration) *clickhouse.Options {
+	return &clickhouse.Options{
+		Addr:     []string{cfg.ClickhouseAddr},
+		Database: cfg.ClickhouseDatabase,
+		Username: cfg.ClickhouseUsername,
+		Password: cfg.ClickhousePassword,
+		TTL:      ttl,
+	}
+}
+
 func usage() {
-	fmt.Printf("Usage: %s <archivist|agent>\n", os.Args[0])
+	fmt.Printf("Usage: %s <archivist|agent|migrate status|migrate up|token <agent name>>\n", os.Args[0])
 }
 
 func initTracer(serviceName string, cfg *config.Config) (func(), error) {
@@ -187,6 +317,10 @@ func main() {
 		err = runArchivist()
 	case "agent":
 		err = runAgent()
+	case "migrate":
+		err = runMigrate()
+	case "token":
+		err = runToken()
 	default:
 		usage()
 	}
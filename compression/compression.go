@@ -0,0 +1,134 @@
+package compression
+
+import (
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	Zstd   = "zstd"
+	Snappy = "snappy"
+	Gzip   = gzip.Name
+
+	// metadata sent by the archivist at the start of a stream with the
+	// compressors and dictionaries it accepts
+	CompressorsHeader  = "archivist-compressors"
+	DictionariesHeader = "archivist-dicts"
+)
+
+func init() {
+	encoding.RegisterCompressor(&zstdCompressor{})
+	encoding.RegisterCompressor(&snappyCompressor{})
+}
+
+// Names returns the gRPC compressors registered by this package.
+func Names() []string {
+	return []string{Gzip, Zstd, Snappy}
+}
+
+// Valid returns true if name is a known compressor, the empty name disables
+// the compression.
+func Valid(name string) bool {
+	if name == "" {
+		return true
+	}
+
+	for _, n := range Names() {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type zstdCompressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	enc, ok := c.encoders.Get().(*zstd.Encoder)
+	if !ok {
+		var err error
+		enc, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		enc.Reset(w)
+	}
+
+	return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	dec, ok := c.decoders.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		dec, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else if err := dec.Reset(r); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+}
+
+// zstdWriter returns its encoder to the pool when closed
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *zstdWriter) Close() error {
+	err := w.Encoder.Close()
+	w.pool.Put(w.Encoder)
+	return err
+}
+
+// zstdReader returns its decoder to the pool once everything is read
+type zstdReader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	if r.Decoder == nil {
+		return 0, io.EOF
+	}
+
+	n, err := r.Decoder.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r.Decoder)
+		r.Decoder = nil
+	}
+
+	return n, err
+}
+
+type snappyCompressor struct{}
+
+func (c *snappyCompressor) Name() string {
+	return Snappy
+}
+
+func (c *snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (c *snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
@@ -0,0 +1,164 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/klauspost/compress/dict"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+// sample returns a payload looking like a dns query
+func sample(n int) []byte {
+	return []byte(fmt.Sprintf("\x45\x00\x00\x3c\x1c\x46\x40\x00\x40\x11 query %d host-%d.example.com IN A", n, n%7))
+}
+
+func TestCompressors(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("compressors", func() {
+		data := bytes.Repeat(sample(1), 100)
+
+		for _, name := range Names() {
+			name := name
+
+			g.It("should compress with "+name, func() {
+				c := encoding.GetCompressor(name)
+				require.NotNil(g, c)
+
+				// twice to reuse the pooled encoders
+				for i := 0; i < 2; i++ {
+					var buf bytes.Buffer
+					w, err := c.Compress(&buf)
+					require.Nil(g, err)
+
+					_, err = w.Write(data)
+					require.Nil(g, err)
+					require.Nil(g, w.Close())
+
+					assert.Less(g, buf.Len(), len(data))
+
+					r, err := c.Decompress(&buf)
+					require.Nil(g, err)
+
+					decompressed, err := io.ReadAll(r)
+					require.Nil(g, err)
+					assert.Equal(g, data, decompressed)
+				}
+			})
+		}
+
+		g.It("should validate the names", func() {
+			assert.True(g, Valid(""))
+			assert.True(g, Valid(Zstd))
+			assert.False(g, Valid("lz4"))
+		})
+	})
+}
+
+func TestPayloads(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("payloads", func() {
+		var dictionary []byte
+
+		g.Before(func() {
+			var samples [][]byte
+			for i := 0; i < 1000; i++ {
+				samples = append(samples, sample(i))
+			}
+
+			var err error
+			dictionary, err = dict.BuildZstdDict(samples, dict.Options{
+				MaxDictSize: 4096,
+				HashBytes:   6,
+				ZstdDictID:  1234,
+			})
+			require.Nil(g, err)
+		})
+
+		g.It("should read the dictionary id", func() {
+			id, err := DictionaryID(dictionary)
+			require.Nil(g, err)
+			assert.Equal(g, uint32(1234), id)
+
+			_, err = DictionaryID([]byte("not a dictionary"))
+			assert.NotNil(g, err)
+		})
+
+		g.It("should decode the encoded packets", func() {
+			encoder, err := NewPayloadEncoder(dictionary)
+			require.Nil(g, err)
+
+			decoder, err := NewPayloadDecoder(dictionary)
+			require.Nil(g, err)
+			assert.Equal(g, []uint32{1234}, decoder.DictionaryIDs())
+
+			pkts := []*pb.Packet{
+				{Id: "p1", Data: sample(5000), TimestampNano: 42, LinkType: 1, Interface: "eth1"},
+				{Id: "p2", Data: sample(5001)},
+			}
+
+			encoded := encoder.Encode(pkts)
+			require.Len(g, encoded, 2)
+
+			// the packets given are left untouched
+			assert.Equal(g, sample(5000), pkts[0].Data)
+			assert.Equal(g, pb.DataEncoding_RAW, pkts[0].DataEncoding)
+
+			assert.Equal(g, pb.DataEncoding_ZSTD, encoded[0].DataEncoding)
+			assert.Equal(g, int64(42), encoded[0].TimestampNano)
+			assert.Equal(g, int32(1), encoded[0].LinkType)
+			assert.Equal(g, "eth1", encoded[0].Interface)
+			assert.Less(g, len(encoded[0].Data), len(pkts[0].Data))
+
+			err = decoder.Decode(encoded)
+			require.Nil(g, err)
+
+			assert.Equal(g, sample(5000), encoded[0].Data)
+			assert.Equal(g, "eth1", encoded[0].Interface)
+			assert.Equal(g, sample(5001), encoded[1].Data)
+			assert.Equal(g, pb.DataEncoding_RAW, encoded[1].DataEncoding)
+		})
+
+		g.It("should reject the packets decoding to more than the max size", func() {
+			encoder, err := NewPayloadEncoder(dictionary)
+			require.Nil(g, err)
+
+			decoder, err := NewPayloadDecoder(dictionary)
+			require.Nil(g, err)
+
+			// a few kilobytes on the wire
+			encoded := encoder.Encode([]*pb.Packet{{Id: "p1", Data: make([]byte, MaxPayloadSize+1)}})
+			assert.Less(g, len(encoded[0].Data), 64*1024)
+
+			err = decoder.Decode(encoded)
+			assert.NotNil(g, err)
+		})
+
+		g.It("should fail without the dictionary", func() {
+			encoder, err := NewPayloadEncoder(dictionary)
+			require.Nil(g, err)
+
+			other, err := dict.BuildZstdDict([][]byte{sample(1), sample(2), sample(3)}, dict.Options{
+				MaxDictSize: 4096,
+				HashBytes:   6,
+				ZstdDictID:  5678,
+			})
+			require.Nil(g, err)
+
+			decoder, err := NewPayloadDecoder(other)
+			require.Nil(g, err)
+
+			err = decoder.Decode(encoder.Encode([]*pb.Packet{{Id: "p1", Data: sample(1)}}))
+			assert.NotNil(g, err)
+		})
+	})
+}
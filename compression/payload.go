@@ -0,0 +1,167 @@
+package compression
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/schmurfy/sniffit/generated_pb/proto"
+)
+
+const (
+	// MaxPayloadSize is the largest data a packet decodes to, the default
+	// max message size of gRPC: no raw packet sent by an agent can be
+	// larger.
+	MaxPayloadSize = 4 * 1024 * 1024
+)
+
+// LoadDictionary reads a zstd dictionary built with `zstd --train` and
+// returns it with its id.
+func LoadDictionary(path string) ([]byte, uint32, error) {
+	dict, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	id, err := DictionaryID(dict)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, path)
+	}
+
+	return dict, id, nil
+}
+
+// DictionaryID returns the id stored in a zstd dictionary.
+func DictionaryID(dict []byte) (uint32, error) {
+	header, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if header.ID() == 0 {
+		return 0, errors.New("dictionary without id")
+	}
+
+	return header.ID(), nil
+}
+
+// FormatDictionaryID returns the id as sent in the archivist headers.
+func FormatDictionaryID(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// PayloadEncoder compresses the packets data with a dictionary, small
+// packets compress much better with a dictionary trained on similar
+// traffic than the batch as a whole.
+type PayloadEncoder struct {
+	id      uint32
+	encoder *zstd.Encoder
+}
+
+func NewPayloadEncoder(dict []byte) (*PayloadEncoder, error) {
+	id, err := DictionaryID(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &PayloadEncoder{id: id, encoder: encoder}, nil
+}
+
+// DictionaryID returns the id of the dictionary, the archivist must know it
+// to decode the packets.
+func (e *PayloadEncoder) DictionaryID() uint32 {
+	return e.id
+}
+
+// Encode returns a copy of the packets with their data compressed, the
+// packets themselves are left untouched.
+func (e *PayloadEncoder) Encode(pkts []*pb.Packet) []*pb.Packet {
+	ret := make([]*pb.Packet, len(pkts))
+
+	for i, pkt := range pkts {
+		if pkt.DataEncoding != pb.DataEncoding_RAW {
+			ret[i] = pkt
+			continue
+		}
+
+		// cloned so every other field is kept
+		encoded := proto.Clone(pkt).(*pb.Packet)
+		encoded.Data = e.encoder.EncodeAll(pkt.Data, nil)
+		encoded.DataEncoding = pb.DataEncoding_ZSTD
+
+		ret[i] = encoded
+	}
+
+	return ret
+}
+
+// PayloadDecoder decompresses the packets encoded with any of its
+// dictionaries.
+type PayloadDecoder struct {
+	ids     []uint32
+	decoder *zstd.Decoder
+}
+
+func NewPayloadDecoder(dicts ...[]byte) (*PayloadDecoder, error) {
+	ids := make([]uint32, 0, len(dicts))
+	for _, dict := range dicts {
+		id, err := DictionaryID(dict)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	decoder, err := zstd.NewReader(nil,
+		zstd.WithDecoderDicts(dicts...),
+		zstd.WithDecoderConcurrency(0),
+		// one small frame could otherwise expand to gigabytes
+		zstd.WithDecoderMaxMemory(MaxPayloadSize),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &PayloadDecoder{ids: ids, decoder: decoder}, nil
+}
+
+// DictionaryIDs returns the ids of the dictionaries known by the decoder.
+func (d *PayloadDecoder) DictionaryIDs() []uint32 {
+	return d.ids
+}
+
+// Decode decompresses the data of the encoded packets in place.
+func (d *PayloadDecoder) Decode(pkts []*pb.Packet) error {
+	for _, pkt := range pkts {
+		if pkt.DataEncoding == pb.DataEncoding_RAW {
+			continue
+		}
+
+		if pkt.DataEncoding != pb.DataEncoding_ZSTD {
+			return errors.Errorf("unknown data encoding: %d", pkt.DataEncoding)
+		}
+
+		data, err := d.decoder.DecodeAll(pkt.Data, nil)
+		if err != nil {
+			return errors.Wrapf(err, "packet %s", pkt.Id)
+		}
+
+		if len(data) > MaxPayloadSize {
+			return errors.Errorf("packet %s: decoded data larger than %d bytes", pkt.Id, MaxPayloadSize)
+		}
+
+		pkt.Data = data
+		pkt.DataEncoding = pb.DataEncoding_RAW
+	}
+
+	return nil
+}
@@ -26,22 +26,71 @@ type ArchivistConfig struct {
 	IndexPath         string        `config:"index_path"`
 	DataRetention     time.Duration `config:"retention"`
 	StoreType         string        `config:"store_type,required"`
+	FlowIdleTimeout   time.Duration `config:"flow_idle_timeout,description=a conversation idle for longer is recorded as a new flow (0 disables flows)"`
+	StoreBatchSize    int           `config:"store_batch_size,description=coalesce the received batches until they hold this many packets (0 stores them as received)"`
+	StoreBatchDelay   time.Duration `config:"store_batch_delay,description=maximum time a packet waits for its batch to be full"`
+	DedupWindow       time.Duration `config:"dedup_window,description=a packet already received from another agent within this window is a duplicate (0 disables the detection)"`
+	DedupMode         string        `config:"dedup_mode,description=drop or mark the duplicates"`
+	CompressionDicts  string        `config:"compression_dicts,description=comma separated list of the zstd dictionaries the agents may compress the packets with"`
+	AgentTokens       string        `config:"agent_tokens,description=file listing the accepted agent tokens, one '<agent name> <token>' per line"`
+	AgentTokenSecret  string        `config:"agent_token_secret,description=secret verifying the signed agent tokens (sniffit token)"`
+	UnknownAgents     string        `config:"unknown_agents,description=reject or quarantine the agents without a valid token"`
+	AuditLog          string        `config:"audit_log,description=file recording the downloads and queries made on the http api (the clickhouse store records them in a table when empty)"`
+	AuditLogMaxSize   int64         `config:"audit_log_max_size,description=size in bytes over which the audit log file is rotated"`
+	AuditLogMaxFiles  int           `config:"audit_log_max_files,description=number of rotated audit log files kept"`
 
-	// clickhouse
+	ClickhouseConfig
+	TLSConfig
+	HTTPAuthConfig
+}
+
+// HTTPAuthConfig lists the credentials accepted by the http api, it is open
+// to anyone when none is configured.
+type HTTPAuthConfig struct {
+	HTTPAPIKeys       string `config:"http_api_keys,description=file of '<name> <key> <roles>' lines, the key is sent in the X-API-Key header"`
+	HTTPPasswords     string `config:"http_passwords,description=file of '<user>:<bcrypt hash>:<roles>' lines for the basic authentication"`
+	HTTPJWKS          string `config:"http_jwks,description=JWKS file verifying the bearer JWTs"`
+	HTTPJWTIssuer     string `config:"http_jwt_issuer,description=issuer required in the JWTs"`
+	HTTPJWTAudience   string `config:"http_jwt_audience,description=audience required in the JWTs"`
+	HTTPJWTRolesClaim string `config:"http_jwt_roles_claim,description=claim holding the roles in the JWTs"`
+}
+
+type ClickhouseConfig struct {
 	ClickhouseAddr     string `config:"clickhouse_addr"`
 	ClickhouseDatabase string `config:"clickhouse_database"`
 	ClickhouseUsername string `config:"clickhouse_username"`
 	ClickhousePassword string `config:"clickhouse_password"`
 }
 
+type TokenConfig struct {
+	AgentTokenSecret string `config:"agent_token_secret,required"`
+}
+
+type MigrateConfig struct {
+	ClickhouseConfig
+}
+
 type AgentConfig struct {
 	Config
 
 	ArchivistAddress string `config:"archivist_address,required"`
-	Filter           string `config:"filter,required,description=bpf filter used for capture"`
-	InterfaceName    string `config:"interface,required,description=interface to listen on"`
+	Filter           string `config:"filter,description=bpf filter used for capture"`
+	InterfaceName    string `config:"interface,description=comma separated list of interfaces to listen on with filter and snap_len"`
+	Captures         string `config:"captures,description=file of '<interface> <snap len> [filter]' lines, each interface is listened on with its own filter and snap length (0 uses snap_len)"`
 	AgentName        string `config:"agent_name,required,description=the name is used to identify packet source in archivist"`
 	BatchSize        int    `config:"batch_size,required"`
+
+	SpoolDir         string `config:"spool_dir,description=directory storing the batches while the archivist is unreachable (disabled when empty)"`
+	SpoolMaxSize     int64  `config:"spool_max_size,description=maximum size of the spool in bytes, the oldest batches are dropped first"`
+	SpoolSegmentSize int64  `config:"spool_segment_size,description=size of the spool files in bytes"`
+	StreamWindow     int    `config:"stream_window,description=maximum number of batches sent to the archivist and not acknowledged yet"`
+	ListenMetrics    string `config:"listen_metrics,description=address serving the prometheus metrics (disabled when empty)"`
+	Compression      string `config:"compression,description=gzip, zstd or snappy, used when the archivist supports it (disabled when empty)"`
+	CompressionDict  string `config:"compression_dict,description=zstd dictionary used to compress each packet when the archivist has it"`
+
+	TLSConfig
+	TLSServerName string `config:"tls_server_name,description=name expected in the archivist certificate (host of archivist_address by default)"`
+	Token         string `config:"token,description=token authenticating the agent on the archivist"`
 }
 
 func Load(config any) error {
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig holds the certificates used between the agents and the
+// archivist, the CA verifies the certificate of the other side: the
+// archivist requires a certificate from the agents when it is set.
+type TLSConfig struct {
+	TLSCert string `config:"tls_cert,description=PEM certificate presented to the other side (TLS disabled when empty)"`
+	TLSKey  string `config:"tls_key,description=PEM private key of tls_cert"`
+	TLSCA   string `config:"tls_ca,description=PEM CA bundle verifying the certificate of the other side"`
+}
+
+// Enabled returns true if TLS is configured.
+func (c *TLSConfig) Enabled() bool {
+	return (c.TLSCert != "") || (c.TLSCA != "")
+}
+
+// ServerTLS returns the configuration of the archivist, the agent
+// certificates are required and verified when a CA is set.
+func (c *TLSConfig) ServerTLS() (*tls.Config, error) {
+	if c.TLSCert == "" {
+		return nil, errors.New("tls_cert is required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.TLSCA != "" {
+		ret.ClientCAs, err = loadCertPool(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return ret, nil
+}
+
+// ClientTLS returns the configuration of the agent, the archivist is
+// verified with the system roots when no CA is set.
+func (c *TLSConfig) ClientTLS(serverName string) (*tls.Config, error) {
+	ret := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.TLSCA != "" {
+		var err error
+		ret.RootCAs, err = loadCertPool(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/schmurfy/chipi/response"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+const (
+	_defaultAuditCount = 100
+)
+
+type auditKey struct{}
+
+// auditEntry returns the entry recorded for the request, nil when it is not
+// audited.
+func auditEntry(ctx context.Context) *models.AuditEntry {
+	e, _ := ctx.Value(auditKey{}).(*models.AuditEntry)
+	return e
+}
+
+// auditPackets sets the number of packets sent by an audited request.
+func auditPackets(ctx context.Context, count int) {
+	if e := auditEntry(ctx); e != nil {
+		e.Packets = uint64(count)
+	}
+}
+
+// auditWriter records the status and the size of the response.
+type auditWriter struct {
+	http.ResponseWriter
+	entry *models.AuditEntry
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+	if aw.entry.Status == 0 {
+		aw.entry.Status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Write(data []byte) (int, error) {
+	if aw.entry.Status == 0 {
+		aw.entry.Status = http.StatusOK
+	}
+
+	n, err := aw.ResponseWriter.Write(data)
+	aw.entry.Bytes += uint64(n)
+	return n, err
+}
+
+func (aw *auditWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (aw *auditWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// auditRequests returns a middleware recording the requests in the audit
+// log once they are served, including the ones refused by the
+// authentication and the aborted downloads.
+func auditRequests(auditLog store.AuditInterface) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if auditLog == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			entry := &models.AuditEntry{
+				Time:   started,
+				Remote: r.RemoteAddr,
+				Path:   r.URL.Path,
+				Query:  r.URL.RawQuery,
+			}
+
+			defer func() {
+				entry.Duration = time.Since(started)
+				if entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+
+				if rctx := chi.RouteContext(r.Context()); rctx != nil {
+					entry.Route = rctx.RoutePattern()
+				}
+
+				// the request is served, it is recorded even if the client
+				// is gone
+				ctx := context.WithoutCancel(r.Context())
+				err := auditLog.StoreAuditEntries(ctx, []*models.AuditEntry{entry})
+				if err != nil {
+					metrics.GetOrCreateCounter(`audit_log_errors`).Inc()
+					trace.SpanFromContext(ctx).RecordError(err)
+					fmt.Printf("failed to record %s in the audit log: %s\n", entry.Path, err.Error())
+				}
+			}()
+
+			ctx := context.WithValue(r.Context(), auditKey{}, entry)
+			next.ServeHTTP(&auditWriter{ResponseWriter: w, entry: entry}, r.WithContext(ctx))
+		})
+	}
+}
+
+type ListAuditRequest struct {
+	errorEncoder
+
+	Path  struct{} `example:"/audit"`
+	Query struct {
+		User  *string `example:"alice" description:"only return the requests of this user"`
+		From  *string `example:"2025-11-09T11:00:00+01:00"`
+		To    *string `example:"2025-11-09T12:00:00+01:00"`
+		Count *int    `description:"maximum number of entries returned, most recent first (default: 100)"`
+	}
+
+	response.JsonEncoder
+	Response []*models.AuditEntry
+
+	Log store.AuditInterface
+}
+
+func (r *ListAuditRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
+	ctx, span := _tracer.Start(ctx, "ListAuditRequest")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	if r.Log == nil {
+		return errors.New("the audit log is disabled")
+	}
+
+	query := &store.AuditQuery{MaxCount: _defaultAuditCount}
+
+	if r.Query.User != nil {
+		query.User = *r.Query.User
+	}
+
+	if r.Query.From != nil {
+		query.From, err = parseTime(*r.Query.From)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.To != nil {
+		query.To, err = parseTime(*r.Query.To)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.Count != nil {
+		if *r.Query.Count < 0 {
+			return badRequest("count must be positive")
+		}
+		query.MaxCount = *r.Query.Count
+	}
+
+	r.Response, err = r.Log.FindAuditEntries(ctx, query)
+	if err != nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("response.entries_count", len(r.Response)),
+	)
+
+	return
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/audit"
+	"github.com/schmurfy/sniffit/config"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestAudit(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("audit", func() {
+		var dir string
+		var auditLog *audit.FileLog
+
+		entries := func() []*models.AuditEntry {
+			ret, err := auditLog.FindAuditEntries(context.Background(), &store.AuditQuery{})
+			require.Nil(g, err)
+			return ret
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "audit")
+			require.Nil(g, err)
+
+			auditLog, err = audit.OpenFileLog(filepath.Join(dir, "audit.log"), 1<<20, 1)
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			auditLog.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should record the packets and bytes sent", func() {
+			handler := auditRequests(auditLog)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auditPackets(r.Context(), 3)
+				w.Write([]byte("pcap"))
+			}))
+
+			req := httptest.NewRequest("GET", "/download/10.0.0.1?proto=tcp", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			found := entries()
+			require.Len(g, found, 1)
+			assert.Equal(g, "/download/10.0.0.1", found[0].Path)
+			assert.Equal(g, "proto=tcp", found[0].Query)
+			assert.Equal(g, http.StatusOK, found[0].Status)
+			assert.Equal(g, uint64(3), found[0].Packets)
+			assert.Equal(g, uint64(4), found[0].Bytes)
+			assert.Equal(g, req.RemoteAddr, found[0].Remote)
+		})
+
+		g.It("should not serve the log without authentication", func() {
+			auth, err := NewAuthentication(&config.HTTPAuthConfig{})
+			require.Nil(g, err)
+
+			router, err := newRouter(auth, nil, nil, auditLog, nil, &config.ArchivistConfig{})
+			require.Nil(g, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/audit", nil))
+			assert.Equal(g, http.StatusNotFound, w.Code)
+		})
+
+		g.It("should record the users and restrict the log to the admins", func() {
+			keys := filepath.Join(dir, "keys")
+			err := os.WriteFile(keys, []byte("grafana k3y viewer\nroot r00t admin\n"), 0600)
+			require.Nil(g, err)
+
+			auth, err := NewAuthentication(&config.HTTPAuthConfig{HTTPAPIKeys: keys})
+			require.Nil(g, err)
+
+			router, err := newRouter(auth, nil, nil, auditLog, nil, &config.ArchivistConfig{})
+			require.Nil(g, err)
+
+			call := func(path string, key string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				if key != "" {
+					req.Header.Set("X-API-Key", key)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			// the store does not support flows
+			call("/flows?ip=10.0.0.1", "k3y")
+			call("/flows/6-10.0.0.1-443-10.0.0.2-51000/download", "k3y")
+			call("/flows", "")
+
+			assert.Equal(g, http.StatusForbidden, call("/audit", "k3y").Code)
+			w := call("/audit?from=yesterday", "r00t")
+			assert.Equal(g, http.StatusBadRequest, w.Code)
+			assert.Equal(g, "invalid time: \"yesterday\", expected RFC 3339\n", w.Body.String())
+
+			w = call("/audit?count=-1", "r00t")
+			assert.Equal(g, http.StatusBadRequest, w.Code)
+			assert.Equal(g, "count must be positive\n", w.Body.String())
+
+			w = call("/audit", "r00t")
+			require.Equal(g, http.StatusOK, w.Code, w.Body.String())
+
+			var found []*models.AuditEntry
+			err = json.Unmarshal(w.Body.Bytes(), &found)
+			require.Nil(g, err)
+			require.Len(g, found, 3)
+
+			assert.Equal(g, "", found[0].User)
+			assert.Equal(g, http.StatusUnauthorized, found[0].Status)
+
+			assert.Equal(g, "grafana", found[1].User)
+			assert.Equal(g, "api_key", found[1].Method)
+			assert.Equal(g, "/flows/{Id}/download", found[1].Route)
+			assert.Equal(g, http.StatusForbidden, found[1].Status)
+
+			assert.Equal(g, "/flows", found[2].Route)
+			assert.Equal(g, "ip=10.0.0.1", found[2].Query)
+			assert.Equal(g, http.StatusInternalServerError, found[2].Status)
+		})
+	})
+}
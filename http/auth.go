@@ -0,0 +1,471 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/schmurfy/sniffit/config"
+)
+
+const (
+	// stats, keys and flows
+	RoleViewer = "viewer"
+	// packet captures, includes the viewer role
+	RoleDownloader = "downloader"
+	// audit log, includes every other role
+	RoleAdmin = "admin"
+
+	_apiKeyHeader = "X-API-Key"
+	_jwtLeeway    = time.Minute
+)
+
+var (
+	_jwtAlgorithms = []jose.SignatureAlgorithm{
+		jose.RS256, jose.RS384, jose.RS512,
+		jose.PS256, jose.PS384, jose.PS512,
+		jose.ES256, jose.ES384, jose.ES512,
+		jose.EdDSA,
+	}
+)
+
+type principalKey struct{}
+
+// Principal is the user or service authenticated on the api.
+type Principal struct {
+	Name   string
+	Method string
+	Roles  []string
+}
+
+// HasRole returns true if the principal has the role or a role including it.
+func (p *Principal) HasRole(role string) bool {
+	if slices.Contains(p.Roles, role) || slices.Contains(p.Roles, RoleAdmin) {
+		return true
+	}
+
+	return (role == RoleViewer) && slices.Contains(p.Roles, RoleDownloader)
+}
+
+// PrincipalFromContext returns the principal of the request, nil when the
+// api is not authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authenticator checks one kind of credentials, it returns a nil principal
+// when the request does not hold this kind and an error when they are
+// invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+	// name and definition of the scheme in the OpenAPI document
+	SecurityScheme() (string, *openapi3.SecurityScheme)
+}
+
+// Authentication checks the requests with the configured authenticators,
+// everything is allowed when there is none.
+type Authentication struct {
+	authenticators []Authenticator
+}
+
+func NewAuthentication(cfg *config.HTTPAuthConfig) (*Authentication, error) {
+	ret := &Authentication{}
+
+	if cfg.HTTPAPIKeys != "" {
+		a, err := newAPIKeyAuthenticator(cfg.HTTPAPIKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.authenticators = append(ret.authenticators, a)
+	}
+
+	if cfg.HTTPPasswords != "" {
+		a, err := newBasicAuthenticator(cfg.HTTPPasswords)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.authenticators = append(ret.authenticators, a)
+	}
+
+	if cfg.HTTPJWKS != "" {
+		a, err := newJWTAuthenticator(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.authenticators = append(ret.authenticators, a)
+	}
+
+	return ret, nil
+}
+
+func (a *Authentication) Enabled() bool {
+	return len(a.authenticators) > 0
+}
+
+// SecuritySchemes returns the schemes of the authenticators for the OpenAPI
+// document.
+func (a *Authentication) SecuritySchemes() map[string]*openapi3.SecurityScheme {
+	ret := map[string]*openapi3.SecurityScheme{}
+	for _, authenticator := range a.authenticators {
+		name, scheme := authenticator.SecurityScheme()
+		ret[name] = scheme
+	}
+
+	return ret
+}
+
+// Authenticate returns the principal of the request, nil if it holds no
+// credentials.
+func (a *Authentication) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range a.authenticators {
+		p, err := authenticator.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if p != nil {
+			return p, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Require returns a middleware rejecting the requests without the role.
+func (a *Authentication) Require(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !a.Enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := _tracer.Start(r.Context(), "Authenticate")
+
+			p, err := a.Authenticate(r.WithContext(ctx))
+			switch {
+			case err != nil:
+				span.RecordError(err)
+				span.End()
+				a.unauthorized(w, "invalid credentials")
+				return
+
+			case p == nil:
+				span.End()
+				a.unauthorized(w, "missing credentials")
+				return
+			}
+
+			// the refused requests are audited with the principal too
+			if e := auditEntry(r.Context()); e != nil {
+				e.User, e.Method = p.Name, p.Method
+			}
+
+			if !p.HasRole(role) {
+				span.End()
+				http.Error(w, "the "+role+" role is required", http.StatusForbidden)
+				return
+			}
+
+			span.End()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+func (a *Authentication) unauthorized(w http.ResponseWriter, msg string) {
+	for _, authenticator := range a.authenticators {
+		if _, ok := authenticator.(*basicAuthenticator); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sniffit"`)
+		}
+	}
+
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// readCredentials calls fn with the fields of each line of a credentials
+// file, empty lines and lines starting with # are ignored.
+func readCredentials(path string, sep func(string) []string, fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		err = fn(sep(line))
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", path, lineNumber)
+		}
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+func parseRoles(s string) ([]string, error) {
+	roles := strings.Split(s, ",")
+	for _, role := range roles {
+		if (role != RoleViewer) && (role != RoleDownloader) && (role != RoleAdmin) {
+			return nil, errors.Errorf("unknown role: %s", role)
+		}
+	}
+
+	return roles, nil
+}
+
+// apiKeyAuthenticator reads "<name> <key> <roles>" lines, the key is sent
+// in the X-API-Key header.
+type apiKeyAuthenticator struct {
+	keys map[string]*Principal
+}
+
+func newAPIKeyAuthenticator(path string) (*apiKeyAuthenticator, error) {
+	ret := &apiKeyAuthenticator{keys: map[string]*Principal{}}
+
+	err := readCredentials(path, strings.Fields, func(fields []string) error {
+		if len(fields) != 3 {
+			return errors.New("expected <name> <key> <roles>")
+		}
+
+		roles, err := parseRoles(fields[2])
+		if err != nil {
+			return err
+		}
+
+		ret.keys[fields[1]] = &Principal{Name: fields[0], Method: "api_key", Roles: roles}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(_apiKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+
+	for known, p := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(key)) == 1 {
+			return p, nil
+		}
+	}
+
+	return nil, errors.New("unknown api key")
+}
+
+func (a *apiKeyAuthenticator) SecurityScheme() (string, *openapi3.SecurityScheme) {
+	return "api_key", openapi3.NewSecurityScheme().
+		WithType("apiKey").
+		WithIn("header").
+		WithName(_apiKeyHeader)
+}
+
+type user struct {
+	hash  []byte
+	roles []string
+}
+
+// basicAuthenticator reads "<user>:<bcrypt hash>:<roles>" lines, like an
+// htpasswd file with the roles of each user.
+type basicAuthenticator struct {
+	users map[string]*user
+
+	// compared with the password of unknown users so they take as long to
+	// refuse as a wrong password
+	dummyHash []byte
+}
+
+func newBasicAuthenticator(path string) (*basicAuthenticator, error) {
+	ret := &basicAuthenticator{users: map[string]*user{}}
+	cost := bcrypt.DefaultCost
+
+	split := func(line string) []string { return strings.Split(line, ":") }
+
+	err := readCredentials(path, split, func(fields []string) error {
+		if len(fields) != 3 {
+			return errors.New("expected <user>:<bcrypt hash>:<roles>")
+		}
+
+		userCost, err := bcrypt.Cost([]byte(fields[1]))
+		if err != nil {
+			return errors.Wrap(err, fields[0])
+		}
+		cost = max(cost, userCost)
+
+		roles, err := parseRoles(fields[2])
+		if err != nil {
+			return err
+		}
+
+		ret.users[fields[0]] = &user{hash: []byte(fields[1]), roles: roles}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return ret, nil
+}
+
+func (a *basicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	// the same error for both cases, the name is not reported
+	u, exists := a.users[name]
+	if !exists {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return nil, errors.New("invalid user or password")
+	}
+
+	err := bcrypt.CompareHashAndPassword(u.hash, []byte(password))
+	if err != nil {
+		return nil, errors.New("invalid user or password")
+	}
+
+	return &Principal{Name: name, Method: "basic", Roles: u.roles}, nil
+}
+
+func (a *basicAuthenticator) SecurityScheme() (string, *openapi3.SecurityScheme) {
+	return "basic", openapi3.NewSecurityScheme().
+		WithType("http").
+		WithScheme("basic")
+}
+
+// jwtAuthenticator verifies the bearer tokens with the keys of a JWKS file,
+// the roles are read from a claim holding a list or a space separated
+// string.
+type jwtAuthenticator struct {
+	keys       jose.JSONWebKeySet
+	issuer     string
+	audience   string
+	rolesClaim string
+	now        func() time.Time
+}
+
+func newJWTAuthenticator(cfg *config.HTTPAuthConfig) (*jwtAuthenticator, error) {
+	data, err := os.ReadFile(cfg.HTTPJWKS)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := &jwtAuthenticator{
+		issuer:     cfg.HTTPJWTIssuer,
+		audience:   cfg.HTTPJWTAudience,
+		rolesClaim: cfg.HTTPJWTRolesClaim,
+		now:        time.Now,
+	}
+
+	if ret.rolesClaim == "" {
+		ret.rolesClaim = "roles"
+	}
+
+	err = json.Unmarshal(data, &ret.keys)
+	if err != nil {
+		return nil, errors.Wrap(err, cfg.HTTPJWKS)
+	}
+
+	if len(ret.keys.Keys) == 0 {
+		return nil, errors.Errorf("no key found in %s", cfg.HTTPJWKS)
+	}
+
+	return ret, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, nil
+	}
+
+	token, err := jwt.ParseSigned(raw, _jwtAlgorithms)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// without key id every key is tried
+	candidates := a.keys.Keys
+	if kid := token.Headers[0].KeyID; kid != "" {
+		candidates = a.keys.Key(kid)
+	}
+
+	var claims jwt.Claims
+	custom := map[string]any{}
+	err = errors.New("no key matches the token")
+	for _, key := range candidates {
+		err = token.Claims(key.Public(), &claims, &custom)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if claims.Expiry == nil {
+		return nil, errors.New("token without expiration")
+	}
+
+	expected := jwt.Expected{Issuer: a.issuer, Time: a.now()}
+	if a.audience != "" {
+		expected.AnyAudience = jwt.Audience{a.audience}
+	}
+
+	err = claims.ValidateWithLeeway(expected, _jwtLeeway)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var roles []string
+	switch value := custom[a.rolesClaim].(type) {
+	case string:
+		roles = strings.Fields(value)
+	case []any:
+		for _, role := range value {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	}
+
+	return &Principal{Name: claims.Subject, Method: "jwt", Roles: roles}, nil
+}
+
+func (a *jwtAuthenticator) SecurityScheme() (string, *openapi3.SecurityScheme) {
+	return "jwt", openapi3.NewJWTSecurityScheme()
+}
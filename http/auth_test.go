@@ -0,0 +1,232 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/getkin/kin-openapi/openapi3"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/schmurfy/sniffit/config"
+)
+
+func TestAuthentication(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Authentication", func() {
+		var dir string
+		var cfg *config.HTTPAuthConfig
+		var signer jose.Signer
+
+		write := func(name string, content string) string {
+			path := filepath.Join(dir, name)
+			err := os.WriteFile(path, []byte(content), 0600)
+			require.Nil(g, err)
+			return path
+		}
+
+		// returns the status and the name of the principal
+		call := func(auth *Authentication, role string, prepare func(*http.Request)) (int, string) {
+			var name string
+			handler := auth.Require(role)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if p := PrincipalFromContext(r.Context()); p != nil {
+					name = p.Name
+				}
+			}))
+
+			req := httptest.NewRequest("GET", "/stats", nil)
+			prepare(req)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w.Code, name
+		}
+
+		token := func(claims any) string {
+			raw, err := jwt.Signed(signer).Claims(claims).Serialize()
+			require.Nil(g, err)
+			return raw
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "auth")
+			require.Nil(g, err)
+
+			hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+			require.Nil(g, err)
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.Nil(g, err)
+
+			signer, err = jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: "k1"}}, nil)
+			require.Nil(g, err)
+
+			jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"},
+			}})
+			require.Nil(g, err)
+
+			cfg = &config.HTTPAuthConfig{
+				HTTPAPIKeys:     write("keys", "# api keys\ngrafana k3y viewer\nexport d0wnl0ad downloader\n"),
+				HTTPPasswords:   write("passwords", fmt.Sprintf("alice:%s:viewer\n", hash)),
+				HTTPJWKS:        write("jwks.json", string(jwks)),
+				HTTPJWTIssuer:   "https://sso",
+				HTTPJWTAudience: "sniffit",
+			}
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("should allow everything without authenticator", func() {
+			auth, err := NewAuthentication(&config.HTTPAuthConfig{})
+			require.Nil(g, err)
+
+			status, _ := call(auth, RoleDownloader, func(*http.Request) {})
+			assert.Equal(g, http.StatusOK, status)
+		})
+
+		g.It("should check the api keys", func() {
+			auth, err := NewAuthentication(cfg)
+			require.Nil(g, err)
+
+			status, name := call(auth, RoleViewer, func(r *http.Request) { r.Header.Set("X-API-Key", "k3y") })
+			assert.Equal(g, http.StatusOK, status)
+			assert.Equal(g, "grafana", name)
+
+			status, _ = call(auth, RoleDownloader, func(r *http.Request) { r.Header.Set("X-API-Key", "k3y") })
+			assert.Equal(g, http.StatusForbidden, status)
+
+			// the downloaders are also viewers
+			status, _ = call(auth, RoleViewer, func(r *http.Request) { r.Header.Set("X-API-Key", "d0wnl0ad") })
+			assert.Equal(g, http.StatusOK, status)
+
+			status, _ = call(auth, RoleViewer, func(r *http.Request) { r.Header.Set("X-API-Key", "guess") })
+			assert.Equal(g, http.StatusUnauthorized, status)
+
+			status, _ = call(auth, RoleViewer, func(*http.Request) {})
+			assert.Equal(g, http.StatusUnauthorized, status)
+		})
+
+		g.It("should check the passwords", func() {
+			auth, err := NewAuthentication(cfg)
+			require.Nil(g, err)
+
+			status, name := call(auth, RoleViewer, func(r *http.Request) { r.SetBasicAuth("alice", "pass") })
+			assert.Equal(g, http.StatusOK, status)
+			assert.Equal(g, "alice", name)
+
+			status, _ = call(auth, RoleViewer, func(r *http.Request) { r.SetBasicAuth("alice", "wrong") })
+			assert.Equal(g, http.StatusUnauthorized, status)
+		})
+
+		g.It("should not tell the unknown users from the wrong passwords", func() {
+			basic, err := newBasicAuthenticator(cfg.HTTPPasswords)
+			require.Nil(g, err)
+
+			authenticate := func(name string, password string) error {
+				req := httptest.NewRequest("GET", "/stats", nil)
+				req.SetBasicAuth(name, password)
+
+				_, err := basic.Authenticate(req)
+				return err
+			}
+
+			wrongPassword := authenticate("alice", "wrong")
+			require.NotNil(g, wrongPassword)
+
+			unknownUser := authenticate("mallory", "pass")
+			require.NotNil(g, unknownUser)
+			assert.Equal(g, wrongPassword.Error(), unknownUser.Error())
+			assert.NotContains(g, unknownUser.Error(), "mallory")
+		})
+
+		g.It("should check the JWTs", func() {
+			auth, err := NewAuthentication(cfg)
+			require.Nil(g, err)
+
+			claims := map[string]any{
+				"sub":   "bob",
+				"iss":   "https://sso",
+				"aud":   "sniffit",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"roles": []string{"downloader"},
+			}
+
+			bearer := func(raw string) func(*http.Request) {
+				return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+raw) }
+			}
+
+			status, name := call(auth, RoleDownloader, bearer(token(claims)))
+			assert.Equal(g, http.StatusOK, status)
+			assert.Equal(g, "bob", name)
+
+			claims["roles"] = "viewer"
+			status, _ = call(auth, RoleDownloader, bearer(token(claims)))
+			assert.Equal(g, http.StatusForbidden, status)
+
+			claims["aud"] = "other"
+			status, _ = call(auth, RoleViewer, bearer(token(claims)))
+			assert.Equal(g, http.StatusUnauthorized, status)
+
+			claims["aud"] = "sniffit"
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			status, _ = call(auth, RoleViewer, bearer(token(claims)))
+			assert.Equal(g, http.StatusUnauthorized, status)
+
+			delete(claims, "exp")
+			status, _ = call(auth, RoleViewer, bearer(token(claims)))
+			assert.Equal(g, http.StatusUnauthorized, status)
+		})
+
+		g.It("should reject unknown roles", func() {
+			cfg.HTTPAPIKeys = write("keys", "grafana k3y root\n")
+
+			_, err := NewAuthentication(cfg)
+			assert.NotNil(g, err)
+		})
+
+		g.It("should list the roles in the OpenAPI document", func() {
+			auth, err := NewAuthentication(cfg)
+			require.Nil(g, err)
+
+			router, err := newRouter(auth, nil, nil, nil, nil, &config.ArchivistConfig{})
+			require.Nil(g, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/doc.json", nil))
+			require.Equal(g, http.StatusOK, w.Code, w.Body.String())
+
+			var doc openapi3.T
+			err = json.Unmarshal(w.Body.Bytes(), &doc)
+			require.Nil(g, err)
+
+			assert.Len(g, doc.Components.SecuritySchemes, 3)
+
+			op := doc.Paths.Find("/download/{Address}").Get
+			require.NotNil(g, op)
+			require.NotNil(g, op.Security)
+			assert.Contains(g, *op.Security, openapi3.SecurityRequirement{"api_key": {"downloader"}})
+
+			op = doc.Paths.Find("/stats").Get
+			assert.Contains(g, *op.Security, openapi3.SecurityRequirement{"basic": {"viewer"}})
+		})
+	})
+}
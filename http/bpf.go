@@ -0,0 +1,115 @@
+package http
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+)
+
+// packetFilter applies a tcpdump filter on the stored packets, the filter
+// offsets depend on the link type so it is compiled once for each link type
+// found in the packets. The programs live as long as the request, Close must
+// be called once the download is done.
+type packetFilter struct {
+	expr     string
+	snapLen  int
+	programs map[layers.LinkType]*pcap.BPF
+}
+
+func newPacketFilter(expr string, snapLen int) (*packetFilter, error) {
+	// compiled right away to report syntax errors before the download
+	// starts, the instructions are not kept
+	_, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, expr)
+	if err != nil {
+		return nil, badRequest("invalid filter %q: %s", expr, err)
+	}
+
+	return &packetFilter{
+		expr:     expr,
+		snapLen:  snapLen,
+		programs: map[layers.LinkType]*pcap.BPF{},
+	}, nil
+}
+
+// Close drops the compiled programs, pcap only releases them once they are
+// garbage collected.
+func (f *packetFilter) Close() {
+	f.programs = nil
+}
+
+func (f *packetFilter) program(linkType layers.LinkType) (*pcap.BPF, error) {
+	if prog, found := f.programs[linkType]; found {
+		return prog, nil
+	}
+
+	prog, err := pcap.NewBPF(linkType, f.snapLen, f.expr)
+	if err != nil {
+		return nil, badRequest("invalid filter %q for link type %s: %s", f.expr, linkType, err)
+	}
+
+	f.programs[linkType] = prog
+	return prog, nil
+}
+
+func (f *packetFilter) Matches(pkt *models.Packet) (bool, error) {
+	prog, err := f.program(pkt.CaptureLinkType())
+	if err != nil {
+		return false, err
+	}
+
+	return prog.Matches(captureInfo(pkt), pkt.Data), nil
+}
+
+// Filter returns an iterator only returning the packets matching the filter,
+// at most maxCount packets are returned if it is positive.
+func (f *packetFilter) Filter(it store.PacketIterator, maxCount int) store.PacketIterator {
+	remaining := -1
+	if maxCount > 0 {
+		remaining = maxCount
+	}
+
+	return &filterIterator{
+		PacketIterator: it,
+		filter:         f,
+		remaining:      remaining,
+	}
+}
+
+type filterIterator struct {
+	store.PacketIterator
+	filter    *packetFilter
+	remaining int
+	err       error
+}
+
+func (it *filterIterator) Next() bool {
+	if (it.err != nil) || (it.remaining == 0) {
+		return false
+	}
+
+	for it.PacketIterator.Next() {
+		match, err := it.filter.Matches(it.PacketIterator.Packet())
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		if match {
+			if it.remaining > 0 {
+				it.remaining--
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *filterIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.PacketIterator.Err()
+}
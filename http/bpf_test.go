@@ -0,0 +1,118 @@
+// +build test
+
+package http
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/audit"
+	"github.com/schmurfy/sniffit/config"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+func TestPacketFilter(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("packet filter", func() {
+		addr1 := net.ParseIP("10.0.0.1").To4()
+		addr2 := net.ParseIP("10.0.0.2").To4()
+		addr3 := net.ParseIP("10.0.0.3").To4()
+
+		now := time.Now()
+
+		// filter returns the ids of the packets going through the filter
+		filter := func(expr string, maxCount int, pkts ...*models.Packet) []string {
+			f, err := newPacketFilter(expr, _defaultSnapLen)
+			require.Nil(g, err)
+			defer f.Close()
+
+			ids := []string{}
+			byId := map[string]*models.Packet{}
+			for _, pkt := range pkts {
+				ids = append(ids, pkt.Id)
+				byId[pkt.Id] = pkt
+			}
+
+			it := f.Filter(store.NewIdsIterator(ids, nil, func(id string) (*models.Packet, error) {
+				return byId[id], nil
+			}), maxCount)
+
+			filtered, err := store.CollectPackets(it)
+			require.Nil(g, err)
+
+			ret := []string{}
+			for _, pkt := range filtered {
+				ret = append(ret, pkt.Id)
+			}
+
+			return ret
+		}
+
+		udp := func(id string, dstPort uint16) *models.Packet {
+			return &models.Packet{Id: id, Data: store.BuildUDPPacket(addr1, addr2, 51000, dstPort), Timestamp: now}
+		}
+
+		g.It("should return the matching packets", func() {
+			ids := filter("udp dst port 53", 0, udp("p1", 53), udp("p2", 123), udp("p3", 53))
+			assert.Equal(g, []string{"p1", "p3"}, ids)
+		})
+
+		g.It("should not return anything without a match", func() {
+			ids := filter("tcp", 0, udp("p1", 53), udp("p2", 123))
+			assert.Empty(g, ids)
+		})
+
+		g.It("should only count the matching packets", func() {
+			ids := filter("udp dst port 53", 2, udp("p1", 123), udp("p2", 53), udp("p3", 123), udp("p4", 53), udp("p5", 53))
+			assert.Equal(g, []string{"p2", "p4"}, ids)
+		})
+
+		g.It("should compile the filter for each link type", func() {
+			ids := filter("src host 10.0.0.1", 0,
+				udp("p1", 53),
+				&models.Packet{Id: "p2", Data: store.BuildRawPacket(addr1, addr2), Timestamp: now, LinkType: layers.LinkTypeRaw},
+				&models.Packet{Id: "p3", Data: store.BuildRawPacket(addr3, addr2), Timestamp: now, LinkType: layers.LinkTypeRaw},
+			)
+			assert.Equal(g, []string{"p1", "p2"}, ids)
+		})
+
+		g.It("should reject invalid expressions", func() {
+			_, err := newPacketFilter("udp dst port", _defaultSnapLen)
+			assert.NotNil(g, err)
+
+			dir, err := os.MkdirTemp("", "bpf")
+			require.Nil(g, err)
+			defer os.RemoveAll(dir)
+
+			auditLog, err := audit.OpenFileLog(filepath.Join(dir, "audit.log"), 1<<20, 1)
+			require.Nil(g, err)
+			defer auditLog.Close()
+
+			dataStore := &directStore{}
+
+			auth, err := NewAuthentication(&config.HTTPAuthConfig{})
+			require.Nil(g, err)
+
+			router, err := newRouter(auth, nil, dataStore, auditLog, stats.NewStats(), &config.ArchivistConfig{})
+			require.Nil(g, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/download/10.0.0.1?bpf=udp+dst+port", nil))
+			assert.Equal(g, http.StatusBadRequest, w.Code, w.Body.String())
+			assert.False(g, dataStore.scanned)
+		})
+	})
+}
@@ -1,18 +1,14 @@
 package http
 
 import (
-	"bytes"
 	"context"
-	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
-	"github.com/pkg/errors"
-	"github.com/schmurfy/chipi/response"
 	"github.com/schmurfy/sniffit/models"
 	"github.com/schmurfy/sniffit/store"
 	"go.opentelemetry.io/otel/attribute"
@@ -23,115 +19,424 @@ const (
 	ISO8601 = "2006-01-02T15:04:05-0700"
 )
 
+var (
+	_protocolNames = map[string]layers.IPProtocol{
+		"icmp":   layers.IPProtocolICMPv4,
+		"tcp":    layers.IPProtocolTCP,
+		"udp":    layers.IPProtocolUDP,
+		"icmpv6": layers.IPProtocolICMPv6,
+		"sctp":   layers.IPProtocolSCTP,
+	}
+)
+
+// DownloadQuery holds the filters shared by the download endpoints.
+type DownloadQuery struct {
+	From      *string `example:"2025-11-09T11:00:00+01:00"`
+	To        *string `example:"2019-09-07T15:50:00+01:00"`
+	Count     *int
+	Agent     *string `example:"sensor1" description:"only return packets captured by this agent"`
+	Dedup     *bool   `description:"only return the first copy of the packets captured by several agents"`
+	EtherType *string `example:"0x0806" description:"only return frames with this ethertype"`
+	Proto     *string `example:"tcp" description:"only return packets with this transport protocol (tcp, udp, sctp, icmp, icmpv6 or its number)"`
+	Port      *string `example:"53" description:"only return packets with this source or destination port"`
+	SrcPort   *string `example:"51000" description:"only return packets with this source port"`
+	DstPort   *string `example:"443" description:"only return packets with this destination port"`
+	Format    *string `example:"pcapng" description:"pcap (default) or pcapng, pcapng files include one interface per agent"`
+	Bpf       *string `example:"tcp[tcpflags] & tcp-syn != 0" description:"only return packets matching this filter (tcpdump syntax)"`
+}
+
+// downloadOptions controls how the packets found are written.
+type downloadOptions struct {
+	format string
+	filter *packetFilter
+}
+
+// build converts the query parameters to a store query, the filter is
+// compiled for packets truncated to snapLen.
+func (dq *DownloadQuery) build(snapLen int) (query *store.FindQuery, opts *downloadOptions, err error) {
+	query = &store.FindQuery{}
+
+	if dq.From != nil {
+		query.From, err = parseTime(*dq.From)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if dq.To != nil {
+		query.To, err = parseTime(*dq.To)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if dq.Count != nil {
+		if *dq.Count < 0 {
+			return nil, nil, badRequest("count must be positive")
+		}
+		query.MaxCount = *dq.Count
+	}
+
+	if dq.Agent != nil {
+		query.Agent = *dq.Agent
+	}
+
+	if dq.Dedup != nil {
+		query.SkipDuplicates = *dq.Dedup
+	}
+
+	if dq.EtherType != nil {
+		var etherType uint64
+		etherType, err = strconv.ParseUint(*dq.EtherType, 0, 16)
+		if err != nil {
+			return nil, nil, badRequest("invalid ethertype: %q", *dq.EtherType)
+		}
+		query.EtherType = uint16(etherType)
+	}
+
+	if dq.Proto != nil {
+		query.Protocol, err = parseProtocol(*dq.Proto)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, p := range []struct {
+		param *string
+		value *uint16
+	}{
+		{dq.Port, &query.Port},
+		{dq.SrcPort, &query.SrcPort},
+		{dq.DstPort, &query.DstPort},
+	} {
+		if p.param != nil {
+			*p.value, err = parsePort(*p.param)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	opts = &downloadOptions{format: "pcap"}
+	if dq.Format != nil {
+		opts.format = *dq.Format
+	}
+
+	if (opts.format != "pcap") && (opts.format != "pcapng") {
+		return nil, nil, badRequest("unknown format: %q", opts.format)
+	}
+
+	if dq.Bpf != nil {
+		opts.filter, err = newPacketFilter(*dq.Bpf, snapLen)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return
+}
+
+func parseProtocol(s string) (layers.IPProtocol, error) {
+	if proto, found := _protocolNames[strings.ToLower(s)]; found {
+		return proto, nil
+	}
+
+	proto, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, badRequest("invalid protocol: %q", s)
+	}
+
+	return layers.IPProtocol(proto), nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, badRequest("invalid port: %q", s)
+	}
+
+	return uint16(port), nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, badRequest("invalid time: %q, expected RFC 3339", s)
+	}
+
+	return t, nil
+}
+
+// parseAddress parses an IP or a MAC address.
+func parseAddress(s string) (*packetSelector, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &packetSelector{ip: ip}, nil
+	}
+
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, badRequest("invalid address: %q", s)
+	}
+
+	return &packetSelector{mac: mac}, nil
+}
+
 type DownloadRequest struct {
-	response.ErrorEncoder
+	errorEncoder
 
 	Path struct {
-		Address string
+		Address string `description:"IPv4, IPv6 or MAC address"`
 	} `example:"/download/1.2.3.4"`
 
 	Query struct {
-		From  *string `example:"2025-11-09T11:00:00+01:00"`
-		To    *string `example:"2019-09-07T15:50:00+01:00"`
-		Count *int
+		DownloadQuery
+		Direction *string `example:"src" description:"src to only return packets sent by the address, dst for the packets sent to it"`
 	}
 
-	response.BytesEncoder
-	Response []byte
+	streamEncoder
+	Response []byte `content-type:"application/octet-stream"`
 
-	Index store.IndexInterface
-	Store store.StoreInterface
-
-	snaplen int32
+	Downloader
 }
 
-func (r *DownloadRequest) Handle(ctx context.Context, w http.ResponseWriter) error {
-	var err error
-
+func (r *DownloadRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
 	ctx, span := _tracer.Start(ctx, "DownloadRequest", trace.WithAttributes(
 		attribute.String("request.Address", r.Path.Address),
 	))
 	defer func() {
 		if err != nil {
 			span.RecordError(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		span.End()
 	}()
 
-	query := &store.FindQuery{}
+	query, opts, err := r.Query.build(r.snapLen())
+	if err != nil {
+		return
+	}
+
+	sel, err := parseAddress(r.Path.Address)
+	if err != nil {
+		return
+	}
+
+	direction := ""
+	if r.Query.Direction != nil {
+		direction = *r.Query.Direction
+	}
+
+	switch direction {
+	case "":
+	case "src":
+		sel.filterSource(query)
+	case "dst":
+		sel.filterDestination(query)
+	default:
+		err = badRequest("invalid direction: %q", direction)
+		return
+	}
+
+	err = r.download(ctx, w, sel, query, opts)
+	return
+}
+
+type DownloadQueryRequest struct {
+	errorEncoder
+
+	Path struct{} `example:"/download"`
+
+	Query struct {
+		DownloadQuery
+		Src   *string  `example:"10.0.0.1" description:"only return packets sent by this IP or MAC address"`
+		Dst   *string  `example:"10.0.0.53" description:"only return packets sent to this IP or MAC address"`
+		Sport *string  `example:"51000" description:"with dport, src, dst and proto: return the packets of this conversation in both directions"`
+		Dport *string  `example:"443" description:"with sport, src, dst and proto: return the packets of this conversation in both directions"`
+		Ip    []string `example:"[\"10.0.0.1\"]" description:"only return packets sent from or to one of these addresses, can be repeated or comma separated"`
+		Cidr  []string `example:"[\"10.1.0.0/16\"]" description:"only return packets sent from or to one of these networks, can be repeated or comma separated"`
+	}
 
-	if r.Query.From != nil {
-		query.From, err = time.Parse(time.RFC3339, *r.Query.From)
+	streamEncoder
+	Response []byte `content-type:"application/octet-stream"`
+
+	Downloader
+}
+
+func (r *DownloadQueryRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
+	ctx, span := _tracer.Start(ctx, "DownloadQueryRequest")
+	defer func() {
 		if err != nil {
-			return errors.WithStack(err)
+			span.RecordError(err)
 		}
+		span.End()
+	}()
+
+	query, opts, err := r.Query.build(r.snapLen())
+	if err != nil {
+		return
 	}
 
-	if r.Query.To != nil {
-		query.To, err = time.Parse(time.RFC3339, *r.Query.To)
+	query.Networks, err = parseNetworks(r.Query.Ip, r.Query.Cidr)
+	if err != nil {
+		return
+	}
+
+	if (r.Query.Sport != nil) || (r.Query.Dport != nil) {
+		var sel *packetSelector
+
+		sel, err = r.flowSelector(query)
 		if err != nil {
-			return errors.WithStack(err)
+			return
 		}
-	}
 
-	if r.Query.Count != nil {
-		query.MaxCount = *r.Query.Count
+		err = r.download(ctx, w, sel, query, opts)
+		return
 	}
 
-	ip := net.ParseIP(r.Path.Address).To4()
+	// the source address is used to select the packets if both are given,
+	// without any address the networks or the port index are used
+	var sel *packetSelector
 
-	var pkts []*models.Packet
-	directData, ok := r.Store.(store.DirectDataInterface)
-	if ok {
-		pkts, err = directData.GetPacketsByAddress(ctx, ip, query)
+	if r.Query.Dst != nil {
+		sel, err = parseAddress(*r.Query.Dst)
 		if err != nil {
-			return errors.WithStack(err)
+			return
 		}
-	} else {
+		sel.filterDestination(query)
+	}
 
-		ids, err := r.Index.FindPacketsByAddress(ctx, ip)
+	if r.Query.Src != nil {
+		sel, err = parseAddress(*r.Query.Src)
 		if err != nil {
-			return errors.WithStack(err)
+			return
+		}
+		sel.filterSource(query)
+	}
+
+	err = r.download(ctx, w, sel, query, opts)
+	return
+}
+
+// parseNetworks converts the ip and cidr parameters to networks, a single
+// address is a network with a full mask.
+func parseNetworks(ips []string, cidrs []string) (ret []*net.IPNet, err error) {
+	for _, s := range ips {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, badRequest("invalid address: %q", s)
+		}
+
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			bits = net.IPv4len * 8
 		}
 
-		pkts, err = r.Store.GetPackets(ctx, ids, query)
+		ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	for _, s := range cidrs {
+		var network *net.IPNet
+
+		_, network, err = net.ParseCIDR(strings.TrimSpace(s))
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, badRequest("invalid network: %q", s)
 		}
+
+		ret = append(ret, network)
 	}
 
-	span.SetAttributes(
-		attribute.Int("response.packets_count", len(pkts)),
-	)
+	for i, network := range ret {
+		ret[i] = models.NormalizeNetwork(network)
+	}
+
+	return
+}
+
+// joinRepeatedParams merges the values of repeated query parameters in a
+// comma separated list, the request parser only reads the first value.
+func joinRepeatedParams(names ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			values := req.URL.Query()
+			for _, name := range names {
+				if len(values[name]) > 1 {
+					values.Set(name, strings.Join(values[name], ","))
+				}
+			}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", `inline; filename=data.pcap`)
+			req.URL.RawQuery = values.Encode()
+			next.ServeHTTP(w, req)
+		})
+	}
+}
 
-	buff := bytes.NewBufferString("")
-	pcapWriter := pcapgo.NewWriter(buff)
+// flowSelector sets the query flow from the five-tuple parameters.
+func (r *DownloadQueryRequest) flowSelector(query *store.FindQuery) (*packetSelector, error) {
+	if (r.Query.Src == nil) || (r.Query.Dst == nil) || (r.Query.Sport == nil) ||
+		(r.Query.Dport == nil) || (r.Query.Proto == nil) {
+		return nil, badRequest("src, dst, sport, dport and proto are required to select a conversation")
+	}
+
+	src := net.ParseIP(*r.Query.Src)
+	dst := net.ParseIP(*r.Query.Dst)
+	if (src == nil) || (dst == nil) {
+		return nil, badRequest("src and dst must be IP addresses to select a conversation")
+	}
 
-	err = pcapWriter.WriteFileHeader(65535, layers.LinkTypeEthernet)
+	sport, err := parsePort(*r.Query.Sport)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, err
 	}
 
-	fmt.Printf("Packets: %d\n", len(pkts))
+	dport, err := parsePort(*r.Query.Dport)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, pkt := range pkts {
-		ci := gopacket.CaptureInfo{
-			CaptureLength: len(pkt.Data),
-			Length:        len(pkt.Data),
-			Timestamp:     pkt.Timestamp,
-		}
+	query.Flow = models.NewFlow(query.Protocol,
+		models.FlowEndpoint{IP: src, Port: sport},
+		models.FlowEndpoint{IP: dst, Port: dport},
+	)
 
-		err = pcapWriter.WritePacket(ci, pkt.Data)
+	return &packetSelector{ip: src}, nil
+}
+
+type FlowDownloadRequest struct {
+	errorEncoder
+
+	Path struct {
+		Id string `description:"flow identifier: protocol-ip-port-ip-port"`
+	} `example:"/flows/6-10.0.0.1-443-10.0.0.2-51000/download"`
+
+	Query DownloadQuery
+
+	streamEncoder
+	Response []byte `content-type:"application/octet-stream"`
+
+	Downloader
+}
+
+func (r *FlowDownloadRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
+	ctx, span := _tracer.Start(ctx, "FlowDownloadRequest", trace.WithAttributes(
+		attribute.String("request.Id", r.Path.Id),
+	))
+	defer func() {
 		if err != nil {
-			return errors.WithStack(err)
+			span.RecordError(err)
 		}
+		span.End()
+	}()
+
+	query, opts, err := r.Query.build(r.snapLen())
+	if err != nil {
+		return
 	}
 
-	r.Response = buff.Bytes()
+	query.Flow, err = models.ParseFlowID(r.Path.Id)
+	if err != nil {
+		err = badRequest("%s", err)
+		return
+	}
 
-	return nil
+	err = r.download(ctx, w, &packetSelector{ip: query.Flow.A.IP}, query, opts)
+	return
 }
@@ -0,0 +1,157 @@
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/audit"
+	"github.com/schmurfy/sniffit/config"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+)
+
+// directStore records the scans of every packet
+type directStore struct {
+	store.StoreInterface
+	store.DirectDataInterface
+
+	scanned bool
+	packets []*models.Packet
+}
+
+func (s *directStore) ScanMatchingPackets(context.Context, *store.FindQuery) (store.PacketIterator, error) {
+	s.scanned = true
+	return store.NewIdsIterator(nil, nil, nil), nil
+}
+
+func (s *directStore) ScanPacketsByAddress(ctx context.Context, ip net.IP, q *store.FindQuery) (store.PacketIterator, error) {
+	s.scanned = true
+
+	ids := []string{}
+	byId := map[string]*models.Packet{}
+	for _, pkt := range s.packets {
+		ids = append(ids, pkt.Id)
+		byId[pkt.Id] = pkt
+	}
+
+	return store.NewIdsIterator(ids, nil, func(id string) (*models.Packet, error) {
+		return byId[id], nil
+	}), nil
+}
+
+func TestDownload(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("download", func() {
+		var dataStore *directStore
+		var router http.Handler
+		var auditLog *audit.FileLog
+		var st *stats.Stats
+		var dir string
+
+		call := func(path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			return w
+		}
+
+		g.BeforeEach(func() {
+			var err error
+
+			dir, err = os.MkdirTemp("", "download")
+			require.Nil(g, err)
+
+			auditLog, err = audit.OpenFileLog(filepath.Join(dir, "audit.log"), 1<<20, 1)
+			require.Nil(g, err)
+
+			dataStore = &directStore{}
+			st = stats.NewStats()
+
+			auth, err := NewAuthentication(&config.HTTPAuthConfig{})
+			require.Nil(g, err)
+
+			router, err = newRouter(auth, nil, dataStore, auditLog, st, &config.ArchivistConfig{})
+			require.Nil(g, err)
+		})
+
+		g.AfterEach(func() {
+			auditLog.Close()
+			os.RemoveAll(dir)
+		})
+
+		g.It("should require a selector", func() {
+			for _, path := range []string{"/download", "/download?agent=sensor1&proto=tcp", "/download?from=2025-11-09T11:00:00Z"} {
+				assert.Equal(g, http.StatusBadRequest, call(path).Code, path)
+			}
+
+			assert.False(g, dataStore.scanned)
+		})
+
+		g.It("should reject invalid parameters", func() {
+			for path, msg := range map[string]string{
+				"/download/10.0.0.1?from=yesterday":                   `invalid time: "yesterday", expected RFC 3339`,
+				"/download/10.0.0.1?port=http":                        `invalid port: "http"`,
+				"/download/10.0.0.1?count=-1":                         "count must be positive",
+				"/download/10.0.0.1?format=txt":                       `unknown format: "txt"`,
+				"/download/10.0.0.1?direction=up":                     `invalid direction: "up"`,
+				"/download/not-an-address":                            `invalid address: "not-an-address"`,
+				"/download?cidr=10.0.0.0/33":                          `invalid network: "10.0.0.0/33"`,
+				"/download?src=10.0.0.1&dst=10.0.0.2&sport=1&dport=2": "src, dst, sport, dport and proto are required to select a conversation",
+				"/flows/6-10.0.0.1/download":                          `invalid flow id: "6-10.0.0.1"`,
+				"/keys?cidr=10.0.0.0/33":                              `invalid network: "10.0.0.0/33"`,
+				"/keys?to=tomorrow":                                   `invalid time: "tomorrow", expected RFC 3339`,
+				"/keys?count=-1":                                      "offset and count must be positive",
+				"/flows?ip=zz":                                        `invalid address: "zz"`,
+				"/flows?count=-1":                                     "count must be positive",
+			} {
+				w := call(path)
+				assert.Equal(g, http.StatusBadRequest, w.Code, path)
+				assert.Equal(g, msg+"\n", w.Body.String(), path)
+			}
+
+			assert.False(g, dataStore.scanned)
+		})
+
+		g.It("should not mix link types in a pcap file", func() {
+			now := time.Now()
+			dataStore.packets = []*models.Packet{
+				{Id: "p1", Data: make([]byte, 60), Timestamp: now, LinkType: layers.LinkTypeEthernet},
+				{Id: "p2", Data: make([]byte, 40), Timestamp: now, LinkType: layers.LinkTypeRaw},
+			}
+
+			w := call("/download/10.0.0.1")
+			assert.Equal(g, http.StatusBadRequest, w.Code)
+			assert.Contains(g, w.Body.String(), "format=pcapng")
+
+			w = call("/download/10.0.0.1?format=pcapng")
+			assert.Equal(g, http.StatusOK, w.Code, w.Body.String())
+		})
+
+		g.It("should write the snap length of the captures in the pcap header", func() {
+			dataStore.packets = []*models.Packet{
+				{Id: "p1", Data: make([]byte, 60), Timestamp: time.Now(), LinkType: layers.LinkTypeEthernet},
+			}
+
+			st.RegisterCapture("sensor1", "eth0", "", 1500)
+			st.RegisterCapture("sensor2", "eth0", "", 100000)
+
+			w := call("/download/10.0.0.1")
+			require.Equal(g, http.StatusOK, w.Code, w.Body.String())
+			require.Greater(g, w.Body.Len(), 24)
+			assert.Equal(g, uint32(100000), binary.LittleEndian.Uint32(w.Body.Bytes()[16:20]))
+		})
+	})
+}
@@ -0,0 +1,443 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/stats"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// size of the beginning of the pcap downloads kept before sending it
+	_pcapBufferSize = 1 << 20
+
+	// maximum snap length of libpcap, used when snap_len is not set
+	_defaultSnapLen = 262144
+)
+
+var (
+	// protocols searched in the port index when none is given
+	_portProtocols = []layers.IPProtocol{
+		layers.IPProtocolTCP,
+		layers.IPProtocolUDP,
+		layers.IPProtocolSCTP,
+	}
+)
+
+// streamEncoder is used by requests writing their response directly to
+// the client, the Response field is only used for the documentation.
+type streamEncoder struct{}
+
+func (e *streamEncoder) EncodeResponse(ctx context.Context, w http.ResponseWriter, obj interface{}) {}
+
+// streamWriter remembers if something was sent to the client, once it is the
+// case errors can no longer be reported with a status code.
+type streamWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *streamWriter) Write(data []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(data)
+}
+
+// packetSelector is the address used to look up the packets in the index,
+// the other criteria are applied with the query filters.
+type packetSelector struct {
+	ip  net.IP
+	mac net.HardwareAddr
+}
+
+func (sel *packetSelector) filterSource(query *store.FindQuery) {
+	query.SrcIP, query.SrcMAC = sel.ip, sel.mac
+}
+
+func (sel *packetSelector) filterDestination(query *store.FindQuery) {
+	query.DstIP, query.DstMAC = sel.ip, sel.mac
+}
+
+// Downloader streams the packets matching a query as a pcap or pcapng file,
+// it is shared by the download endpoints.
+type Downloader struct {
+	Index   store.IndexInterface
+	Store   store.StoreInterface
+	Stats   *stats.Stats
+	SnapLen int32
+}
+
+// snapLen returns the length the stored packets were truncated to.
+func (d *Downloader) snapLen() int {
+	if d.SnapLen > 0 {
+		return int(d.SnapLen)
+	}
+
+	return _defaultSnapLen
+}
+
+// pcapSnapLen returns the snap length written in the pcap files, a pcap file
+// has a single one for all its packets so it is the largest of the agents
+// captures.
+func (d *Downloader) pcapSnapLen() int {
+	ret := int(d.SnapLen)
+	if n := int(d.Stats.MaxSnapLen()); n > ret {
+		ret = n
+	}
+
+	if ret == 0 {
+		return _defaultSnapLen
+	}
+
+	return ret
+}
+
+func (d *Downloader) download(ctx context.Context, w http.ResponseWriter, sel *packetSelector, query *store.FindQuery, opts *downloadOptions) (err error) {
+	span := trace.SpanFromContext(ctx)
+
+	if opts.filter != nil {
+		defer opts.filter.Close()
+	}
+
+	// the packets are filtered after being read so the limit can only be
+	// applied once they went through the filter
+	maxCount := query.MaxCount
+	if opts.filter != nil {
+		query.MaxCount = 0
+	}
+
+	it, err := d.scanPackets(ctx, sel, query)
+	if err != nil {
+		return
+	}
+
+	if opts.filter != nil {
+		it = opts.filter.Filter(it, maxCount)
+	}
+
+	out := &streamWriter{ResponseWriter: w}
+
+	defer func() {
+		closeErr := it.Close()
+		if err == nil {
+			err = closeErr
+		}
+
+		if (err != nil) && out.started {
+			// the response is incomplete, abort it so the client
+			// does not end up with a truncated file it believes valid
+			span.RecordError(err)
+			panic(http.ErrAbortHandler)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename=data.%s`, opts.format))
+
+	var count int
+
+	switch opts.format {
+	case "pcap":
+		count, err = d.writePcap(out, it)
+	case "pcapng":
+		count, err = d.writePcapng(out, it)
+	}
+
+	span.SetAttributes(
+		attribute.Int("response.packets_count", count),
+	)
+	auditPackets(ctx, count)
+
+	return
+}
+
+// scanPackets returns the packets matching the selector and the query, the
+// selector address can either be an IP address or a MAC address for non IP
+// traffic, without selector the packets are looked up by network or by port.
+func (d *Downloader) scanPackets(ctx context.Context, sel *packetSelector, query *store.FindQuery) (store.PacketIterator, error) {
+	var refs []store.PacketRef
+	var err error
+
+	// every store would return all the packets
+	if (sel == nil) && (len(query.Networks) == 0) && (query.Flow == nil) &&
+		(query.Port == 0) && (query.SrcPort == 0) && (query.DstPort == 0) {
+		return nil, badRequest("an address, a network or a port is required")
+	}
+
+	if directData, direct := d.Store.(store.DirectDataInterface); direct {
+		var it store.PacketIterator
+
+		switch {
+		case sel == nil:
+			it, err = directData.ScanMatchingPackets(ctx, query)
+		case sel.ip != nil:
+			it, err = directData.ScanPacketsByAddress(ctx, sel.ip, query)
+		default:
+			it, err = directData.ScanPacketsByMAC(ctx, sel.mac, query)
+		}
+
+		return it, errors.WithStack(err)
+	}
+
+	switch {
+	case (sel == nil) && (len(query.Networks) > 0):
+		refs, err = d.findPacketsByNetwork(ctx, query)
+	case sel == nil:
+		refs, err = d.findPacketsByPort(ctx, query)
+	case sel.ip != nil:
+		refs, err = d.findRefs(
+			func(index store.TimedIndexInterface) ([]store.PacketRef, error) {
+				return index.FindPacketRefsByAddress(ctx, sel.ip)
+			},
+			func() ([]string, error) { return d.Index.FindPacketsByAddress(ctx, sel.ip) },
+		)
+	default:
+		refs, err = d.findRefs(
+			func(index store.TimedIndexInterface) ([]store.PacketRef, error) {
+				return index.FindPacketRefsByMAC(ctx, sel.mac)
+			},
+			func() ([]string, error) { return d.Index.FindPacketsByMAC(ctx, sel.mac) },
+		)
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	it, err := d.Store.ScanPacketRefs(ctx, refs, query)
+	return it, errors.WithStack(err)
+}
+
+// findRefs uses the capture times of the packets when the index stores them
+// so the store can order the packets and skip the ones outside of the query
+// time range without loading them.
+func (d *Downloader) findRefs(timed func(store.TimedIndexInterface) ([]store.PacketRef, error), untimed func() ([]string, error)) ([]store.PacketRef, error) {
+	if index, ok := d.Index.(store.TimedIndexInterface); ok {
+		return timed(index)
+	}
+
+	ids, err := untimed()
+	return store.PacketRefs(ids), err
+}
+
+// findPacketsByNetwork merges the packets of all the query networks, the
+// store returns them deduplicated and in chronological order.
+func (d *Downloader) findPacketsByNetwork(ctx context.Context, query *store.FindQuery) ([]store.PacketRef, error) {
+	ret := []store.PacketRef{}
+
+	for _, network := range query.Networks {
+		refs, err := d.findRefs(
+			func(index store.TimedIndexInterface) ([]store.PacketRef, error) {
+				return index.FindPacketRefsByNetwork(ctx, network)
+			},
+			func() ([]string, error) { return d.Index.FindPacketsByNetwork(ctx, network) },
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, refs...)
+	}
+
+	return ret, nil
+}
+
+func (d *Downloader) findPacketsByPort(ctx context.Context, query *store.FindQuery) ([]store.PacketRef, error) {
+	var port uint16
+
+	switch {
+	case query.DstPort != 0:
+		port = query.DstPort
+	case query.SrcPort != 0:
+		port = query.SrcPort
+	case query.Port != 0:
+		port = query.Port
+	default:
+		return nil, badRequest("an address or a port is required")
+	}
+
+	protocols := _portProtocols
+	if query.Protocol != 0 {
+		protocols = []layers.IPProtocol{query.Protocol}
+	}
+
+	ret := []store.PacketRef{}
+
+	for _, proto := range protocols {
+		refs, err := d.findRefs(
+			func(index store.TimedIndexInterface) ([]store.PacketRef, error) {
+				return index.FindPacketRefsByPort(ctx, proto, port)
+			},
+			func() ([]string, error) { return d.Index.FindPacketsByPort(ctx, proto, port) },
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, refs...)
+	}
+
+	return ret, nil
+}
+
+// writePcap streams the packets as a pcap file, a pcap file can only hold one
+// link type so the download fails when the packets have several link types,
+// the pcapng format has no such limitation. The beginning of the file is
+// buffered so the mix is reported with a 400 when it is found early.
+func (d *Downloader) writePcap(out io.Writer, it store.PacketIterator) (count int, err error) {
+	buffered := bufio.NewWriterSize(out, _pcapBufferSize)
+	pcapWriter := pcapgo.NewWriter(buffered)
+
+	// the file header is written with the first packet
+	hasPacket := it.Next()
+
+	linkType := layers.LinkTypeEthernet
+	if hasPacket {
+		linkType = it.Packet().CaptureLinkType()
+	}
+
+	err = pcapWriter.WriteFileHeader(uint32(d.pcapSnapLen()), linkType)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	for ; hasPacket; hasPacket = it.Next() {
+		pkt := it.Packet()
+
+		if pkt.CaptureLinkType() != linkType {
+			err = badRequest("the packets have several link types (%s and %s), use format=pcapng", linkType, pkt.CaptureLinkType())
+			return
+		}
+
+		err = pcapWriter.WritePacket(captureInfo(pkt), pkt.Data)
+		if err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+
+		count++
+	}
+
+	err = it.Err()
+	if err != nil {
+		return
+	}
+
+	err = errors.WithStack(buffered.Flush())
+	return
+}
+
+// writePcapng streams the packets with one interface per agent and link type
+// so the capture point of each packet is preserved.
+func (d *Downloader) writePcapng(out io.Writer, it store.PacketIterator) (count int, err error) {
+	type interfaceKey struct {
+		agent    string
+		ifName   string
+		linkType layers.LinkType
+	}
+
+	pcapngWriter, err := newPcapngWriter(out)
+	if err != nil {
+		return
+	}
+
+	interfaces := map[interfaceKey]int{}
+
+	for it.Next() {
+		pkt := it.Packet()
+		key := interfaceKey{agent: pkt.Agent, ifName: pkt.Interface, linkType: pkt.CaptureLinkType()}
+
+		// interface blocks can be written anywhere before their first use
+		index, exists := interfaces[key]
+		if !exists {
+			index, err = pcapngWriter.AddInterface(d.captureInterface(pkt))
+			if err != nil {
+				return
+			}
+
+			interfaces[key] = index
+		}
+
+		ci := captureInfo(pkt)
+		ci.InterfaceIndex = index
+
+		err = pcapngWriter.WritePacket(ci, pkt.Data, pkt.Id)
+		if err != nil {
+			return
+		}
+
+		count++
+	}
+
+	err = it.Err()
+	if err != nil {
+		return
+	}
+
+	err = pcapngWriter.Flush()
+	return
+}
+
+// captureInterface describes where a packet was captured, the interface
+// recorded with the packet is used when known and the capture settings
+// come from its agent.
+func (d *Downloader) captureInterface(pkt *models.Packet) *pcapngInterface {
+	ret := &pcapngInterface{
+		Name:     pkt.Agent,
+		LinkType: pkt.CaptureLinkType(),
+		SnapLen:  uint32(d.SnapLen),
+	}
+
+	if pkt.Agent == "" {
+		ret.Name = "unknown"
+		return ret
+	}
+
+	ifName := pkt.Interface
+
+	// the settings describe the current captures of the agent
+	if src := d.Stats.Source(pkt.Agent); src != nil {
+		var c *stats.Capture
+		ifName, c = src.Capture(ifName)
+		if c != nil {
+			ret.Filter = c.Filter
+			if c.SnapLen > 0 {
+				ret.SnapLen = uint32(c.SnapLen)
+			}
+		}
+	}
+
+	if ifName != "" {
+		ret.Name = fmt.Sprintf("%s:%s", pkt.Agent, ifName)
+		ret.Description = fmt.Sprintf("interface %s on agent %s", ifName, pkt.Agent)
+	}
+
+	return ret
+}
+
+func captureInfo(pkt *models.Packet) gopacket.CaptureInfo {
+	ret := gopacket.CaptureInfo{
+		CaptureLength: len(pkt.Data),
+		Length:        int(pkt.DataLength),
+		Timestamp:     pkt.Timestamp,
+	}
+
+	// the original length is not known for all packets
+	if ret.Length < ret.CaptureLength {
+		ret.Length = ret.CaptureLength
+	}
+
+	return ret
+}
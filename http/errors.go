@@ -0,0 +1,43 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// requestError is returned for invalid requests, they are answered with a
+// 400 instead of a 500.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...any) error {
+	return errors.WithStack(&requestError{msg: fmt.Sprintf(format, args...)})
+}
+
+// writeError sends the error with the status matching it.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var re *requestError
+	if errors.As(err, &re) {
+		status = http.StatusBadRequest
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// errorEncoder answers the errors returned by the handlers, it replaces
+// response.ErrorEncoder which always answers with a 400.
+type errorEncoder struct{}
+
+func (e *errorEncoder) HandleError(ctx context.Context, w http.ResponseWriter, err error) {
+	writeError(w, err)
+}
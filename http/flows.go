@@ -0,0 +1,101 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/schmurfy/chipi/response"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// FlowSummary describes a conversation, its id can be used with
+// /flows/{id}/download.
+type FlowSummary struct {
+	Id string `json:"id"`
+	models.FlowRecord
+}
+
+type ListFlowsRequest struct {
+	errorEncoder
+
+	Path  struct{} `example:"/flows"`
+	Query struct {
+		Ip    *string `example:"10.0.0.1" description:"only return the conversations of this address"`
+		From  *string `example:"2025-11-09T11:00:00+01:00"`
+		To    *string `example:"2025-11-09T12:00:00+01:00"`
+		Count *int
+	}
+
+	response.JsonEncoder
+	Response []*FlowSummary
+
+	Store store.StoreInterface
+}
+
+func (r *ListFlowsRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
+	ctx, span := _tracer.Start(ctx, "ListFlowsRequest")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	query := &store.FlowQuery{}
+
+	if r.Query.Ip != nil {
+		query.IP = net.ParseIP(*r.Query.Ip)
+		if query.IP == nil {
+			return badRequest("invalid address: %q", *r.Query.Ip)
+		}
+	}
+
+	if r.Query.From != nil {
+		query.From, err = parseTime(*r.Query.From)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.To != nil {
+		query.To, err = parseTime(*r.Query.To)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.Count != nil {
+		if *r.Query.Count < 0 {
+			return badRequest("count must be positive")
+		}
+		query.MaxCount = *r.Query.Count
+	}
+
+	flowStore, ok := r.Store.(store.FlowInterface)
+	if !ok {
+		return errors.New("flows are not supported by this store")
+	}
+
+	flows, err := flowStore.FindFlows(ctx, query)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	span.SetAttributes(
+		attribute.Int("response.flows_count", len(flows)),
+	)
+
+	r.Response = make([]*FlowSummary, len(flows))
+	for i, fr := range flows {
+		r.Response[i] = &FlowSummary{
+			Id:         fr.ID(),
+			FlowRecord: *fr,
+		}
+	}
+
+	return nil
+}
@@ -1,8 +1,10 @@
 package http
 
 import (
+	"maps"
 	"net/http"
 	goHttp "net/http"
+	"slices"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/getkin/kin-openapi/openapi3"
@@ -10,6 +12,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/cors"
 	"github.com/schmurfy/chipi"
+	"github.com/schmurfy/chipi/builder"
+	"github.com/schmurfy/chipi/shared"
 	"go.opentelemetry.io/otel"
 
 	"github.com/schmurfy/sniffit/archivist"
@@ -22,7 +26,23 @@ var (
 	_tracer = otel.Tracer("http")
 )
 
-func Start(addr string, arc *archivist.Archivist, indexStore store.IndexInterface, dataStore store.StoreInterface, st *stats.Stats, cfg *config.ArchivistConfig) error {
+// Start serves the api, the downloads and queries are recorded in auditLog
+// unless it is nil.
+func Start(addr string, arc *archivist.Archivist, indexStore store.IndexInterface, dataStore store.StoreInterface, auditLog store.AuditInterface, st *stats.Stats, cfg *config.ArchivistConfig) error {
+	auth, err := NewAuthentication(&cfg.HTTPAuthConfig)
+	if err != nil {
+		return err
+	}
+
+	r, err := newRouter(auth, indexStore, dataStore, auditLog, st, cfg)
+	if err != nil {
+		return err
+	}
+
+	return goHttp.ListenAndServe(addr, r)
+}
+
+func newRouter(auth *Authentication, indexStore store.IndexInterface, dataStore store.StoreInterface, auditLog store.AuditInterface, st *stats.Stats, cfg *config.ArchivistConfig) (*chi.Mux, error) {
 	r := chi.NewRouter()
 
 	api, err := chipi.New(r, &openapi3.Info{
@@ -31,15 +51,28 @@ func Start(addr string, arc *archivist.Archivist, indexStore store.IndexInterfac
 	})
 
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
 	// api.AddServer(&openapi3.Server{
 	// 	URL: "http://127.0.0.1:2121",
 	// })
 
+	for name, scheme := range auth.SecuritySchemes() {
+		api.AddSecurityScheme(name, scheme)
+	}
+
+	// role required by each route
+	roles := map[string]string{}
+	get := func(router chi.Router, pattern string, role string, reqObject any) error {
+		roles[pattern] = role
+		return api.Get(router.With(auth.Require(role)), pattern, reqObject)
+	}
+
 	r.Use(cors.AllowAll().Handler)
-	r.Get("/doc.json", api.ServeSchema)
+	r.Get("/doc.json", func(w http.ResponseWriter, r *http.Request) {
+		serveSchema(w, r, api, auth, roles)
+	})
 	r.Get("/doc", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte(INDEX_DOC))
 		if err != nil {
@@ -55,23 +88,113 @@ func Start(addr string, arc *archivist.Archivist, indexStore store.IndexInterfac
 		metrics.WritePrometheus(w, true)
 	})
 
-	err = api.Get(r, "/stats", &GetStatsRequest{
+	// the middleware is applied before the authentication so the refused
+	// requests are recorded too
+	audited := r.With(auditRequests(auditLog))
+
+	err = get(r, "/stats", RoleViewer, &GetStatsRequest{
 		IndexStore: indexStore,
 		DataStore:  dataStore,
 		Stats:      st,
 	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	err = api.Get(r, "/download/{Address}", &DownloadRequest{
+	err = get(audited, "/keys", RoleViewer, &ListKeysRequest{
+		Index: indexStore,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	downloader := Downloader{
 		Index:   indexStore,
 		Store:   dataStore,
-		snaplen: cfg.SnapLen,
+		Stats:   st,
+		SnapLen: cfg.SnapLen,
+	}
+
+	err = get(audited.With(joinRepeatedParams("ip", "cidr")), "/download", RoleDownloader, &DownloadQueryRequest{
+		Downloader: downloader,
 	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	return goHttp.ListenAndServe(addr, r)
+	err = get(audited, "/download/{Address}", RoleDownloader, &DownloadRequest{
+		Downloader: downloader,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = get(audited, "/flows", RoleViewer, &ListFlowsRequest{
+		Store: dataStore,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = get(audited, "/flows/{Id}/download", RoleDownloader, &FlowDownloadRequest{
+		Downloader: downloader,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// without authentication the admin role could not be checked, the
+	// audit log is not served at all
+	if auth.Enabled() {
+		err = get(r, "/audit", RoleAdmin, &ListAuditRequest{
+			Log: auditLog,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return r, nil
+}
+
+// serveSchema serves the OpenAPI document with the role required by each
+// operation, listed as the scopes of the security schemes.
+func serveSchema(w http.ResponseWriter, r *http.Request, api *builder.Builder, auth *Authentication, roles map[string]string) {
+	swagger, err := api.GenerateSwagger(r.Context(), shared.NewChipiCallbacks(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	schemes := auth.SecuritySchemes()
+	if len(schemes) > 0 {
+		for pattern, item := range swagger.Paths.Map() {
+			role, exists := roles[pattern]
+			if !exists {
+				continue
+			}
+
+			// any of the schemes is accepted
+			security := openapi3.NewSecurityRequirements()
+			for _, name := range slices.Sorted(maps.Keys(schemes)) {
+				security.With(openapi3.NewSecurityRequirement().Authenticate(name, role))
+			}
+
+			for _, op := range item.Operations() {
+				op.Security = security
+			}
+		}
+	}
+
+	data, err := swagger.MarshalJSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
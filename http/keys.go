@@ -0,0 +1,194 @@
+package http
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schmurfy/chipi/response"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	_defaultKeysCount = 100
+)
+
+// KeySummary describes an indexed address, the counters are only returned
+// by the stores able to compute them.
+type KeySummary struct {
+	Address   string     `json:"address"`
+	Type      string     `json:"type"`
+	Packets   uint64     `json:"packets,omitempty"`
+	Bytes     uint64     `json:"bytes,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+type KeysPage struct {
+	// number of keys matching the query
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Keys   []*KeySummary `json:"keys"`
+}
+
+type ListKeysRequest struct {
+	errorEncoder
+
+	Path  struct{} `example:"/keys"`
+	Query struct {
+		From   *string `example:"2025-11-09T11:00:00+01:00" description:"only count the packets received after this time"`
+		To     *string `example:"2025-11-09T12:00:00+01:00" description:"only count the packets received before this time"`
+		Cidr   *string `example:"10.1.0.0/16" description:"only return the addresses of this network"`
+		Offset *int    `description:"number of keys to skip"`
+		Count  *int    `description:"maximum number of keys returned (default: 100)"`
+	}
+
+	response.JsonEncoder
+	Response *KeysPage
+
+	Index store.IndexInterface
+}
+
+func (r *ListKeysRequest) Handle(ctx context.Context, w http.ResponseWriter) (err error) {
+	ctx, span := _tracer.Start(ctx, "ListKeysRequest")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	query := &store.KeysQuery{}
+
+	if r.Query.From != nil {
+		query.From, err = parseTime(*r.Query.From)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.To != nil {
+		query.To, err = parseTime(*r.Query.To)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Query.Cidr != nil {
+		_, query.Network, err = net.ParseCIDR(*r.Query.Cidr)
+		if err != nil {
+			return badRequest("invalid network: %q", *r.Query.Cidr)
+		}
+	}
+
+	offset := 0
+	if r.Query.Offset != nil {
+		offset = *r.Query.Offset
+	}
+
+	count := _defaultKeysCount
+	if r.Query.Count != nil {
+		count = *r.Query.Count
+	}
+
+	if (offset < 0) || (count < 0) {
+		return badRequest("offset and count must be positive")
+	}
+
+	keys, err := r.keyStats(ctx, query)
+	if err != nil {
+		return
+	}
+
+	// linear when the store already sorted them
+	store.SortKeyStats(keys)
+
+	r.Response = &KeysPage{
+		Total:  len(keys),
+		Offset: offset,
+		Keys:   []*KeySummary{},
+	}
+
+	for i := offset; (i < len(keys)) && (i < offset+count); i++ {
+		r.Response.Keys = append(r.Response.Keys, newKeySummary(keys[i]))
+	}
+
+	span.SetAttributes(
+		attribute.Int("response.keys_total", len(keys)),
+	)
+
+	return nil
+}
+
+// keyStats returns the indexed addresses, only the addresses themselves are
+// known when the index cannot summarize them.
+func (r *ListKeysRequest) keyStats(ctx context.Context, query *store.KeysQuery) ([]*store.KeyStats, error) {
+	if keyStats, ok := r.Index.(store.KeyStatsInterface); ok {
+		ret, err := keyStats.KeyStats(ctx, query)
+		return ret, errors.WithStack(err)
+	}
+
+	if !query.From.IsZero() || !query.To.IsZero() {
+		return nil, errors.New("from and to are not supported by this store")
+	}
+
+	keys, err := r.Index.IndexKeys(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := make([]*store.KeyStats, 0, len(keys))
+
+	for _, k := range keys {
+		addr := parseIndexKey(k)
+		if (addr != nil) && query.MatchAddress(addr) {
+			ret = append(ret, &store.KeyStats{Address: addr})
+		}
+	}
+
+	return ret, nil
+}
+
+// parseIndexKey parses the keys returned by IndexKeys, they are either
+// hex encoded or readable IP addresses depending on the store.
+func parseIndexKey(k string) []byte {
+	if ip := net.ParseIP(k); ip != nil {
+		return ip.To16()
+	}
+
+	addr, err := hex.DecodeString(k)
+	if err != nil {
+		return nil
+	}
+
+	return addr
+}
+
+func newKeySummary(ks *store.KeyStats) *KeySummary {
+	ret := &KeySummary{
+		Packets: ks.Packets,
+		Bytes:   ks.Bytes,
+	}
+
+	if len(ks.Address) == net.IPv6len {
+		ret.Address = net.IP(ks.Address).String()
+		ret.Type = "ip"
+	} else {
+		ret.Address = net.HardwareAddr(ks.Address).String()
+		ret.Type = "mac"
+	}
+
+	if !ks.FirstSeen.IsZero() {
+		ret.FirstSeen = &ks.FirstSeen
+	}
+
+	if !ks.LastSeen.IsZero() {
+		ret.LastSeen = &ks.LastSeen
+	}
+
+	return ret
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+)
+
+// pcapng writer supporting per packet comments which pcapgo.NgWriter does not,
+// see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+
+const (
+	_pcapngSectionHeaderBlock    = 0x0A0D0D0A
+	_pcapngInterfaceBlock        = 0x00000001
+	_pcapngEnhancedPacketBlock   = 0x00000006
+	_pcapngByteOrderMagic        = 0x1A2B3C4D
+	_pcapngOptionEnd             = 0
+	_pcapngOptionComment         = 1
+	_pcapngOptionInterfaceName   = 2
+	_pcapngOptionInterfaceDesc   = 3
+	_pcapngOptionUserApplication = 4
+	_pcapngOptionInterfaceTsRes  = 9
+	_pcapngOptionInterfaceFilter = 11
+)
+
+type pcapngInterface struct {
+	Name        string
+	Description string
+	Filter      string
+	LinkType    layers.LinkType
+	SnapLen     uint32
+}
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+type pcapngWriter struct {
+	w          *bufio.Writer
+	interfaces int
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	ret := &pcapngWriter{
+		w: bufio.NewWriter(w),
+	}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], _pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1) // major version
+	binary.LittleEndian.PutUint16(body[6:8], 0) // minor version
+	// section length is unknown
+	binary.LittleEndian.PutUint64(body[8:16], 0xFFFFFFFFFFFFFFFF)
+
+	err := ret.writeBlock(_pcapngSectionHeaderBlock, body, []pcapngOption{
+		{code: _pcapngOptionUserApplication, value: []byte("sniffit")},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// AddInterface writes an interface description block and returns the
+// interface index to use when writing packets captured on it.
+func (pw *pcapngWriter) AddInterface(intf *pcapngInterface) (int, error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(intf.LinkType))
+	binary.LittleEndian.PutUint32(body[4:8], intf.SnapLen)
+
+	options := []pcapngOption{
+		// nanoseconds timestamps
+		{code: _pcapngOptionInterfaceTsRes, value: []byte{9}},
+	}
+
+	if intf.Name != "" {
+		options = append(options, pcapngOption{code: _pcapngOptionInterfaceName, value: []byte(intf.Name)})
+	}
+
+	if intf.Description != "" {
+		options = append(options, pcapngOption{code: _pcapngOptionInterfaceDesc, value: []byte(intf.Description)})
+	}
+
+	if intf.Filter != "" {
+		// the first byte is the filter type, 0 for a libpcap filter string
+		options = append(options, pcapngOption{code: _pcapngOptionInterfaceFilter, value: append([]byte{0}, intf.Filter...)})
+	}
+
+	err := pw.writeBlock(_pcapngInterfaceBlock, body, options)
+	if err != nil {
+		return 0, err
+	}
+
+	pw.interfaces++
+	return pw.interfaces - 1, nil
+}
+
+// WritePacket writes an enhanced packet block for the packet captured on
+// ci.InterfaceIndex, the comment is omitted if empty.
+func (pw *pcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if (ci.InterfaceIndex < 0) || (ci.InterfaceIndex >= pw.interfaces) {
+		return errors.Errorf("unknown interface %d", ci.InterfaceIndex)
+	}
+
+	ts := uint64(ci.Timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ci.InterfaceIndex))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(ci.Length))
+	body = append(body, pcapngPad(data)...)
+
+	var options []pcapngOption
+	if comment != "" {
+		options = append(options, pcapngOption{code: _pcapngOptionComment, value: []byte(comment)})
+	}
+
+	return pw.writeBlock(_pcapngEnhancedPacketBlock, body, options)
+}
+
+func (pw *pcapngWriter) Flush() error {
+	return errors.WithStack(pw.w.Flush())
+}
+
+func (pw *pcapngWriter) writeBlock(blockType uint32, body []byte, options []pcapngOption) error {
+	var opts []byte
+
+	if len(options) > 0 {
+		for _, opt := range options {
+			opts = binary.LittleEndian.AppendUint16(opts, opt.code)
+			opts = binary.LittleEndian.AppendUint16(opts, uint16(len(opt.value)))
+			opts = append(opts, pcapngPad(opt.value)...)
+		}
+
+		opts = binary.LittleEndian.AppendUint16(opts, _pcapngOptionEnd)
+		opts = binary.LittleEndian.AppendUint16(opts, 0)
+	}
+
+	// type + length + body + options + length
+	length := uint32(4 + 4 + len(body) + len(opts) + 4)
+
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = append(block, opts...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+
+	_, err := pw.w.Write(block)
+	return errors.WithStack(err)
+}
+
+// pcapngPad returns data padded to a 32 bits boundary
+func pcapngPad(data []byte) []byte {
+	padding := (4 - len(data)%4) % 4
+	if padding == 0 {
+		return data
+	}
+
+	ret := make([]byte, len(data), len(data)+padding)
+	copy(ret, data)
+	return append(ret, make([]byte, padding)...)
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapngWriter(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("pcapngWriter", func() {
+		var buff *bytes.Buffer
+		var w *pcapngWriter
+
+		g.BeforeEach(func() {
+			var err error
+
+			buff = &bytes.Buffer{}
+			w, err = newPcapngWriter(buff)
+			require.Nil(g, err)
+		})
+
+		g.It("should write packets on multiple interfaces", func() {
+			now := time.Now()
+
+			eth, err := w.AddInterface(&pcapngInterface{
+				Name:     "agent1:eth0",
+				Filter:   "port not 22",
+				LinkType: layers.LinkTypeEthernet,
+				SnapLen:  1500,
+			})
+			require.Nil(g, err)
+
+			raw, err := w.AddInterface(&pcapngInterface{
+				Name:     "agent2:wg0",
+				LinkType: layers.LinkTypeRaw,
+			})
+			require.Nil(g, err)
+
+			err = w.WritePacket(gopacket.CaptureInfo{
+				Timestamp:      now,
+				CaptureLength:  3,
+				Length:         10,
+				InterfaceIndex: eth,
+			}, []byte{1, 2, 3}, "packet1")
+			require.Nil(g, err)
+
+			err = w.WritePacket(gopacket.CaptureInfo{
+				Timestamp:      now.Add(time.Second),
+				CaptureLength:  4,
+				Length:         4,
+				InterfaceIndex: raw,
+			}, []byte{4, 5, 6, 7}, "")
+			require.Nil(g, err)
+
+			require.Nil(g, w.Flush())
+
+			r, err := pcapgo.NewNgReader(buff, pcapgo.NgReaderOptions{
+				WantMixedLinkType: true,
+			})
+			require.Nil(g, err)
+
+			data, ci, err := r.ReadPacketData()
+			require.Nil(g, err)
+			assert.Equal(g, []byte{1, 2, 3}, data)
+			assert.Equal(g, 10, ci.Length)
+			assert.Equal(g, eth, ci.InterfaceIndex)
+			assert.Equal(g, now.UnixNano(), ci.Timestamp.UnixNano())
+
+			data, ci, err = r.ReadPacketData()
+			require.Nil(g, err)
+			assert.Equal(g, []byte{4, 5, 6, 7}, data)
+			assert.Equal(g, raw, ci.InterfaceIndex)
+
+			require.Equal(g, 2, r.NInterfaces())
+
+			intf, err := r.Interface(eth)
+			require.Nil(g, err)
+			assert.Equal(g, "agent1:eth0", intf.Name)
+			assert.Equal(g, "port not 22", intf.Filter)
+			assert.Equal(g, layers.LinkTypeEthernet, intf.LinkType)
+			assert.Equal(g, uint32(1500), intf.SnapLength)
+
+			intf, err = r.Interface(raw)
+			require.Nil(g, err)
+			assert.Equal(g, "agent2:wg0", intf.Name)
+			assert.Equal(g, layers.LinkTypeRaw, intf.LinkType)
+		})
+
+		g.It("should reject packets for unknown interfaces", func() {
+			err := w.WritePacket(gopacket.CaptureInfo{
+				CaptureLength:  1,
+				Length:         1,
+				InterfaceIndex: 0,
+			}, []byte{1}, "")
+			assert.NotNil(g, err)
+		})
+	})
+}
@@ -18,7 +18,7 @@ type GetStatsRequest struct {
 	Query struct{}
 
 	response.JsonEncoder
-	Response stats.Stats
+	Response *stats.Stats
 
 	IndexStore store.IndexInterface
 	DataStore  store.DataInterface
@@ -44,7 +44,7 @@ func (r *GetStatsRequest) Handle(ctx context.Context, w http.ResponseWriter) err
 		return err
 	}
 
-	statsCopy := *r.Stats
+	statsCopy := r.Stats.Snapshot()
 
 	fmt.Printf("Index stats:\n")
 	indexStats, err := r.IndexStore.GetStats()
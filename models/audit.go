@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEntry records a request reading packets or their metadata on the
+// http api.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// name and authentication method of the principal, empty when the api
+	// is not authenticated or the credentials were refused
+	User   string `json:"user,omitempty"`
+	Method string `json:"method,omitempty"`
+	Remote string `json:"remote"`
+	// route pattern, path and raw query string of the request
+	Route    string        `json:"route"`
+	Path     string        `json:"path"`
+	Query    string        `json:"query,omitempty"`
+	Status   int           `json:"status"`
+	Packets  uint64        `json:"packets"`
+	Bytes    uint64        `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
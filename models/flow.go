@@ -0,0 +1,150 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+)
+
+// FlowEndpoint is one side of a conversation.
+type FlowEndpoint struct {
+	IP   net.IP `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+func (e FlowEndpoint) compare(other FlowEndpoint) int {
+	if ret := bytes.Compare(e.IP, other.IP); ret != 0 {
+		return ret
+	}
+
+	return int(e.Port) - int(other.Port)
+}
+
+// Flow is a bidirectional conversation identified by its five-tuple, the
+// endpoints are sorted so both directions share the same flow.
+type Flow struct {
+	Proto layers.IPProtocol `json:"proto"`
+	A     FlowEndpoint      `json:"a"`
+	B     FlowEndpoint      `json:"b"`
+}
+
+// NewFlow returns the flow between two endpoints, the order of the
+// endpoints does not matter.
+func NewFlow(proto layers.IPProtocol, src, dst FlowEndpoint) *Flow {
+	src.IP = NormalizeIP(src.IP)
+	dst.IP = NormalizeIP(dst.IP)
+
+	if src.compare(dst) > 0 {
+		src, dst = dst, src
+	}
+
+	return &Flow{
+		Proto: proto,
+		A:     src,
+		B:     dst,
+	}
+}
+
+// ParseFlowID parses an identifier returned by Flow.ID.
+func ParseFlowID(id string) (*Flow, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 5 {
+		return nil, errors.Errorf("invalid flow id: %q", id)
+	}
+
+	proto, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return nil, errors.Errorf("invalid flow id: %q", id)
+	}
+
+	endpoints := make([]FlowEndpoint, 2)
+	for i := range endpoints {
+		ip := net.ParseIP(parts[1+i*2])
+		if ip == nil {
+			return nil, errors.Errorf("invalid flow id: %q", id)
+		}
+
+		port, err := strconv.ParseUint(parts[2+i*2], 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("invalid flow id: %q", id)
+		}
+
+		endpoints[i] = FlowEndpoint{IP: ip, Port: uint16(port)}
+	}
+
+	return NewFlow(layers.IPProtocol(proto), endpoints[0], endpoints[1]), nil
+}
+
+// ID returns a readable identifier usable in urls, ex: 6-10.0.0.1-51000-10.0.0.2-443
+func (f *Flow) ID() string {
+	return fmt.Sprintf("%d-%s-%d-%s-%d", uint8(f.Proto), f.A.IP, f.A.Port, f.B.IP, f.B.Port)
+}
+
+func (f *Flow) Equal(other *Flow) bool {
+	return (other != nil) && (f.Proto == other.Proto) &&
+		(f.A.compare(other.A) == 0) && (f.B.compare(other.B) == 0)
+}
+
+// Flow returns the flow the packet belongs to, nil for non IP packets,
+// Decode must have been called before.
+func (pp *Packet) Flow() *Flow {
+	if !pp.HasIP() {
+		return nil
+	}
+
+	return NewFlow(pp.IPProto,
+		FlowEndpoint{IP: pp.SrcIP, Port: pp.SrcPort},
+		FlowEndpoint{IP: pp.DstIP, Port: pp.DstPort},
+	)
+}
+
+// FlowRecord summarizes a conversation seen by an agent, a new record is
+// started when a conversation resumes after being idle.
+type FlowRecord struct {
+	Flow
+	Agent     string    `json:"agent"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	// union of the TCP flags seen in both directions
+	TCPFlags uint8 `json:"tcp_flags"`
+}
+
+// NewFlowRecord starts a record with the given packet, Decode must have been
+// called before.
+func NewFlowRecord(pkt *Packet) *FlowRecord {
+	return &FlowRecord{
+		Flow:      *pkt.Flow(),
+		Agent:     pkt.Agent,
+		FirstSeen: pkt.Timestamp,
+		LastSeen:  pkt.Timestamp,
+		Packets:   1,
+		Bytes:     uint64(pkt.Length()),
+		TCPFlags:  pkt.TCPFlags,
+	}
+}
+
+// RecordID identifies the record in the stores.
+func (fr *FlowRecord) RecordID() string {
+	return fmt.Sprintf("%s@%s@%d", fr.ID(), fr.Agent, fr.FirstSeen.UnixNano())
+}
+
+// Add updates the record with a packet of the same flow, Decode must have
+// been called before.
+// FirstSeen is part of the record id so it is never updated.
+func (fr *FlowRecord) Add(pkt *Packet) {
+	if pkt.Timestamp.After(fr.LastSeen) {
+		fr.LastSeen = pkt.Timestamp
+	}
+
+	fr.Packets++
+	fr.Bytes += uint64(pkt.Length())
+	fr.TCPFlags |= pkt.TCPFlags
+}
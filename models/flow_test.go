@@ -0,0 +1,54 @@
+package models
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/franela/goblin"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlow(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Flow", func() {
+		client := FlowEndpoint{IP: net.ParseIP("10.0.0.2"), Port: 51000}
+		server := FlowEndpoint{IP: net.ParseIP("10.0.0.1"), Port: 443}
+
+		g.It("should be the same in both directions", func() {
+			f1 := NewFlow(layers.IPProtocolTCP, client, server)
+			f2 := NewFlow(layers.IPProtocolTCP, server, client)
+
+			assert.True(g, f1.Equal(f2))
+			assert.Equal(g, f1.ID(), f2.ID())
+			assert.Equal(g, "6-10.0.0.1-443-10.0.0.2-51000", f1.ID())
+		})
+
+		g.It("should differ by protocol", func() {
+			f1 := NewFlow(layers.IPProtocolTCP, client, server)
+			f2 := NewFlow(layers.IPProtocolUDP, client, server)
+
+			assert.False(g, f1.Equal(f2))
+		})
+
+		g.It("should parse its id", func() {
+			f := NewFlow(layers.IPProtocolUDP,
+				FlowEndpoint{IP: net.ParseIP("2001:db8::1"), Port: 53},
+				FlowEndpoint{IP: net.ParseIP("2001:db8::2"), Port: 5353},
+			)
+
+			parsed, err := ParseFlowID(f.ID())
+			require.Nil(g, err)
+			assert.True(g, f.Equal(parsed))
+		})
+
+		g.It("should reject invalid ids", func() {
+			for _, id := range []string{"", "6-10.0.0.1-443", "tcp-10.0.0.1-443-10.0.0.2-1", "6-10.0.0.1-443-nope-1", "6-10.0.0.1-70000-10.0.0.2-1"} {
+				_, err := ParseFlowID(id)
+				assert.NotNil(g, err, id)
+			}
+		})
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"net"
 	"time"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 	pb "github.com/schmurfy/sniffit/generated_pb/proto"
 )
@@ -16,8 +18,27 @@ type Packet struct {
 	Timestamp     time.Time
 	CaptureLength uint16
 	DataLength    uint16
-	SrcIP         net.IP
-	DstIP         net.IP
+	// the zero value (LinkTypeNull) is used by packets recorded before link
+	// types were tracked, those are ethernet frames
+	LinkType layers.LinkType
+	// name of the agent which captured the packet and of its capture
+	// interface, empty for packets stored before they were recorded
+	Agent     string
+	Interface string
+	// id of the first copy when the packet was also captured by another
+	// agent
+	DuplicateOf string
+	SrcIP       net.IP
+	DstIP       net.IP
+	SrcMAC      net.HardwareAddr
+	DstMAC      net.HardwareAddr
+	EtherType   uint16
+	// transport layer, the ports are only set for TCP, UDP and SCTP
+	IPProto layers.IPProtocol
+	SrcPort uint16
+	DstPort uint16
+	// FIN, SYN, RST, PSH, ACK, URG, ECE and CWR from the lowest bit
+	TCPFlags uint8
 }
 
 func NewPacketFromProto(pkt *pb.Packet) *Packet {
@@ -26,10 +47,199 @@ func NewPacketFromProto(pkt *pb.Packet) *Packet {
 		Data:          pkt.Data,
 		CaptureLength: uint16(pkt.CaptureLength),
 		DataLength:    uint16(pkt.DataLength),
+		LinkType:      layers.LinkType(pkt.LinkType),
+		Interface:     pkt.Interface,
 		Timestamp:     time.Unix(pkt.Timestamp, pkt.TimestampNano),
 	}
 }
 
+// NormalizeIP returns the 16 bytes form of an address, IPv4 addresses are
+// returned as v4-mapped IPv6 addresses so both families share the same
+// representation in the stores.
+func NormalizeIP(ip net.IP) net.IP {
+	return ip.To16()
+}
+
+// NormalizeNetwork returns the 16 bytes form of a network, the mask of IPv4
+// networks is extended to cover the v4-mapped prefix.
+func NormalizeNetwork(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if bits == net.IPv4len*8 {
+		ones += (net.IPv6len - net.IPv4len) * 8
+	}
+
+	return &net.IPNet{
+		IP:   NormalizeIP(n.IP).Mask(net.CIDRMask(ones, net.IPv6len*8)),
+		Mask: net.CIDRMask(ones, net.IPv6len*8),
+	}
+}
+
+// NetworkRange returns the first and last addresses of a network in their
+// 16 bytes form.
+func NetworkRange(n *net.IPNet) (first net.IP, last net.IP) {
+	n = NormalizeNetwork(n)
+
+	first = n.IP
+	last = make(net.IP, net.IPv6len)
+	for i := range last {
+		last[i] = first[i] | ^n.Mask[i]
+	}
+
+	return
+}
+
+// Decode extracts the link and network layer addresses and the transport
+// protocol and ports from the packet data using its link type, SrcIP and
+// DstIP are left empty for non IP frames (ARP, LLDP, STP, ...) and SrcMAC or
+// DstMAC can be empty when the link layer does not carry them (raw IP,
+// loopback, linux cooked capture).
+func (pp *Packet) Decode() {
+	packet := gopacket.NewPacket(pp.Data, pp.CaptureLinkType(), gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+
+	pp.SrcIP, pp.DstIP = nil, nil
+	pp.SrcMAC, pp.DstMAC = nil, nil
+	pp.EtherType = 0
+	pp.IPProto = 0
+	pp.SrcPort, pp.DstPort = 0, 0
+	pp.TCPFlags = 0
+
+	switch link := packet.LinkLayer().(type) {
+	case *layers.Ethernet:
+		pp.SrcMAC = link.SrcMAC
+		pp.DstMAC = link.DstMAC
+		pp.EtherType = uint16(link.EthernetType)
+
+	case *layers.LinuxSLL:
+		if link.AddrLen == 6 {
+			pp.SrcMAC = link.Addr
+		}
+		pp.EtherType = uint16(link.EthernetType)
+
+	}
+
+	// 802.11 frames are not exposed as a link layer by gopacket
+	if dot11, ok := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11); ok {
+		pp.SrcMAC = dot11.Address2
+		pp.DstMAC = dot11.Address1
+	}
+
+	switch ipLayer := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		pp.SrcIP = NormalizeIP(ipLayer.SrcIP)
+		pp.DstIP = NormalizeIP(ipLayer.DstIP)
+		if pp.EtherType == 0 {
+			pp.EtherType = uint16(layers.EthernetTypeIPv4)
+		}
+		pp.IPProto = ipLayer.Protocol
+	case *layers.IPv6:
+		pp.SrcIP = NormalizeIP(ipLayer.SrcIP)
+		pp.DstIP = NormalizeIP(ipLayer.DstIP)
+		if pp.EtherType == 0 {
+			pp.EtherType = uint16(layers.EthernetTypeIPv6)
+		}
+		// can be an extension header, replaced below when the transport
+		// layer is known
+		pp.IPProto = ipLayer.NextHeader
+	}
+
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		pp.IPProto = layers.IPProtocolTCP
+		pp.SrcPort = uint16(transport.SrcPort)
+		pp.DstPort = uint16(transport.DstPort)
+		pp.TCPFlags = tcpFlags(transport)
+	case *layers.UDP:
+		pp.IPProto = layers.IPProtocolUDP
+		pp.SrcPort = uint16(transport.SrcPort)
+		pp.DstPort = uint16(transport.DstPort)
+	case *layers.SCTP:
+		pp.IPProto = layers.IPProtocolSCTP
+		pp.SrcPort = uint16(transport.SrcPort)
+		pp.DstPort = uint16(transport.DstPort)
+	default:
+		if packet.Layer(layers.LayerTypeICMPv6) != nil {
+			pp.IPProto = layers.IPProtocolICMPv6
+		}
+	}
+}
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var ret uint8
+
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			ret |= 1 << i
+		}
+	}
+
+	return ret
+}
+
+// Length returns the original length of the packet, the captured data can
+// be shorter.
+func (pp *Packet) Length() int {
+	if int(pp.DataLength) > len(pp.Data) {
+		return int(pp.DataLength)
+	}
+
+	return len(pp.Data)
+}
+
+// CaptureLinkType returns the link type of the packet data.
+func (pp *Packet) CaptureLinkType() layers.LinkType {
+	if pp.LinkType == layers.LinkTypeNull {
+		return layers.LinkTypeEthernet
+	}
+
+	return pp.LinkType
+}
+
+// HasIP returns true if the packet has been decoded and has an IP layer.
+func (pp *Packet) HasIP() bool {
+	return (pp.SrcIP != nil) && (pp.DstIP != nil)
+}
+
+// HasMAC returns true if the packet has been decoded and has at least one
+// MAC address.
+func (pp *Packet) HasMAC() bool {
+	return (pp.SrcMAC != nil) || (pp.DstMAC != nil)
+}
+
+// IndexedAddresses returns the addresses used to index the packet, the IP
+// addresses for IP packets and the MAC addresses for other frames, Decode
+// must have been called before.
+func (pp *Packet) IndexedAddresses() [][]byte {
+	if pp.HasIP() {
+		return [][]byte{pp.SrcIP, pp.DstIP}
+	}
+
+	ret := make([][]byte, 0, 2)
+	for _, mac := range []net.HardwareAddr{pp.SrcMAC, pp.DstMAC} {
+		if mac != nil {
+			ret = append(ret, mac)
+		}
+	}
+
+	return ret
+}
+
+// IndexedPorts returns the distinct ports used by the packet, nil if its
+// transport protocol has no ports, Decode must have been called before.
+func (pp *Packet) IndexedPorts() []uint16 {
+	if (pp.SrcPort == 0) && (pp.DstPort == 0) {
+		return nil
+	}
+
+	if pp.SrcPort == pp.DstPort {
+		return []uint16{pp.SrcPort}
+	}
+
+	return []uint16{pp.SrcPort, pp.DstPort}
+}
+
 func UnserializePacket(data []byte) (*Packet, error) {
 	var ret Packet
 
@@ -5,37 +5,198 @@ import (
 	"time"
 )
 
+// Capture holds the settings of an interface captured by an agent.
+type Capture struct {
+	Filter  string `json:"filter,omitempty"`
+	SnapLen int32  `json:"snap_len,omitempty"`
+}
+
 type Source struct {
 	LastPacket time.Time `json:"last_packet"`
 	Packets    int       `json:"packets"`
 
+	// capture settings reported by the agent for each interface
+	Captures map[string]*Capture `json:"captures,omitempty"`
+
 	updateMutex sync.Mutex
 }
 
+// Capture returns the settings of an interface, an empty name returns the
+// only interface of the agents capturing one, nil if not known.
+func (src *Source) Capture(ifName string) (string, *Capture) {
+	src.updateMutex.Lock()
+	defer src.updateMutex.Unlock()
+
+	if (ifName == "") && (len(src.Captures) == 1) {
+		for name, c := range src.Captures {
+			ret := *c
+			return name, &ret
+		}
+	}
+
+	c, exists := src.Captures[ifName]
+	if !exists {
+		return ifName, nil
+	}
+
+	ret := *c
+	return ifName, &ret
+}
+
+// Rejection records the attempts of an agent without a valid token, the
+// packets of quarantined agents are acknowledged but not stored.
+type Rejection struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	Attempts    int       `json:"attempts"`
+	Reason      string    `json:"reason"`
+	Quarantined bool      `json:"quarantined"`
+	Packets     int       `json:"packets"`
+	Address     string    `json:"address,omitempty"`
+}
+
 type Stats struct {
-	Sources    map[string]*Source `json:"sources"`
-	Keys       int                `json:"keys"`
-	IndexStats map[string]string  `json:"index_stats"`
-	DataStats  map[string]string  `json:"data_stats"`
+	Sources    map[string]*Source    `json:"sources"`
+	Rejections map[string]*Rejection `json:"rejections"`
+	Keys       int                   `json:"keys"`
+	IndexStats map[string]string     `json:"index_stats"`
+	DataStats  map[string]string     `json:"data_stats"`
 
 	insertMutex sync.Mutex
 }
 
 func NewStats() *Stats {
 	return &Stats{
-		Sources: map[string]*Source{},
+		Sources:    map[string]*Source{},
+		Rejections: map[string]*Rejection{},
 	}
 }
 
-func (st *Stats) RegisterPacket(agent string, t time.Time, count int) {
+// Snapshot returns a copy of the stats safe to read while the agents keep
+// sending packets.
+func (st *Stats) Snapshot() *Stats {
+	st.insertMutex.Lock()
+	defer st.insertMutex.Unlock()
+
+	ret := &Stats{
+		Sources:    make(map[string]*Source, len(st.Sources)),
+		Rejections: make(map[string]*Rejection, len(st.Rejections)),
+		Keys:       st.Keys,
+		IndexStats: st.IndexStats,
+		DataStats:  st.DataStats,
+	}
+
+	for agent, src := range st.Sources {
+		src.updateMutex.Lock()
+		copied := &Source{
+			LastPacket: src.LastPacket,
+			Packets:    src.Packets,
+		}
+		if src.Captures != nil {
+			copied.Captures = make(map[string]*Capture, len(src.Captures))
+			for ifName, c := range src.Captures {
+				captured := *c
+				copied.Captures[ifName] = &captured
+			}
+		}
+		ret.Sources[agent] = copied
+		src.updateMutex.Unlock()
+	}
+
+	for agent, rejection := range st.Rejections {
+		r := *rejection
+		ret.Rejections[agent] = &r
+	}
+
+	return ret
+}
+
+// getOrCreateRejection must be called with the lock held.
+func (st *Stats) getOrCreateRejection(agent string) *Rejection {
+	rejection, exists := st.Rejections[agent]
+	if !exists {
+		rejection = &Rejection{}
+		st.Rejections[agent] = rejection
+	}
+
+	return rejection
+}
+
+// RegisterRejection records an attempt from an agent without a valid token.
+func (st *Stats) RegisterRejection(agent string, address string, reason string, quarantined bool) {
+	st.insertMutex.Lock()
+	defer st.insertMutex.Unlock()
+
+	rejection := st.getOrCreateRejection(agent)
+	rejection.LastAttempt = time.Now()
+	rejection.Attempts++
+	rejection.Reason = reason
+	rejection.Quarantined = quarantined
+	rejection.Address = address
+}
+
+// RegisterQuarantinedPackets records the packets discarded from a
+// quarantined agent.
+func (st *Stats) RegisterQuarantinedPackets(agent string, count int) {
+	st.insertMutex.Lock()
+	defer st.insertMutex.Unlock()
+
+	st.getOrCreateRejection(agent).Packets += count
+}
+
+func (st *Stats) getOrCreateSource(agent string) *Source {
+	st.insertMutex.Lock()
+	defer st.insertMutex.Unlock()
+
 	src, exists := st.Sources[agent]
 	if !exists {
 		src = &Source{}
-		st.insertMutex.Lock()
 		st.Sources[agent] = src
-		st.insertMutex.Unlock()
 	}
 
+	return src
+}
+
+// Source returns the stats of an agent or nil if nothing was received from
+// it yet.
+func (st *Stats) Source(agent string) *Source {
+	st.insertMutex.Lock()
+	defer st.insertMutex.Unlock()
+
+	return st.Sources[agent]
+}
+
+// RegisterCapture records the settings of an interface captured by the
+// agent, the interfaces it no longer captures are kept.
+func (st *Stats) RegisterCapture(agent string, ifName string, filter string, snapLen int32) {
+	src := st.getOrCreateSource(agent)
+
+	src.updateMutex.Lock()
+	if src.Captures == nil {
+		src.Captures = map[string]*Capture{}
+	}
+	src.Captures[ifName] = &Capture{Filter: filter, SnapLen: snapLen}
+	src.updateMutex.Unlock()
+}
+
+// MaxSnapLen returns the largest snap length reported by the agents, 0 if
+// none reported one.
+func (st *Stats) MaxSnapLen() int32 {
+	var ret int32
+
+	for _, src := range st.Snapshot().Sources {
+		for _, c := range src.Captures {
+			if c.SnapLen > ret {
+				ret = c.SnapLen
+			}
+		}
+	}
+
+	return ret
+}
+
+func (st *Stats) RegisterPacket(agent string, t time.Time, count int) {
+	src := st.getOrCreateSource(agent)
+
 	src.updateMutex.Lock()
 	src.LastPacket = t
 	src.Packets += count
@@ -67,34 +67,38 @@ func (n *BadgerStore) GetPackets(ctx context.Context, ids []string, q *store.Fin
 		span.End()
 	}()
 
-	pkts = make([]*models.Packet, 0, len(ids))
-
-	err = n.db.View(func(tx *badger.Txn) error {
-		var err error
-		var item *badger.Item
+	it, err := n.ScanPackets(ctx, ids, q)
+	if err != nil {
+		return
+	}
 
-		for _, id := range ids {
-			item, err = tx.Get([]byte(id))
-			if err != nil {
-				if err == badger.ErrKeyNotFound {
-					continue
-				}
+	pkts, err = store.CollectPackets(it)
+	return
+}
 
-				return err
-			}
+func (n *BadgerStore) ScanPackets(ctx context.Context, ids []string, q *store.FindQuery) (store.PacketIterator, error) {
+	return store.NewIdsIterator(ids, q, n.getPacket), nil
+}
 
-			err = item.Value(func(data []byte) error {
-				pp, err := models.UnserializePacket(data)
-				if err != nil {
-					return errors.WithStack(err)
-				}
+func (n *BadgerStore) ScanPacketRefs(ctx context.Context, refs []store.PacketRef, q *store.FindQuery) (store.PacketIterator, error) {
+	return store.NewRefsIterator(refs, q, n.getPacket), nil
+}
 
-				pkts = append(pkts, pp)
+func (n *BadgerStore) getPacket(id string) (pkt *models.Packet, err error) {
+	err = n.db.View(func(tx *badger.Txn) error {
+		item, err := tx.Get([]byte(id))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
 				return nil
-			})
+			}
+
+			return errors.WithStack(err)
 		}
 
-		return nil
+		return item.Value(func(data []byte) error {
+			pkt, err = models.UnserializePacket(data)
+			return errors.WithStack(err)
+		})
 	})
 
 	return
@@ -113,6 +117,10 @@ func (n *BadgerStore) DataKeys(ctx context.Context) (ret []string, err error) {
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 			k := item.Key()
+			if isFlowKey(k) || isMetaKey(k) {
+				continue
+			}
+
 			err := item.Value(func(v []byte) error {
 				ret = append(ret, string(k))
 				return nil
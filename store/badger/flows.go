@@ -0,0 +1,188 @@
+package badger_store
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// flow records are stored as json under flow:<record id> and indexed by
+// endpoint with empty flowip:<hex ip>-<record id> keys.
+const (
+	_flowKeyPrefix   = "flow:"
+	_flowIPKeyPrefix = "flowip:"
+)
+
+func isFlowKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(_flowKeyPrefix)) || bytes.HasPrefix(k, []byte(_flowIPKeyPrefix))
+}
+
+func (n *BadgerStore) buildFlowIPPrefix(ip []byte) []byte {
+	return []byte(fmt.Sprintf("%s%s-", _flowIPKeyPrefix, hex.EncodeToString(ip)))
+}
+
+func (n *BadgerStore) StoreFlows(ctx context.Context, flows []*models.FlowRecord) (err error) {
+	ctx, span := _tracer.Start(ctx, "StoreFlows",
+		trace.WithAttributes(
+			attribute.Int("request.flows_count", len(flows)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	for _, fr := range flows {
+		// the record is read in the transaction, a concurrent update
+		// makes the commit fail and the record is compared again
+		for {
+			err = n.db.Update(func(tx *badger.Txn) error {
+				return n.storeFlow(tx, fr)
+			})
+			if err != badger.ErrConflict {
+				break
+			}
+		}
+
+		if err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+	}
+
+	return
+}
+
+// storeFlow writes the record unless the stored one already counts as many
+// packets, records are sent again as they grow so an older snapshot must not
+// replace a newer one.
+func (n *BadgerStore) storeFlow(tx *badger.Txn, fr *models.FlowRecord) error {
+	recordID := fr.RecordID()
+	key := []byte(_flowKeyPrefix + recordID)
+
+	item, err := tx.Get(key)
+	switch {
+	case err == nil:
+		var stored models.FlowRecord
+
+		err = item.Value(func(data []byte) error {
+			return json.Unmarshal(data, &stored)
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if stored.Packets >= fr.Packets {
+			return nil
+		}
+
+	case err != badger.ErrKeyNotFound:
+		return errors.WithStack(err)
+	}
+
+	data, err := json.Marshal(fr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	expiresAt := uint64(fr.LastSeen.Add(n.ttl).Unix())
+
+	entries := []*badger.Entry{
+		badger.NewEntry(key, data),
+		badger.NewEntry(append(n.buildFlowIPPrefix(fr.A.IP), recordID...), []byte{}),
+		badger.NewEntry(append(n.buildFlowIPPrefix(fr.B.IP), recordID...), []byte{}),
+	}
+
+	for _, entry := range entries {
+		entry.ExpiresAt = expiresAt
+		err = tx.SetEntry(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (n *BadgerStore) FindFlows(ctx context.Context, q *store.FlowQuery) (ret []*models.FlowRecord, err error) {
+	ctx, span := _tracer.Start(ctx, "FindFlows")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret = []*models.FlowRecord{}
+
+	err = n.db.View(func(tx *badger.Txn) error {
+		// without ip all the records are read
+		prefix := []byte(_flowKeyPrefix)
+		if (q != nil) && (q.IP != nil) {
+			prefix = n.buildFlowIPPrefix(models.NormalizeIP(q.IP))
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = (q == nil) || (q.IP == nil)
+
+		it := tx.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+
+			if !opts.PrefetchValues {
+				recordID := item.Key()[len(prefix):]
+
+				var err error
+				item, err = tx.Get(append([]byte(_flowKeyPrefix), recordID...))
+				if err != nil {
+					if err == badger.ErrKeyNotFound {
+						continue
+					}
+
+					return errors.WithStack(err)
+				}
+			}
+
+			var fr models.FlowRecord
+
+			err := item.Value(func(data []byte) error {
+				return json.Unmarshal(data, &fr)
+			})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if q.Match(&fr) {
+				ret = append(ret, &fr)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].FirstSeen.Before(ret[j].FirstSeen)
+	})
+
+	if (q != nil) && (q.MaxCount > 0) && (len(ret) > q.MaxCount) {
+		ret = ret[:q.MaxCount]
+	}
+
+	return
+}
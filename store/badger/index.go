@@ -9,10 +9,10 @@ import (
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -22,6 +22,10 @@ var (
 	_tracer = otel.Tracer("badger_store")
 )
 
+const (
+	_portKeyPrefix = "p"
+)
+
 // copy in shared
 type key struct {
 	name      string
@@ -29,8 +33,22 @@ type key struct {
 	timestamp time.Time
 }
 
-func (n *BadgerStore) buildKey(addr net.IP, packetId string) []byte {
-	ret := fmt.Sprintf("%s-%s", hex.EncodeToString(addr), packetId)
+// IP addresses are always stored in their 16 bytes form so IPv4 and IPv6
+// keys share the same layout, MAC addresses (6 bytes) are used for non IP
+// frames.
+func (n *BadgerStore) buildPrefix(addr []byte) []byte {
+	ret := fmt.Sprintf("%s-", hex.EncodeToString(addr))
+	return []byte(ret)
+}
+
+func (n *BadgerStore) buildKey(addr []byte, packetId string) []byte {
+	return append(n.buildPrefix(addr), packetId...)
+}
+
+// ports are indexed with their transport protocol, the "p" prefix cannot be
+// confused with an hex encoded address.
+func (n *BadgerStore) buildPortPrefix(proto layers.IPProtocol, port uint16) []byte {
+	ret := fmt.Sprintf("%s%02x%04x-", _portKeyPrefix, uint8(proto), port)
 	return []byte(ret)
 }
 
@@ -50,13 +68,22 @@ func (n *BadgerStore) IndexPackets(ctx context.Context, pkts []*models.Packet) (
 	defer wb.Cancel()
 
 	for _, pkt := range pkts {
-		packet := gopacket.NewPacket(pkt.Data, layers.LayerTypeEthernet, gopacket.Default)
-		ipLayer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		pkt.Decode()
 
-		for _, addr := range []net.IP{ipLayer.SrcIP, ipLayer.DstIP} {
-			// addr := []byte(pkt.)
+		for _, addr := range pkt.IndexedAddresses() {
 			key := n.buildKey(addr, pkt.Id)
-			entry := badger.NewEntry(key, []byte{})
+			entry := badger.NewEntry(key, encodeIndexValue(pkt))
+			entry.ExpiresAt = uint64(pkt.Timestamp.Add(n.ttl).Unix())
+
+			err = errors.WithStack(wb.SetEntry(entry))
+			if err != nil {
+				return
+			}
+		}
+
+		for _, port := range pkt.IndexedPorts() {
+			key := append(n.buildPortPrefix(pkt.IPProto, port), pkt.Id...)
+			entry := badger.NewEntry(key, encodeIndexValue(pkt))
 			entry.ExpiresAt = uint64(pkt.Timestamp.Add(n.ttl).Unix())
 
 			err = errors.WithStack(wb.SetEntry(entry))
@@ -93,7 +120,7 @@ func (n *BadgerStore) IndexKeys(ctx context.Context) (ret []string, err error) {
 			item := it.Item()
 			k := item.Key()
 			parts := strings.Split(string(k), "-")
-			if len(parts) >= 2 {
+			if (len(parts) >= 2) && !strings.HasPrefix(parts[0], _portKeyPrefix) && !isFlowKey(k) && !isMetaKey(k) {
 				mret[parts[0]] = nil
 			}
 
@@ -104,8 +131,9 @@ func (n *BadgerStore) IndexKeys(ctx context.Context) (ret []string, err error) {
 		return nil
 	})
 
-	n.lastIndexKeysScan = time.Now()
-	n.cachedIndexKeys = ret
+	if err != nil {
+		return
+	}
 
 	ret = make([]string, 0, len(mret))
 
@@ -113,11 +141,60 @@ func (n *BadgerStore) IndexKeys(ctx context.Context) (ret []string, err error) {
 		ret = append(ret, k)
 	}
 
+	n.lastIndexKeysScan = time.Now()
+	n.cachedIndexKeys = ret
+
+	return
+}
+
+func (n *BadgerStore) FindPacketsByAddress(ctx context.Context, ip net.IP) ([]string, error) {
+	refs, err := n.FindPacketRefsByAddress(ctx, ip)
+	return packetIds(refs), err
+}
+
+func (n *BadgerStore) FindPacketsByMAC(ctx context.Context, mac net.HardwareAddr) ([]string, error) {
+	refs, err := n.FindPacketRefsByMAC(ctx, mac)
+	return packetIds(refs), err
+}
+
+func (n *BadgerStore) FindPacketsByNetwork(ctx context.Context, network *net.IPNet) ([]string, error) {
+	refs, err := n.FindPacketRefsByNetwork(ctx, network)
+	return packetIds(refs), err
+}
+
+func (n *BadgerStore) FindPacketsByPort(ctx context.Context, proto layers.IPProtocol, port uint16) ([]string, error) {
+	refs, err := n.FindPacketRefsByPort(ctx, proto, port)
+	return packetIds(refs), err
+}
+
+func packetIds(refs []store.PacketRef) []string {
+	if refs == nil {
+		return nil
+	}
+
+	ret := make([]string, len(refs))
+	for i, ref := range refs {
+		ret[i] = ref.Id
+	}
+
+	return ret
+}
+
+func (n *BadgerStore) FindPacketRefsByAddress(ctx context.Context, ip net.IP) (ret []store.PacketRef, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketRefsByAddress")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = n.findByPrefix(n.buildPrefix(models.NormalizeIP(ip)))
 	return
 }
 
-func (n *BadgerStore) FindPacketsByAddress(ctx context.Context, ip net.IP) (ret []string, err error) {
-	ctx, span := _tracer.Start(ctx, "FindPacketsByAddress")
+func (n *BadgerStore) FindPacketRefsByMAC(ctx context.Context, mac net.HardwareAddr) (ret []store.PacketRef, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketRefsByMAC")
 	defer func() {
 		if err != nil {
 			span.RecordError(err)
@@ -125,19 +202,106 @@ func (n *BadgerStore) FindPacketsByAddress(ctx context.Context, ip net.IP) (ret
 		span.End()
 	}()
 
+	ret, err = n.findByPrefix(n.buildPrefix(mac))
+	return
+}
+
+func (n *BadgerStore) FindPacketRefsByNetwork(ctx context.Context, network *net.IPNet) (ret []store.PacketRef, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketRefsByNetwork",
+		trace.WithAttributes(
+			attribute.String("request.network", network.String()),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	network = models.NormalizeNetwork(network)
+	prefix := n.buildNetworkPrefix(network)
+	found := map[string]struct{}{}
+
 	err = n.db.View(func(tx *badger.Txn) error {
 		it := tx.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
-		prefix := []byte(hex.EncodeToString(ip))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			parts := strings.Split(string(it.Item().Key()), "-")
+			if (len(parts) < 2) || !networkContains(network, parts[0]) {
+				continue
+			}
+
+			// packets are indexed with both of their addresses
+			if _, exists := found[parts[1]]; exists {
+				continue
+			}
+			found[parts[1]] = struct{}{}
+
+			ref, err := indexRef(it.Item(), parts[1])
+			if err != nil {
+				return err
+			}
+
+			ret = append(ret, ref)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// buildNetworkPrefix returns the longest key prefix shared by all the
+// addresses of the network, the keys found still have to be checked with
+// networkContains when the mask does not end on an hex digit.
+func (n *BadgerStore) buildNetworkPrefix(network *net.IPNet) []byte {
+	ones, _ := network.Mask.Size()
+	return []byte(hex.EncodeToString(network.IP)[:ones/4])
+}
+
+// networkContains returns true if the hex encoded key address is an IP
+// address of the network, MAC addresses and port keys are ignored.
+func networkContains(network *net.IPNet, key string) bool {
+	addr, err := hex.DecodeString(key)
+	if (err != nil) || (len(addr) != net.IPv6len) {
+		return false
+	}
+
+	return network.Contains(addr)
+}
+
+func (n *BadgerStore) FindPacketRefsByPort(ctx context.Context, proto layers.IPProtocol, port uint16) (ret []store.PacketRef, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketRefsByPort")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = n.findByPrefix(n.buildPortPrefix(proto, port))
+	return
+}
+
+func (n *BadgerStore) findByPrefix(prefix []byte) (ret []store.PacketRef, err error) {
+	err = n.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
 
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
-			k := item.Key()
-			parts := strings.Split(string(k), "-")
-			if len(parts) >= 2 {
-				ret = append(ret, parts[1])
+			parts := strings.Split(string(item.Key()), "-")
+			if len(parts) < 2 {
+				continue
 			}
+
+			ref, err := indexRef(item, parts[1])
+			if err != nil {
+				return err
+			}
+
+			ret = append(ret, ref)
 		}
 
 		return nil
@@ -145,3 +309,19 @@ func (n *BadgerStore) FindPacketsByAddress(ctx context.Context, ip net.IP) (ret
 
 	return
 }
+
+// indexRef returns the indexed packet with its capture time, the keys
+// written before the time was stored have a zero timestamp since the id
+// creation time is only an approximation.
+func indexRef(item *badger.Item, packetId string) (store.PacketRef, error) {
+	ret := store.PacketRef{Id: packetId}
+
+	err := item.Value(func(value []byte) error {
+		if len(value) == _indexValueSize {
+			ret.Timestamp, _ = decodeIndexValue(value, packetId)
+		}
+		return nil
+	})
+
+	return ret, errors.WithStack(err)
+}
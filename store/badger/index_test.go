@@ -1,12 +1,19 @@
 package badger_store
 
 import (
+	"context"
+	"net"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3"
 	"github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/schmurfy/sniffit/index_encoder"
+	"github.com/schmurfy/sniffit/models"
 	"github.com/schmurfy/sniffit/store"
 )
 
@@ -21,5 +28,121 @@ func TestBadger(t *testing.T) {
 			opts.TTL = 7 * 24 * time.Hour
 			return New(&opts)
 		})
+
+		g.It("should cache the key stats", func() {
+			dir, err := os.MkdirTemp("", "badger")
+			require.Nil(g, err)
+			defer os.RemoveAll(dir)
+
+			encoder, err := index_encoder.NewProto()
+			require.Nil(g, err)
+
+			opts := DefaultOptions
+			opts.Path = dir
+			opts.Encoder = encoder
+			opts.TTL = 7 * 24 * time.Hour
+
+			s, err := New(&opts)
+			require.Nil(g, err)
+			defer s.Close()
+
+			ctx := context.Background()
+			addr1 := net.ParseIP("10.0.0.1").To4()
+			addr2 := net.ParseIP("10.0.0.2").To4()
+			addr3 := net.ParseIP("10.0.0.3").To4()
+
+			index := func(id string, src, dst net.IP) {
+				err := s.IndexPackets(ctx, []*models.Packet{
+					{Id: id, Data: store.BuildPacket(src, dst), Timestamp: time.Now()},
+				})
+				require.Nil(g, err)
+			}
+
+			index("p1", addr1, addr2)
+
+			keys, err := s.KeyStats(ctx, &store.KeysQuery{})
+			require.Nil(g, err)
+			require.Len(g, keys, 2)
+			assert.Equal(g, models.NormalizeIP(addr1), net.IP(keys[0].Address))
+
+			index("p2", addr3, addr2)
+
+			keys, err = s.KeyStats(ctx, &store.KeysQuery{})
+			require.Nil(g, err)
+			assert.Len(g, keys, 2)
+
+			// another query is scanned
+			_, network, _ := net.ParseCIDR("10.0.0.0/24")
+			keys, err = s.KeyStats(ctx, &store.KeysQuery{Network: network})
+			require.Nil(g, err)
+			assert.Len(g, keys, 3)
+		})
+
+		g.It("should upgrade the IPv4 keys of older databases", func() {
+			dir, err := os.MkdirTemp("", "badger")
+			require.Nil(g, err)
+			defer os.RemoveAll(dir)
+
+			opts := DefaultOptions
+			opts.Path = dir
+			opts.TTL = 7 * 24 * time.Hour
+
+			s, err := New(&opts)
+			require.Nil(g, err)
+			defer func() { s.Close() }()
+
+			// older databases have no marker
+			expiresAt := uint64(time.Now().Add(time.Hour).Unix())
+			err = s.db.Update(func(tx *badger.Txn) error {
+				entry := badger.NewEntry([]byte("ac100001-p1"), []byte{})
+				entry.ExpiresAt = expiresAt
+				err := tx.SetEntry(entry)
+				if err != nil {
+					return err
+				}
+
+				return tx.Delete([]byte(_ipv4KeysUpgradedKey))
+			})
+			require.Nil(g, err)
+			s.Close()
+
+			s, err = New(&opts)
+			require.Nil(g, err)
+
+			ids, err := s.FindPacketsByAddress(context.Background(), net.ParseIP("172.16.0.1"))
+			require.Nil(g, err)
+			assert.Equal(g, []string{"p1"}, ids)
+
+			err = s.db.View(func(tx *badger.Txn) error {
+				_, err := tx.Get([]byte("ac100001-p1"))
+				assert.Equal(g, badger.ErrKeyNotFound, err)
+
+				item, err := tx.Get([]byte("00000000000000000000ffffac100001-p1"))
+				require.Nil(g, err)
+				assert.Equal(g, expiresAt, item.ExpiresAt())
+				return nil
+			})
+			require.Nil(g, err)
+
+			keys, err := s.DataKeys(context.Background())
+			require.Nil(g, err)
+			assert.NotContains(g, keys, _ipv4KeysUpgradedKey)
+
+			// the keys are not scanned again
+			err = s.db.Update(func(tx *badger.Txn) error {
+				return tx.Set([]byte("ac100002-p2"), []byte{})
+			})
+			require.Nil(g, err)
+			s.Close()
+
+			s, err = New(&opts)
+			require.Nil(g, err)
+
+			err = s.db.View(func(tx *badger.Txn) error {
+				_, err := tx.Get([]byte("ac100002-p2"))
+				return err
+			})
+			assert.Nil(g, err)
+		})
 	})
 }
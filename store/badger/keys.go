@@ -0,0 +1,181 @@
+package badger_store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// address keys hold the packet timestamp (unix nanoseconds) and length so
+// the keys can be summarized without reading the packets.
+const (
+	_indexValueSize = 12
+)
+
+func encodeIndexValue(pkt *models.Packet) []byte {
+	ret := make([]byte, _indexValueSize)
+	binary.BigEndian.PutUint64(ret, uint64(pkt.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(ret[8:], uint32(pkt.Length()))
+	return ret
+}
+
+// decodeIndexValue returns the timestamp and length of an indexed packet,
+// keys written before the value was added only have the id creation time.
+func decodeIndexValue(value []byte, packetId string) (time.Time, int) {
+	if len(value) == _indexValueSize {
+		return time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+			int(binary.BigEndian.Uint32(value[8:]))
+	}
+
+	if id, err := xid.FromString(packetId); err == nil {
+		return id.Time(), 0
+	}
+
+	return time.Time{}, 0
+}
+
+// keyStatsQuery identifies the results of a query in the cache.
+type keyStatsQuery struct {
+	from    int64
+	to      int64
+	network string
+}
+
+func newKeyStatsQuery(q *store.KeysQuery) keyStatsQuery {
+	var ret keyStatsQuery
+
+	if q != nil {
+		ret.from = q.From.UnixNano()
+		ret.to = q.To.UnixNano()
+		if q.Network != nil {
+			ret.network = q.Network.String()
+		}
+	}
+
+	return ret
+}
+
+type cachedKeyStats struct {
+	keys      []*store.KeyStats
+	scannedAt time.Time
+}
+
+// KeyStats returns the stats sorted with store.SortKeyStats, like the index
+// keys they are cached so the pages of a listing do not scan the whole
+// index each time.
+func (n *BadgerStore) KeyStats(ctx context.Context, q *store.KeysQuery) (ret []*store.KeyStats, err error) {
+	ctx, span := _tracer.Start(ctx, "KeyStats")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	n.cachedKeyStatsMutex.Lock()
+	defer n.cachedKeyStatsMutex.Unlock()
+
+	cacheKey := newKeyStatsQuery(q)
+	now := time.Now()
+
+	if cached, found := n.cachedKeyStats[cacheKey]; found && (now.Sub(cached.scannedAt) < n.cachedIndexKeysInterval) {
+		span.SetAttributes(attribute.Bool("cached", true))
+		// copied so the caller can reorder it
+		return slices.Clone(cached.keys), nil
+	}
+
+	ret, err = n.scanKeyStats(q)
+	if err != nil {
+		return
+	}
+
+	store.SortKeyStats(ret)
+
+	// the results of the other queries are dropped once expired
+	for k, cached := range n.cachedKeyStats {
+		if now.Sub(cached.scannedAt) >= n.cachedIndexKeysInterval {
+			delete(n.cachedKeyStats, k)
+		}
+	}
+
+	if n.cachedIndexKeysInterval > 0 {
+		n.cachedKeyStats[cacheKey] = &cachedKeyStats{keys: ret, scannedAt: now}
+		ret = slices.Clone(ret)
+	}
+
+	return
+}
+
+func (n *BadgerStore) scanKeyStats(q *store.KeysQuery) (ret []*store.KeyStats, err error) {
+	keys := map[string]*store.KeyStats{}
+
+	prefix := []byte{}
+	if (q != nil) && (q.Network != nil) {
+		prefix = n.buildNetworkPrefix(models.NormalizeNetwork(q.Network))
+	}
+
+	err = n.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.Key()
+
+			parts := strings.Split(string(k), "-")
+			if (len(parts) < 2) || strings.HasPrefix(parts[0], _portKeyPrefix) || isFlowKey(k) || isMetaKey(k) {
+				continue
+			}
+
+			addr, err := hex.DecodeString(parts[0])
+			if (err != nil) || !q.MatchAddress(addr) {
+				continue
+			}
+
+			var ts time.Time
+			var length int
+
+			err = item.Value(func(value []byte) error {
+				ts, length = decodeIndexValue(value, parts[1])
+				return nil
+			})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if !q.MatchTime(ts) {
+				continue
+			}
+
+			ks, exists := keys[parts[0]]
+			if !exists {
+				ks = &store.KeyStats{Address: addr}
+				keys[parts[0]] = ks
+			}
+
+			ks.Add(ts, length)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ret = make([]*store.KeyStats, 0, len(keys))
+	for _, ks := range keys {
+		ret = append(ret, ks)
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package badger_store
 
 import (
+	"bytes"
 	"context"
 	"strconv"
 	"sync"
@@ -12,6 +13,19 @@ import (
 	"github.com/schmurfy/sniffit/store"
 )
 
+const (
+	// keys holding the state of the store itself, they are never returned
+	// as index or data keys
+	_metaKeyPrefix = "meta:"
+
+	// written once the index keys are all in their 16 bytes form
+	_ipv4KeysUpgradedKey = _metaKeyPrefix + "ipv4_keys_upgraded"
+)
+
+func isMetaKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(_metaKeyPrefix))
+}
+
 var (
 	DefaultOptions = Options{
 		CachedIndexKeysInterval: 15 * time.Minute,
@@ -29,6 +43,9 @@ type BadgerStore struct {
 	cachedIndexKeysInterval time.Duration
 	cachedIndexKeysMutex    sync.Mutex
 	lastIndexKeysScan       time.Time
+
+	cachedKeyStats      map[keyStatsQuery]*cachedKeyStats
+	cachedKeyStatsMutex sync.Mutex
 }
 
 type Options struct {
@@ -52,15 +69,90 @@ func New(o *Options) (*BadgerStore, error) {
 		encoder:                 o.Encoder,
 		ttl:                     o.TTL,
 		cachedIndexKeysInterval: o.CachedIndexKeysInterval,
+		cachedKeyStats:          map[keyStatsQuery]*cachedKeyStats{},
 		ctx:                     ctx,
 		cancelCtx:               cancel,
 	}
 
+	err = ret.upgradeIPv4Keys()
+	if err != nil {
+		ret.Close()
+		return nil, err
+	}
+
 	go ret.backgroundCleanup(1*time.Hour, 0.7)
 
 	return ret, nil
 }
 
+// upgradeIPv4Keys rewrites the index keys written when IPv4 addresses were
+// indexed in their 4 bytes form, a marker is written once done so the keys
+// are only scanned the first time an older database is opened. The write
+// batch commits the changes as it grows.
+func (b *BadgerStore) upgradeIPv4Keys() error {
+	err := b.db.View(func(tx *badger.Txn) error {
+		_, err := tx.Get([]byte(_ipv4KeysUpgradedKey))
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return errors.WithStack(err)
+	}
+
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err = b.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := tx.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+
+			key, upgrade := store.UpgradeIPv4Key(string(item.Key()))
+			if !upgrade {
+				continue
+			}
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			entry := badger.NewEntry([]byte(key), value)
+			entry.ExpiresAt = item.ExpiresAt()
+
+			err = wb.SetEntry(entry)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			err = wb.Delete(item.KeyCopy(nil))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = wb.Set([]byte(_ipv4KeysUpgradedKey), []byte{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(wb.Flush())
+}
+
 func (b *BadgerStore) backgroundCleanup(frequency time.Duration, ratio float64) {
 	ticker := time.NewTicker(frequency)
 	defer ticker.Stop()
@@ -0,0 +1,127 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	AUDIT_INSERT = `INSERT INTO audit_log
+		(time, user, method, remote, route, path, query, status, packets,
+			bytes, duration)`
+)
+
+func (c *ClickHouseStore) StoreAuditEntries(ctx context.Context, entries []*models.AuditEntry) (err error) {
+	ctx, span := _tracer.Start(ctx, "StoreAuditEntries",
+		trace.WithAttributes(
+			attribute.Int("request.entries_count", len(entries)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	batch, err := c.conn.PrepareBatch(ctx, AUDIT_INSERT)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, e := range entries {
+		err = batch.Append(
+			e.Time,
+			e.User,
+			e.Method,
+			e.Remote,
+			e.Route,
+			e.Path,
+			e.Query,
+			uint16(e.Status),
+			e.Packets,
+			e.Bytes,
+			int64(e.Duration),
+		)
+		if err != nil {
+			batch.Abort()
+			return errors.WithStack(err)
+		}
+	}
+
+	return errors.WithStack(batch.Send())
+}
+
+func (c *ClickHouseStore) FindAuditEntries(ctx context.Context, q *store.AuditQuery) (ret []*models.AuditEntry, err error) {
+	ctx, span := _tracer.Start(ctx, "FindAuditEntries")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	query := `
+		SELECT time, user, method, remote, route, path, query, status, packets,
+			bytes, duration
+		FROM audit_log
+		WHERE 1 = 1`
+
+	var args []any
+
+	if q != nil {
+		if q.User != "" {
+			query += " AND user = ?"
+			args = append(args, q.User)
+		}
+		if !q.From.IsZero() {
+			query += " AND time >= ?"
+			args = append(args, q.From)
+		}
+		if !q.To.IsZero() {
+			query += " AND time <= ?"
+			args = append(args, q.To)
+		}
+	}
+
+	query += " ORDER BY time DESC"
+	if q != nil && q.MaxCount > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.MaxCount)
+	}
+
+	rows, err := c.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	ret = []*models.AuditEntry{}
+
+	for rows.Next() {
+		var e models.AuditEntry
+		var status uint16
+		var duration int64
+
+		err = rows.Scan(&e.Time, &e.User, &e.Method, &e.Remote, &e.Route, &e.Path,
+			&e.Query, &status, &e.Packets, &e.Bytes, &duration)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		e.Status = int(status)
+		e.Duration = time.Duration(duration)
+		ret = append(ret, &e)
+	}
+
+	return ret, errors.WithStack(rows.Err())
+}
@@ -7,13 +7,11 @@ import (
 	"embed"
 	"fmt"
 	"net"
-	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
-	"github.com/google/gopacket"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 	"github.com/schmurfy/sniffit/models"
@@ -29,9 +27,18 @@ var (
 
 const (
 	PACKET_INSERT = `INSERT INTO packets
-		(data, received_at, expires_at, src_ip, dst_ip)
-		VALUES(@data, @received_at, @expires_at, @src_ip, @dst_ip)
-	`
+		(id, data, capture_length, data_length, received_at, expires_at, link_type, agent, interface, duplicate_of,
+			src_ip, dst_ip, src_mac, dst_mac, ether_type, ip_proto, src_port, dst_port)`
+
+	PACKET_COLUMNS = "id, data, capture_length, data_length, received_at, link_type, agent, interface, duplicate_of"
+
+	// rows are deleted by the TTL when parts are merged, until then they
+	// are filtered out
+	_notExpired = "expires_at > now()"
+
+	// MAC addresses are only used to find non IP frames, like the other stores
+	_macCondition = `(src_mac = MACStringToNum(?) OR dst_mac = MACStringToNum(?))
+		AND src_ip = toIPv6('::') AND dst_ip = toIPv6('::')`
 )
 
 //go:embed migrations/*.sql
@@ -63,8 +70,24 @@ var (
 	}
 )
 
-// New creates a new ClickHouse store instance
+// New opens the store and applies the pending migrations.
 func New(o *Options) (*ClickHouseStore, error) {
+	ret, err := Open(o)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = ret.Migrate(context.Background())
+	if err != nil {
+		ret.Close()
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Open connects to ClickHouse without touching the schema.
+func Open(o *Options) (*ClickHouseStore, error) {
 	conn, err := clickhouse.Open(&clickhouse.Options{
 		Addr: o.Addr,
 		Auth: clickhouse.Auth{
@@ -86,118 +109,86 @@ func New(o *Options) (*ClickHouseStore, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	ret := &ClickHouseStore{
+	return &ClickHouseStore{
 		conn: conn,
 		ttl:  o.TTL,
-	}
-
-	// Initialize schema
-	if err := ret.initSchema(o); err != nil {
-		conn.Close()
-		return nil, err
-	}
-
-	return ret, nil
+	}, nil
 }
 
-// initSchema creates the necessary tables by applying migration files
-func (c *ClickHouseStore) initSchema(o *Options) error {
-	ctx := context.Background()
-
-	// Read all migration files from embedded filesystem
-	entries, err := migrationsFS.ReadDir("migrations")
-	if err != nil {
-		return errors.Wrap(err, "failed to read migrations directory")
-	}
-
-	// Sort migration files to ensure they run in order
-	var migrationFiles []string
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".sql" {
-			migrationFiles = append(migrationFiles, entry.Name())
+// StorePackets inserts the packets in one batch, they are indexed with their
+// addresses and ports at the same time.
+func (c *ClickHouseStore) StorePackets(ctx context.Context, pkts []*models.Packet) (err error) {
+	ctx, span := _tracer.Start(ctx, "StorePackets",
+		trace.WithAttributes(
+			attribute.Int("request.packets_count", len(pkts)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
 		}
-	}
-	sort.Strings(migrationFiles)
+		span.End()
+	}()
 
-	// Apply each migration file
-	for _, filename := range migrationFiles {
-		if err := c.applyMigration(ctx, filename, o); err != nil {
-			return errors.Wrapf(err, "failed to apply migration %s", filename)
-		}
+	if len(pkts) == 0 {
+		return nil
 	}
 
-	return nil
-}
-
-// applyMigration reads and executes a single migration file
-func (c *ClickHouseStore) applyMigration(ctx context.Context, filename string, o *Options) error {
-	// Read migration file
-	content, err := migrationsFS.ReadFile(filepath.Join("migrations", filename))
+	batch, err := c.conn.PrepareBatch(ctx, PACKET_INSERT)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	sql := string(content)
-
-	// Split SQL into individual statements
-	statements := splitSQLStatements(sql)
+	for _, pkt := range pkts {
+		pkt.Decode()
 
-	// Execute each statement
-	for _, stmt := range statements {
-		stmt = strings.TrimSpace(stmt)
-		if stmt == "" || strings.HasPrefix(stmt, "--") {
-			continue
+		// non IP frames are stored with unspecified addresses
+		srcIP, dstIP := net.IPv6unspecified, net.IPv6unspecified
+		if pkt.HasIP() {
+			srcIP, dstIP = pkt.SrcIP, pkt.DstIP
 		}
 
-		if err := c.conn.Exec(ctx, stmt); err != nil {
-			return errors.Wrapf(err, "failed to execute statement: %s", stmt)
+		err = batch.Append(
+			pkt.Id,
+			pkt.Data,
+			pkt.CaptureLength,
+			pkt.DataLength,
+			pkt.Timestamp,
+			pkt.Timestamp.Add(c.ttl),
+			uint16(pkt.LinkType),
+			pkt.Agent,
+			pkt.Interface,
+			pkt.DuplicateOf,
+			srcIP,
+			dstIP,
+			macToNum(pkt.SrcMAC),
+			macToNum(pkt.DstMAC),
+			pkt.EtherType,
+			uint8(pkt.IPProto),
+			pkt.SrcPort,
+			pkt.DstPort,
+		)
+		if err != nil {
+			batch.Abort()
+			return errors.WithStack(err)
 		}
 	}
 
-	return nil
+	return errors.WithStack(batch.Send())
 }
 
-// splitSQLStatements splits a SQL script into individual statements
-func splitSQLStatements(sql string) []string {
-	var statements []string
-	var current strings.Builder
-
-	lines := strings.SplitSeq(sql, "\n")
-	for line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		// Skip empty lines and comments
-		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
-			continue
-		}
-
-		current.WriteString(line)
-		current.WriteString("\n")
-
-		// Statement ends with semicolon
-		if strings.HasSuffix(trimmed, ";") {
-			statements = append(statements, current.String())
-			current.Reset()
-		}
-	}
-
-	// Add any remaining statement
-	if current.Len() > 0 {
-		statements = append(statements, current.String())
+// macToNum converts a MAC address like MACStringToNum, empty addresses are 0.
+func macToNum(mac net.HardwareAddr) (ret uint64) {
+	for _, b := range mac {
+		ret = ret<<8 | uint64(b)
 	}
 
-	return statements
-}
-
-// StorePackets stores packets in ClickHouse with their source and destination IPs
-func (c *ClickHouseStore) StorePackets(ctx context.Context, pkts []*models.Packet) (err error) {
-	return c.storePacketsWithWait(ctx, pkts, false)
+	return
 }
 
-func (c *ClickHouseStore) storePacketsWithWait(ctx context.Context, pkts []*models.Packet, wait bool) (err error) {
-	ctx, span := _tracer.Start(ctx, "StorePackets",
+func (c *ClickHouseStore) GetPacketsByAddress(ctx context.Context, ip net.IP, q *store.FindQuery) (pkts []*models.Packet, err error) {
+	ctx, span := _tracer.Start(ctx, "GetPacketsByAddress",
 		trace.WithAttributes(
-			attribute.Int("request.packets_count", len(pkts)),
+			attribute.String("request.ip", ip.String()),
 		))
 	defer func() {
 		if err != nil {
@@ -206,43 +197,19 @@ func (c *ClickHouseStore) storePacketsWithWait(ctx context.Context, pkts []*mode
 		span.End()
 	}()
 
-	if len(pkts) == 0 {
-		return nil
-	}
-
-	ctx = clickhouse.Context(ctx, clickhouse.WithAsync(wait))
-
-	for _, pkt := range pkts {
-		expiresAt := pkt.Timestamp.Add(c.ttl)
-
-		packet := gopacket.NewPacket(pkt.Data, layers.LayerTypeEthernet, gopacket.Default)
-		ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		if !ok {
-			continue
-		}
-
-		srcIP := ipLayer.SrcIP
-		dstIP := ipLayer.DstIP
-
-		err = c.conn.Exec(ctx, PACKET_INSERT,
-			clickhouse.Named("data", pkt.Data),
-			clickhouse.DateNamed("received_at", pkt.Timestamp, clickhouse.NanoSeconds),
-			clickhouse.DateNamed("expires_at", expiresAt, clickhouse.Seconds),
-			clickhouse.Named("src_ip", srcIP),
-			clickhouse.Named("dst_ip", dstIP),
-		)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	it, err := c.ScanPacketsByAddress(ctx, ip, q)
+	if err != nil {
+		return
 	}
 
-	return nil
+	pkts, err = store.CollectPackets(it)
+	return
 }
 
-func (c *ClickHouseStore) GetPacketsByAddress(ctx context.Context, ip net.IP, q *store.FindQuery) (pkts []*models.Packet, err error) {
-	ctx, span := _tracer.Start(ctx, "GetPacketsByAddress",
+func (c *ClickHouseStore) GetPacketsByMAC(ctx context.Context, mac net.HardwareAddr, q *store.FindQuery) (pkts []*models.Packet, err error) {
+	ctx, span := _tracer.Start(ctx, "GetPacketsByMAC",
 		trace.WithAttributes(
-			attribute.String("request.ip", ip.String()),
+			attribute.String("request.mac", mac.String()),
 		))
 	defer func() {
 		if err != nil {
@@ -251,13 +218,34 @@ func (c *ClickHouseStore) GetPacketsByAddress(ctx context.Context, ip net.IP, q
 		span.End()
 	}()
 
-	// Build query
-	args := []any{ip.String(), ip.String()}
+	it, err := c.ScanPacketsByMAC(ctx, mac, q)
+	if err != nil {
+		return
+	}
+
+	pkts, err = store.CollectPackets(it)
+	return
+}
+
+func (c *ClickHouseStore) ScanPacketsByAddress(ctx context.Context, ip net.IP, q *store.FindQuery) (store.PacketIterator, error) {
+	return c.queryPackets(ctx, "(src_ip = toIPv6(?) OR dst_ip = toIPv6(?))", []any{ip.String(), ip.String()}, q)
+}
+
+func (c *ClickHouseStore) ScanPacketsByMAC(ctx context.Context, mac net.HardwareAddr, q *store.FindQuery) (store.PacketIterator, error) {
+	return c.queryPackets(ctx, _macCondition, []any{mac.String(), mac.String()}, q)
+}
+
+func (c *ClickHouseStore) ScanMatchingPackets(ctx context.Context, q *store.FindQuery) (store.PacketIterator, error) {
+	return c.queryPackets(ctx, "1 = 1", nil, q)
+}
+
+// queryPackets returns an iterator on the packets matching the given
+// condition and the query filters
+func (c *ClickHouseStore) queryPackets(ctx context.Context, condition string, args []any, q *store.FindQuery) (store.PacketIterator, error) {
 	query := `
-		SELECT data, received_at,
+		SELECT ` + PACKET_COLUMNS + `
 		FROM packets
-		WHERE (src_ip = ? OR dst_ip = ?)
-	`
+		WHERE ` + _notExpired + ` AND ` + condition
 
 	if q != nil {
 		if !q.From.IsZero() {
@@ -268,53 +256,191 @@ func (c *ClickHouseStore) GetPacketsByAddress(ctx context.Context, ip net.IP, q
 			query += " AND received_at <= ?"
 			args = append(args, q.To)
 		}
+		if q.Agent != "" {
+			query += " AND agent = ?"
+			args = append(args, q.Agent)
+		}
+		if q.SkipDuplicates {
+			query += " AND duplicate_of = ''"
+		}
+		if q.EtherType != 0 {
+			query += " AND ether_type = ?"
+			args = append(args, q.EtherType)
+		}
+		if q.SrcIP != nil {
+			query += " AND src_ip = toIPv6(?)"
+			args = append(args, q.SrcIP.String())
+		}
+		if q.DstIP != nil {
+			query += " AND dst_ip = toIPv6(?)"
+			args = append(args, q.DstIP.String())
+		}
+		if len(q.Networks) > 0 {
+			// ranges use the sorting key unlike a CIDR function
+			ranges := make([]string, 0, len(q.Networks))
+			for _, n := range q.Networks {
+				first, last := models.NetworkRange(n)
+				ranges = append(ranges,
+					"(src_ip BETWEEN toIPv6(?) AND toIPv6(?)) OR (dst_ip BETWEEN toIPv6(?) AND toIPv6(?))")
+				args = append(args, first.String(), last.String(), first.String(), last.String())
+			}
+			query += " AND (" + strings.Join(ranges, " OR ") + ")"
+		}
+		if q.SrcMAC != nil {
+			query += " AND src_mac = MACStringToNum(?)"
+			args = append(args, q.SrcMAC.String())
+		}
+		if q.DstMAC != nil {
+			query += " AND dst_mac = MACStringToNum(?)"
+			args = append(args, q.DstMAC.String())
+		}
+		if q.Protocol != 0 {
+			query += " AND ip_proto = ?"
+			args = append(args, uint8(q.Protocol))
+		}
+		if q.Port != 0 {
+			query += " AND (src_port = ? OR dst_port = ?)"
+			args = append(args, q.Port, q.Port)
+		}
+		if q.SrcPort != 0 {
+			query += " AND src_port = ?"
+			args = append(args, q.SrcPort)
+		}
+		if q.DstPort != 0 {
+			query += " AND dst_port = ?"
+			args = append(args, q.DstPort)
+		}
+		if q.Flow != nil {
+			query += ` AND ip_proto = ? AND (
+				(src_ip = toIPv6(?) AND src_port = ? AND dst_ip = toIPv6(?) AND dst_port = ?) OR
+				(src_ip = toIPv6(?) AND src_port = ? AND dst_ip = toIPv6(?) AND dst_port = ?))`
+			a, b := q.Flow.A, q.Flow.B
+			args = append(args, uint8(q.Flow.Proto),
+				a.IP.String(), a.Port, b.IP.String(), b.Port,
+				b.IP.String(), b.Port, a.IP.String(), a.Port,
+			)
+		}
 	}
 
 	query += " ORDER BY received_at"
+	if q != nil && q.Descending {
+		query += " DESC"
+	}
+
 	if q != nil && q.MaxCount > 0 {
 		query += fmt.Sprintf(" LIMIT %d", q.MaxCount)
-		pkts = make([]*models.Packet, 0, q.MaxCount)
-	} else {
-		pkts = make([]*models.Packet, 0, 1000)
 	}
 
-	fmt.Printf("query: %s\nargs: %v\n", query, args)
-
 	rows, err := c.conn.Query(ctx, query, args...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer rows.Close()
 
-	fmt.Printf("after query\n")
+	return &rowsIterator{rows: rows}, nil
+}
 
-	for rows.Next() {
-		var pkt models.Packet
+// rowsIterator reads the packets from the query result as they arrive
+type rowsIterator struct {
+	rows    driver.Rows
+	current *models.Packet
+	err     error
+}
 
-		if err := rows.Scan(&pkt.Data, &pkt.Timestamp); err != nil {
-			return nil, errors.WithStack(err)
-		}
+func (it *rowsIterator) Next() bool {
+	it.current = nil
 
-		pkts = append(pkts, &pkt)
+	if (it.err != nil) || !it.rows.Next() {
+		return false
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, errors.WithStack(err)
+	var pkt models.Packet
+	var linkType uint16
+
+	err := it.rows.Scan(&pkt.Id, &pkt.Data, &pkt.CaptureLength, &pkt.DataLength, &pkt.Timestamp, &linkType, &pkt.Agent, &pkt.Interface, &pkt.DuplicateOf)
+	if err != nil {
+		it.err = errors.WithStack(err)
+		return false
+	}
+
+	pkt.LinkType = layers.LinkType(linkType)
+
+	// the addresses, ports and protocols are only stored to be queried, they
+	// are extracted from the data like when the packets were stored
+	pkt.Decode()
+
+	it.current = &pkt
+	return true
+}
+
+func (it *rowsIterator) Packet() *models.Packet {
+	return it.current
+}
+
+func (it *rowsIterator) Err() error {
+	if it.err != nil {
+		return it.err
 	}
 
-	return pkts, nil
+	return errors.WithStack(it.rows.Err())
+}
+
+func (it *rowsIterator) Close() error {
+	return errors.WithStack(it.rows.Close())
 }
 
 // GetPackets retrieves packets by their IDs with optional query filters
 func (c *ClickHouseStore) GetPackets(ctx context.Context, ids []string, q *store.FindQuery) (pkts []*models.Packet, err error) {
+	ctx, span := _tracer.Start(ctx, "GetPackets",
+		trace.WithAttributes(
+			attribute.Int("request.ids_count", len(ids)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	it, err := c.ScanPackets(ctx, ids, q)
+	if err != nil {
+		return
+	}
+
+	pkts, err = store.CollectPackets(it)
 	return
 }
 
+// ScanPackets retrieves packets by their IDs with optional query filters, they
+// are returned in capture time order like the other queries.
+func (c *ClickHouseStore) ScanPackets(ctx context.Context, ids []string, q *store.FindQuery) (store.PacketIterator, error) {
+	if len(ids) == 0 {
+		return store.NewIdsIterator(nil, q, nil), nil
+	}
+
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+
+	return c.queryPackets(ctx, "id IN ?", []any{clickhouse.GroupSet{Value: values}}, q)
+}
+
+// ScanPacketRefs ignores the timestamps of the refs, the time range and the
+// order are handled by the query.
+func (c *ClickHouseStore) ScanPacketRefs(ctx context.Context, refs []store.PacketRef, q *store.FindQuery) (store.PacketIterator, error) {
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.Id
+	}
+
+	return c.ScanPackets(ctx, ids, q)
+}
+
 // DataKeys returns all packet IDs
 func (c *ClickHouseStore) DataKeys(ctx context.Context) (ret []string, err error) {
 	ret = []string{}
 
-	rows, err := c.conn.Query(ctx, "SELECT DISTINCT id FROM packets ORDER BY id")
+	rows, err := c.conn.Query(ctx, "SELECT DISTINCT id FROM packets WHERE id != '' AND "+_notExpired+" ORDER BY id")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -355,10 +481,11 @@ func (c *ClickHouseStore) IndexKeys(ctx context.Context) (ret []string, err erro
 	// Get all unique source and destination IPs
 	rows, err := c.conn.Query(ctx, `
 		SELECT DISTINCT ip FROM (
-			SELECT DISTINCT src_ip AS ip FROM packets
+			SELECT DISTINCT src_ip AS ip FROM packets WHERE `+_notExpired+`
 			UNION DISTINCT
-			SELECT DISTINCT dst_ip AS ip FROM packets
+			SELECT DISTINCT dst_ip AS ip FROM packets WHERE `+_notExpired+`
 		)
+		WHERE ip != toIPv6('::')
 		ORDER BY ip
 	`)
 	if err != nil {
@@ -381,8 +508,158 @@ func (c *ClickHouseStore) IndexKeys(ctx context.Context) (ret []string, err erro
 	return ret, nil
 }
 
+// KeyStats summarizes the packets of each IP address, non IP frames are not
+// counted as their MAC addresses are not returned by IndexKeys either.
+func (c *ClickHouseStore) KeyStats(ctx context.Context, q *store.KeysQuery) (ret []*store.KeyStats, err error) {
+	ctx, span := _tracer.Start(ctx, "KeyStats")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	conditions := _notExpired
+	args := []any{}
+
+	if q != nil {
+		if !q.From.IsZero() {
+			conditions += " AND received_at >= ?"
+			args = append(args, q.From)
+		}
+		if !q.To.IsZero() {
+			conditions += " AND received_at <= ?"
+			args = append(args, q.To)
+		}
+	}
+
+	query := `
+		SELECT ip, count(), sum(if(data_length > length(data), data_length, length(data))),
+			min(received_at), max(received_at)
+		FROM (
+			SELECT arrayJoin(arrayDistinct([src_ip, dst_ip])) AS ip, data, data_length, received_at
+			FROM packets
+			WHERE ` + conditions + `
+		)
+		WHERE ip != toIPv6('::')`
+
+	if (q != nil) && (q.Network != nil) {
+		first, last := models.NetworkRange(q.Network)
+		query += " AND ip BETWEEN toIPv6(?) AND toIPv6(?)"
+		args = append(args, first.String(), last.String())
+	}
+
+	query += " GROUP BY ip"
+
+	rows, err := c.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	ret = []*store.KeyStats{}
+
+	for rows.Next() {
+		var ip net.IP
+		ks := &store.KeyStats{}
+
+		err = rows.Scan(&ip, &ks.Packets, &ks.Bytes, &ks.FirstSeen, &ks.LastSeen)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		ks.Address = models.NormalizeIP(ip)
+		ret = append(ret, ks)
+	}
+
+	err = errors.WithStack(rows.Err())
+	return
+}
+
 // FindPacketsByAddress finds all packet IDs associated with a specific IP address
 func (c *ClickHouseStore) FindPacketsByAddress(ctx context.Context, ip net.IP) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByAddress")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = c.findIds(ctx, "(src_ip = toIPv6(?) OR dst_ip = toIPv6(?))", ip.String(), ip.String())
+	return
+}
+
+// FindPacketsByMAC finds all packet IDs associated with a specific MAC address
+func (c *ClickHouseStore) FindPacketsByMAC(ctx context.Context, mac net.HardwareAddr) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByMAC")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = c.findIds(ctx, _macCondition, mac.String(), mac.String())
+	return
+}
+
+// FindPacketsByNetwork finds all packet IDs associated with an address of a network
+func (c *ClickHouseStore) FindPacketsByNetwork(ctx context.Context, network *net.IPNet) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByNetwork",
+		trace.WithAttributes(
+			attribute.String("request.network", network.String()),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	first, last := models.NetworkRange(network)
+	ret, err = c.findIds(ctx, "((src_ip BETWEEN toIPv6(?) AND toIPv6(?)) OR (dst_ip BETWEEN toIPv6(?) AND toIPv6(?)))",
+		first.String(), last.String(), first.String(), last.String())
+	return
+}
+
+// FindPacketsByPort finds all packet IDs using a specific port
+func (c *ClickHouseStore) FindPacketsByPort(ctx context.Context, proto layers.IPProtocol, port uint16) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByPort")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = c.findIds(ctx, "ip_proto = ? AND (src_port = ? OR dst_port = ?)", uint8(proto), port, port)
+	return
+}
+
+// findIds returns the ids of the packets matching the condition in id order,
+// rows stored without id are ignored.
+func (c *ClickHouseStore) findIds(ctx context.Context, condition string, args ...any) (ret []string, err error) {
+	ret = []string{}
+
+	rows, err := c.conn.Query(ctx, `
+		SELECT DISTINCT id FROM packets
+		WHERE id != '' AND `+_notExpired+` AND `+condition+`
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ret = append(ret, id)
+	}
+
+	err = errors.WithStack(rows.Err())
 	return
 }
 
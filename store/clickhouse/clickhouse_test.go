@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/franela/goblin"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/schmurfy/sniffit/index_encoder"
 	"github.com/schmurfy/sniffit/models"
 	"github.com/schmurfy/sniffit/store"
 	"github.com/stretchr/testify/assert"
@@ -17,7 +19,7 @@ import (
 )
 
 func (c *ClickHouseStore) StorePacketsAndFlush(t *testing.T, ctx context.Context, pkts []*models.Packet) error {
-	return c.storePacketsWithWait(ctx, pkts, true)
+	return c.StorePackets(ctx, pkts)
 }
 
 func TestClickHouseStore_Integration(t *testing.T) {
@@ -81,7 +83,6 @@ func TestClickHouseStore_Integration(t *testing.T) {
 		// Verify packet data - results may not be in order
 		retrievedIds := make(map[string]*models.Packet)
 		for _, pkt := range retrieved {
-			fmt.Printf("p: %+v\n", pkt)
 			retrievedIds[pkt.Id] = pkt
 		}
 		for _, original := range packets {
@@ -140,6 +141,118 @@ func TestClickHouseStore_Integration(t *testing.T) {
 		assert.Equal(t, 2, len(retrieved), "Should filter by time range and return 2 packets")
 	})
 
+	t.Run("ScanPacketsByAddress", func(t *testing.T) {
+		now := time.Now()
+		baseID := now.UnixNano()
+
+		packets := make([]*models.Packet, 3)
+		for i := range packets {
+			packets[i] = &models.Packet{
+				Id:            fmt.Sprintf("scan_test_%d_%d", baseID, i),
+				Data:          createSimplePacketData("192.168.3.1", "192.168.3.2"),
+				Timestamp:     now.Add(time.Duration(i-3) * time.Minute),
+				CaptureLength: 64,
+				DataLength:    64,
+			}
+		}
+
+		err := chStore.StorePacketsAndFlush(t, ctx, packets)
+		require.NoError(t, err)
+
+		it, err := chStore.ScanPacketsByAddress(ctx, net.ParseIP("192.168.3.1"), &store.FindQuery{
+			MaxCount:   2,
+			Descending: true,
+		})
+		require.NoError(t, err)
+
+		timestamps := []int64{}
+		for it.Next() {
+			timestamps = append(timestamps, it.Packet().Timestamp.Unix())
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+
+		assert.Equal(t, []int64{packets[2].Timestamp.Unix(), packets[1].Timestamp.Unix()}, timestamps)
+	})
+
+	t.Run("ScanMatchingPackets", func(t *testing.T) {
+		now := time.Now()
+		baseID := now.UnixNano()
+
+		packets := []*models.Packet{
+			{
+				Id:        fmt.Sprintf("port_test_%d_0", baseID),
+				Data:      store.BuildUDPPacket(net.ParseIP("192.168.4.1").To4(), net.ParseIP("192.168.4.53").To4(), 5353, 53),
+				Timestamp: now,
+			},
+			{
+				Id:        fmt.Sprintf("port_test_%d_1", baseID),
+				Data:      store.BuildUDPPacket(net.ParseIP("192.168.4.53").To4(), net.ParseIP("192.168.4.1").To4(), 53, 5353),
+				Timestamp: now,
+			},
+		}
+
+		err := chStore.StorePacketsAndFlush(t, ctx, packets)
+		require.NoError(t, err)
+
+		it, err := chStore.ScanMatchingPackets(ctx, &store.FindQuery{
+			DstIP:    net.ParseIP("192.168.4.53"),
+			Protocol: layers.IPProtocolUDP,
+			DstPort:  53,
+		})
+		require.NoError(t, err)
+
+		retrieved, err := store.CollectPackets(it)
+		require.NoError(t, err)
+		require.Len(t, retrieved, 1)
+		assert.Equal(t, packets[0].Data, retrieved[0].Data)
+
+		_, network, _ := net.ParseCIDR("192.168.4.0/30")
+		it, err = chStore.ScanMatchingPackets(ctx, &store.FindQuery{
+			Networks: []*net.IPNet{network},
+			SrcPort:  5353,
+		})
+		require.NoError(t, err)
+
+		retrieved, err = store.CollectPackets(it)
+		require.NoError(t, err)
+		require.Len(t, retrieved, 1)
+		assert.Equal(t, packets[0].Data, retrieved[0].Data)
+	})
+
+	t.Run("KeyStats", func(t *testing.T) {
+		now := time.Now()
+		baseID := now.UnixNano()
+
+		src := net.ParseIP("192.168.5.1").To4()
+		dst := net.ParseIP("192.168.5.2").To4()
+
+		packets := []*models.Packet{
+			{
+				Id:        fmt.Sprintf("keys_test_%d_0", baseID),
+				Data:      store.BuildUDPPacket(src, dst, 5353, 53),
+				Timestamp: now.Add(-time.Minute),
+			},
+			{
+				Id:        fmt.Sprintf("keys_test_%d_1", baseID),
+				Data:      store.BuildUDPPacket(dst, src, 53, 5353),
+				Timestamp: now,
+			},
+		}
+
+		err := chStore.StorePacketsAndFlush(t, ctx, packets)
+		require.NoError(t, err)
+
+		_, network, _ := net.ParseCIDR("192.168.5.1/32")
+		keys, err := chStore.KeyStats(ctx, &store.KeysQuery{Network: network})
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		assert.Equal(t, []byte(models.NormalizeIP(src)), keys[0].Address)
+		assert.Equal(t, uint64(2), keys[0].Packets)
+		assert.Equal(t, uint64(len(packets[0].Data)+len(packets[1].Data)), keys[0].Bytes)
+	})
+
 	t.Run("FindByAddress", func(t *testing.T) {
 		// Create packets with known IP addresses and unique IDs
 		srcIP := net.ParseIP("192.168.1.100")
@@ -240,6 +353,28 @@ func TestClickHouseStore_Integration(t *testing.T) {
 		assert.Contains(t, *stats, "unique_src_ips")
 		assert.Contains(t, *stats, "unique_dst_ips")
 	})
+
+	t.Run("AuditEntries", func(t *testing.T) {
+		now := time.Now().UTC()
+		entries := []*models.AuditEntry{
+			{Time: now.Add(-time.Minute), User: "alice", Route: "/keys", Path: "/keys", Status: 200},
+			{Time: now, User: "bob", Route: "/download/{Address}", Path: "/download/10.0.0.1", Status: 200, Packets: 3, Bytes: 512},
+		}
+
+		err := chStore.StoreAuditEntries(ctx, entries)
+		require.NoError(t, err)
+
+		found, err := chStore.FindAuditEntries(ctx, &store.AuditQuery{})
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+		assert.Equal(t, "bob", found[0].User, "most recent entry first")
+		assert.Equal(t, uint64(3), found[0].Packets)
+
+		found, err = chStore.FindAuditEntries(ctx, &store.AuditQuery{User: "alice"})
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		assert.Equal(t, "/keys", found[0].Route)
+	})
 }
 
 // Helper function to create simple packet data
@@ -310,6 +445,55 @@ func TestClickHouseStore_Interface(t *testing.T) {
 	var _ store.StoreInterface = (*ClickHouseStore)(nil)
 }
 
+// indexingStore runs the shared store.TestIndex tests through StorePackets,
+// ClickHouse indexes the packets as they are stored but the shared tests
+// only index them.
+type indexingStore struct {
+	*ClickHouseStore
+}
+
+func (s *indexingStore) IndexPackets(ctx context.Context, pkts []*models.Packet) error {
+	return s.StorePackets(ctx, pkts)
+}
+
+func TestClickHouseStore_Conformance(t *testing.T) {
+	opts := &Options{
+		Addr:     []string{"127.0.0.1:9000"},
+		Database: "sniffit_conformance",
+		Username: "default",
+		Password: "",
+		TTL:      7 * 24 * time.Hour,
+	}
+
+	if err := createTestDatabase(opts); err != nil {
+		t.Skipf("Skipping test, cannot create database: %v", err)
+		return
+	}
+	defer dropTestDatabase(opts)
+
+	chStore, err := New(opts)
+	if err != nil {
+		t.Skipf("Skipping test, cannot connect to ClickHouse: %v", err)
+		return
+	}
+	defer chStore.Close()
+
+	g := goblin.Goblin(t)
+	g.Describe("clickhouse", func() {
+		store.TestIndex(g, func(path string, encoder index_encoder.Interface) (store.StoreInterface, error) {
+			// the tables are shared by all the tests
+			for _, table := range []string{"packets", "flows"} {
+				err := chStore.conn.Exec(context.Background(), "TRUNCATE TABLE "+table)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return &indexingStore{chStore}, nil
+		})
+	})
+}
+
 // createTestDatabase creates a test database in ClickHouse
 func createTestDatabase(opts *Options) error {
 	// Connect without specifying database
@@ -361,3 +545,39 @@ func dropTestDatabase(opts *Options) error {
 	err = conn.Exec(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s", opts.Database))
 	return err
 }
+
+func TestMacToNum(t *testing.T) {
+	mac, err := net.ParseMAC("02:00:5e:10:00:01")
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(0x02005e100001), macToNum(mac))
+	assert.Equal(t, uint64(0), macToNum(nil))
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	sql := `-- first; comment
+CREATE TABLE t (
+  a String DEFAULT 'a;b', -- trailing; comment
+  b String DEFAULT 'it''s; \'quoted\''
+) ENGINE = Memory;
+
+/* block; comment */ ALTER TABLE t ADD COLUMN ` + "`c;d`" + ` UInt8;
+SELECT 1`
+
+	assert.Equal(t, []string{
+		"CREATE TABLE t (\n  a String DEFAULT 'a;b', \n  b String DEFAULT 'it''s; \\'quoted\\''\n) ENGINE = Memory",
+		"ALTER TABLE t ADD COLUMN `c;d` UInt8",
+		"SELECT 1",
+	}, splitSQLStatements(sql))
+
+	assert.Empty(t, splitSQLStatements("-- only a comment\n;\n"))
+}
+
+func TestMigrationVersions(t *testing.T) {
+	versions, err := migrationVersions()
+	require.NoError(t, err)
+
+	require.NotEmpty(t, versions)
+	assert.Equal(t, "001_initial_schema", versions[0])
+	assert.IsNonDecreasing(t, versions)
+}
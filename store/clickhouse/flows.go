@@ -0,0 +1,129 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+	"github.com/schmurfy/sniffit/models"
+	"github.com/schmurfy/sniffit/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	FLOW_INSERT = `INSERT INTO flows
+		(id, agent, proto, a_ip, a_port, b_ip, b_port, first_seen, last_seen,
+			packets, bytes, tcp_flags, expires_at)`
+)
+
+// StoreFlows inserts the records, older versions of a record are replaced
+// when ClickHouse merges the parts.
+func (c *ClickHouseStore) StoreFlows(ctx context.Context, flows []*models.FlowRecord) (err error) {
+	ctx, span := _tracer.Start(ctx, "StoreFlows",
+		trace.WithAttributes(
+			attribute.Int("request.flows_count", len(flows)),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	if len(flows) == 0 {
+		return nil
+	}
+
+	batch, err := c.conn.PrepareBatch(ctx, FLOW_INSERT)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, fr := range flows {
+		err = batch.Append(
+			fr.ID(),
+			fr.Agent,
+			uint8(fr.Proto),
+			fr.A.IP,
+			fr.A.Port,
+			fr.B.IP,
+			fr.B.Port,
+			fr.FirstSeen,
+			fr.LastSeen,
+			fr.Packets,
+			fr.Bytes,
+			fr.TCPFlags,
+			fr.LastSeen.Add(c.ttl),
+		)
+		if err != nil {
+			batch.Abort()
+			return errors.WithStack(err)
+		}
+	}
+
+	return errors.WithStack(batch.Send())
+}
+
+func (c *ClickHouseStore) FindFlows(ctx context.Context, q *store.FlowQuery) (ret []*models.FlowRecord, err error) {
+	ctx, span := _tracer.Start(ctx, "FindFlows")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	query := `
+		SELECT proto, a_ip, a_port, b_ip, b_port, agent, first_seen, last_seen,
+			packets, bytes, tcp_flags
+		FROM flows FINAL
+		WHERE 1 = 1`
+
+	var args []any
+
+	if q != nil {
+		if q.IP != nil {
+			query += " AND (a_ip = toIPv6(?) OR b_ip = toIPv6(?))"
+			args = append(args, q.IP.String(), q.IP.String())
+		}
+		if !q.From.IsZero() {
+			query += " AND last_seen >= ?"
+			args = append(args, q.From)
+		}
+		if !q.To.IsZero() {
+			query += " AND first_seen <= ?"
+			args = append(args, q.To)
+		}
+	}
+
+	query += " ORDER BY first_seen"
+	if q != nil && q.MaxCount > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.MaxCount)
+	}
+
+	rows, err := c.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	ret = []*models.FlowRecord{}
+
+	for rows.Next() {
+		var fr models.FlowRecord
+		var proto uint8
+
+		err = rows.Scan(&proto, &fr.A.IP, &fr.A.Port, &fr.B.IP, &fr.B.Port,
+			&fr.Agent, &fr.FirstSeen, &fr.LastSeen, &fr.Packets, &fr.Bytes, &fr.TCPFlags)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		fr.Proto = layers.IPProtocol(proto)
+		ret = append(ret, &fr)
+	}
+
+	return ret, errors.WithStack(rows.Err())
+}
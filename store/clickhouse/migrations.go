@@ -0,0 +1,400 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+)
+
+const (
+	// the lock of an archivist which died while migrating expires after
+	// this delay
+	_migrationLockTTL = 30 * time.Minute
+
+	// time given to the other archivists to register before the lock owner
+	// is checked, and delay between two attempts
+	_migrationLockSettle = time.Second
+	_migrationLockRetry  = 2 * time.Second
+
+	// this migration rebuilds the packets table and cannot be applied twice
+	_ipv6Migration = "002_ipv6_addresses"
+
+	_createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version String,
+		applied_at DateTime64(3)
+	) ENGINE = ReplacingMergeTree ORDER BY version`
+
+	// the oldest non expired row owns the lock
+	_createMigrationsLockTable = `CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+		owner String,
+		acquired_at DateTime64(6) DEFAULT now64(6),
+		expires_at DateTime
+	) ENGINE = MergeTree ORDER BY acquired_at TTL expires_at`
+)
+
+// Migration is an embedded migration, AppliedAt is zero until the migration
+// is applied.
+type Migration struct {
+	Version   string
+	AppliedAt time.Time
+}
+
+func (m *Migration) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// migrationVersions returns the embedded migrations in the order they
+// must be applied, the version is the file name without extension.
+func migrationVersions() ([]string, error) {
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read migrations directory")
+	}
+
+	var ret []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".sql" {
+			ret = append(ret, strings.TrimSuffix(entry.Name(), ".sql"))
+		}
+	}
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// MigrationStatus returns every embedded migration and when it was applied,
+// the schema is not modified.
+func (c *ClickHouseStore) MigrationStatus(ctx context.Context) (ret []*Migration, err error) {
+	ctx, span := _tracer.Start(ctx, "MigrationStatus")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	versions, err := migrationVersions()
+	if err != nil {
+		return
+	}
+
+	var count uint64
+	err = c.conn.QueryRow(ctx,
+		`SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = 'schema_migrations'`,
+	).Scan(&count)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	applied := map[string]time.Time{}
+	if count > 0 {
+		applied, err = c.appliedMigrations(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	ret = make([]*Migration, 0, len(versions))
+	for _, version := range versions {
+		ret = append(ret, &Migration{
+			Version:   version,
+			AppliedAt: applied[version],
+		})
+	}
+
+	return
+}
+
+// Migrate applies the pending migrations and returns their versions, the
+// archivists starting at the same time wait for each other so every
+// migration is applied once.
+// The databases created before the migrations were tracked have every
+// migration applied again once, they are all idempotent except the rebuild
+// of the packets table which is recorded by baselineMigrations.
+func (c *ClickHouseStore) Migrate(ctx context.Context) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "Migrate")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	for _, query := range []string{_createMigrationsTable, _createMigrationsLockTable} {
+		err = c.conn.Exec(ctx, query)
+		if err != nil {
+			err = errors.Wrap(err, "failed to create the migrations tables")
+			return
+		}
+	}
+
+	pending, err := c.pendingMigrations(ctx)
+	if (err != nil) || (len(pending) == 0) {
+		return
+	}
+
+	release, err := c.lockMigrations(ctx)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	err = c.baselineMigrations(ctx)
+	if err != nil {
+		return
+	}
+
+	// another archivist may have applied them while we were waiting
+	pending, err = c.pendingMigrations(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, version := range pending {
+		err = c.applyMigration(ctx, version)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to apply migration %s", version)
+			return
+		}
+
+		err = c.conn.Exec(ctx,
+			`INSERT INTO schema_migrations (version, applied_at) VALUES (?, now64(3))`,
+			version,
+		)
+		if err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+
+		ret = append(ret, version)
+	}
+
+	return
+}
+
+// baselineMigrations records the IPv6 migration of the databases created
+// before the migrations were tracked, rebuilding their packets table again
+// would drop the columns added by the later migrations.
+func (c *ClickHouseStore) baselineMigrations(ctx context.Context) error {
+	applied, err := c.appliedMigrations(ctx)
+	if (err != nil) || (len(applied) > 0) {
+		return err
+	}
+
+	var count uint64
+	err = c.conn.QueryRow(ctx,
+		`SELECT count() FROM system.columns WHERE database = currentDatabase() AND table = 'packets' AND name = 'src_ip' AND type = 'IPv6'`,
+	).Scan(&count)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	return errors.WithStack(c.conn.Exec(ctx,
+		`INSERT INTO schema_migrations (version, applied_at) VALUES (?, now64(3))`,
+		_ipv6Migration,
+	))
+}
+
+func (c *ClickHouseStore) appliedMigrations(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := c.conn.Query(ctx, `SELECT version, min(applied_at) FROM schema_migrations GROUP BY version`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	ret := map[string]time.Time{}
+	for rows.Next() {
+		var version string
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		ret[version] = appliedAt
+	}
+
+	return ret, errors.WithStack(rows.Err())
+}
+
+func (c *ClickHouseStore) pendingMigrations(ctx context.Context) ([]string, error) {
+	versions, err := migrationVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := c.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, version := range versions {
+		if _, found := applied[version]; !found {
+			ret = append(ret, version)
+		}
+	}
+
+	return ret, nil
+}
+
+// lockMigrations waits until this store owns the migration lock, every
+// candidate inserts a row and the oldest one wins.
+func (c *ClickHouseStore) lockMigrations(ctx context.Context) (func(), error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%s", hostname, xid.New().String())
+
+	release := func() {
+		// mutations are asynchronous by default, the next owner must not
+		// see our row
+		ctx := clickhouse.Context(context.WithoutCancel(ctx), clickhouse.WithSettings(clickhouse.Settings{
+			"mutations_sync": 1,
+		}))
+		_ = c.conn.Exec(ctx, `ALTER TABLE schema_migrations_lock DELETE WHERE owner = ?`, owner)
+	}
+
+	for {
+		err := c.conn.Exec(ctx,
+			`INSERT INTO schema_migrations_lock (owner, expires_at) VALUES (?, now() + toIntervalSecond(?))`,
+			owner, int64(_migrationLockTTL.Seconds()),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to request the migration lock")
+		}
+
+		if err := sleepContext(ctx, _migrationLockSettle); err != nil {
+			release()
+			return nil, err
+		}
+
+		var current string
+		err = c.conn.QueryRow(ctx,
+			`SELECT owner FROM schema_migrations_lock WHERE expires_at > now() ORDER BY acquired_at, owner LIMIT 1`,
+		).Scan(&current)
+		if err != nil {
+			release()
+			return nil, errors.Wrap(err, "failed to check the migration lock")
+		}
+
+		if current == owner {
+			return release, nil
+		}
+
+		release()
+
+		if err := sleepContext(ctx, _migrationLockRetry); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// applyMigration reads and executes a single migration file
+func (c *ClickHouseStore) applyMigration(ctx context.Context, version string) error {
+	content, err := migrationsFS.ReadFile(filepath.Join("migrations", version+".sql"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, stmt := range splitSQLStatements(string(content)) {
+		if err := c.conn.Exec(ctx, stmt); err != nil {
+			return errors.Wrapf(err, "failed to execute statement: %s", stmt)
+		}
+	}
+
+	return nil
+}
+
+// splitSQLStatements splits a SQL script on the semicolons ending its
+// statements, the comments are removed and the quoted strings and
+// identifiers are kept as is.
+func splitSQLStatements(sql string) []string {
+	var statements []string
+	var current strings.Builder
+
+	flush := func() {
+		if stmt := strings.TrimSpace(current.String()); stmt != "" {
+			statements = append(statements, stmt)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case (sql[i] == '\'') || (sql[i] == '"') || (sql[i] == '`'):
+			end := quotedEnd(sql, i)
+			current.WriteString(sql[i:end])
+			i = end - 1
+
+		case strings.HasPrefix(sql[i:], "--"):
+			// the newline is kept
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end - 1
+			}
+
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+
+		case sql[i] == ';':
+			flush()
+
+		default:
+			current.WriteByte(sql[i])
+		}
+	}
+
+	flush()
+
+	return statements
+}
+
+// quotedEnd returns the index following the quote closing the string
+// starting at start, quotes are escaped with a backslash or doubled.
+func quotedEnd(s string, start int) int {
+	quote := s[start]
+
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if (i+1 < len(s)) && (s[i+1] == quote) {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
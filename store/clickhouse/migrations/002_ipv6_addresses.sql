@@ -0,0 +1,25 @@
+-- src_ip and dst_ip are part of the sorting key and cannot be altered in place
+-- so the table is rebuilt with IPv6 columns, IPv4 addresses are stored as
+-- v4-mapped addresses (::ffff:a.b.c.d).
+-- The copy left by an interrupted run is dropped first, the migration is
+-- only recorded once every statement succeeded.
+DROP TABLE IF EXISTS packets_ipv6;
+
+CREATE TABLE IF NOT EXISTS packets_ipv6 (
+  data Array(UInt8) CODEC(ZSTD),
+  received_at DateTime64(9),
+  expires_at DateTime,
+  src_ip IPv6,
+  dst_ip IPv6
+)
+ENGINE = MergeTree()
+ORDER BY (src_ip, dst_ip, received_at)
+TTL expires_at;
+
+INSERT INTO packets_ipv6 (data, received_at, expires_at, src_ip, dst_ip)
+  SELECT data, received_at, expires_at, toIPv6(src_ip), toIPv6(dst_ip)
+  FROM packets;
+
+EXCHANGE TABLES packets AND packets_ipv6;
+
+DROP TABLE packets_ipv6;
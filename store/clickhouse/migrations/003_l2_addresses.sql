@@ -0,0 +1,10 @@
+-- non IP frames (ARP, LLDP, STP, ...) are stored with unspecified IP
+-- addresses (::) and looked up by MAC address instead.
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS src_mac UInt64,
+  ADD COLUMN IF NOT EXISTS dst_mac UInt64,
+  ADD COLUMN IF NOT EXISTS ether_type UInt16;
+
+ALTER TABLE packets
+  ADD INDEX IF NOT EXISTS src_mac_idx src_mac TYPE bloom_filter GRANULARITY 4,
+  ADD INDEX IF NOT EXISTS dst_mac_idx dst_mac TYPE bloom_filter GRANULARITY 4;
@@ -0,0 +1,4 @@
+-- pcap link type of the capture, 0 is used for rows stored before the link
+-- type was recorded (ethernet frames).
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS link_type UInt16;
@@ -0,0 +1,9 @@
+-- transport protocol and ports, the ports are 0 for protocols without ports
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS ip_proto UInt8,
+  ADD COLUMN IF NOT EXISTS src_port UInt16,
+  ADD COLUMN IF NOT EXISTS dst_port UInt16;
+
+ALTER TABLE packets
+  ADD INDEX IF NOT EXISTS src_port_idx src_port TYPE bloom_filter GRANULARITY 4,
+  ADD INDEX IF NOT EXISTS dst_port_idx dst_port TYPE bloom_filter GRANULARITY 4;
@@ -0,0 +1,22 @@
+-- one row per flow record, the archivist rewrites the record as packets
+-- arrive so only the most complete version is kept.
+CREATE TABLE IF NOT EXISTS flows (
+  id String,
+  agent String,
+  proto UInt8,
+  a_ip IPv6,
+  a_port UInt16,
+  b_ip IPv6,
+  b_port UInt16,
+  first_seen DateTime64(9),
+  last_seen DateTime64(9),
+  packets UInt64,
+  bytes UInt64,
+  tcp_flags UInt8,
+  expires_at DateTime,
+  INDEX a_ip_idx a_ip TYPE bloom_filter GRANULARITY 4,
+  INDEX b_ip_idx b_ip TYPE bloom_filter GRANULARITY 4
+)
+ENGINE = ReplacingMergeTree(packets)
+ORDER BY (id, agent, first_seen)
+TTL expires_at;
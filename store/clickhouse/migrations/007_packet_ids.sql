@@ -0,0 +1,10 @@
+-- packet id assigned by the agent and the lengths reported by the capture,
+-- rows stored before have an empty id and can only be found with the
+-- direct queries.
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS id String,
+  ADD COLUMN IF NOT EXISTS capture_length UInt16,
+  ADD COLUMN IF NOT EXISTS data_length UInt16;
+
+ALTER TABLE packets
+  ADD INDEX IF NOT EXISTS id_idx id TYPE bloom_filter GRANULARITY 4;
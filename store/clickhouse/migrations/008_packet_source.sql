@@ -0,0 +1,5 @@
+-- agent and interface which captured the packet, empty for the rows stored
+-- before they were recorded.
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS agent LowCardinality(String),
+  ADD COLUMN IF NOT EXISTS interface LowCardinality(String);
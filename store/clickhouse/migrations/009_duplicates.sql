@@ -0,0 +1,4 @@
+-- id of the first copy of a packet captured by several agents, empty for
+-- the other packets.
+ALTER TABLE packets
+  ADD COLUMN IF NOT EXISTS duplicate_of String;
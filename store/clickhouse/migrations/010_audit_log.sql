@@ -0,0 +1,17 @@
+-- append-only log of the downloads and queries made on the http api, the
+-- entries are kept without TTL.
+CREATE TABLE IF NOT EXISTS audit_log (
+  time DateTime64(9),
+  user String,
+  method String,
+  remote String,
+  route String,
+  path String,
+  query String,
+  status UInt16,
+  packets UInt64,
+  bytes UInt64,
+  duration Int64
+)
+ENGINE = MergeTree
+ORDER BY (time, user);
@@ -3,7 +3,9 @@ package store
 import (
 	"context"
 	"net"
+	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/schmurfy/sniffit/models"
 )
 
@@ -13,16 +15,47 @@ type IndexInterface interface {
 	IndexPackets(context.Context, []*models.Packet) error
 	IndexKeys(context.Context) ([]string, error)
 	FindPacketsByAddress(context.Context, net.IP) ([]string, error)
+	FindPacketsByMAC(context.Context, net.HardwareAddr) ([]string, error)
+	// FindPacketsByNetwork returns the packets sent from or to any address
+	// of the network, each packet is returned once
+	FindPacketsByNetwork(context.Context, *net.IPNet) ([]string, error)
+	FindPacketsByPort(context.Context, layers.IPProtocol, uint16) ([]string, error)
 	GetStats() (*Stats, error)
 }
 
+// PacketRef is an indexed packet, the timestamp is the capture time of the
+// packet or zero when the index does not know it.
+type PacketRef struct {
+	Id        string
+	Timestamp time.Time
+}
+
+// TimedIndexInterface is implemented by the indexes storing the capture time
+// of the packets, the packets can then be ordered and filtered on their time
+// before being loaded.
+type TimedIndexInterface interface {
+	FindPacketRefsByAddress(context.Context, net.IP) ([]PacketRef, error)
+	FindPacketRefsByMAC(context.Context, net.HardwareAddr) ([]PacketRef, error)
+	FindPacketRefsByNetwork(context.Context, *net.IPNet) ([]PacketRef, error)
+	FindPacketRefsByPort(context.Context, layers.IPProtocol, uint16) ([]PacketRef, error)
+}
+
 type DirectDataInterface interface {
 	GetPacketsByAddress(context.Context, net.IP, *FindQuery) ([]*models.Packet, error)
+	GetPacketsByMAC(context.Context, net.HardwareAddr, *FindQuery) ([]*models.Packet, error)
+	ScanPacketsByAddress(context.Context, net.IP, *FindQuery) (PacketIterator, error)
+	ScanPacketsByMAC(context.Context, net.HardwareAddr, *FindQuery) (PacketIterator, error)
+	// ScanMatchingPackets only uses the query filters to select packets
+	ScanMatchingPackets(context.Context, *FindQuery) (PacketIterator, error)
 }
 
 type DataInterface interface {
 	StorePackets(context.Context, []*models.Packet) error
 	GetPackets(context.Context, []string, *FindQuery) ([]*models.Packet, error)
+	ScanPackets(context.Context, []string, *FindQuery) (PacketIterator, error)
+	// ScanPacketRefs returns the packets in capture time order, the refs
+	// outside of the query time range are skipped without being loaded
+	ScanPacketRefs(context.Context, []PacketRef, *FindQuery) (PacketIterator, error)
 	DataKeys(context.Context) ([]string, error)
 	GetStats() (*Stats, error)
 }
@@ -31,3 +64,19 @@ type StoreInterface interface {
 	IndexInterface
 	DataInterface
 }
+
+// FlowInterface is implemented by the stores able to persist the flow
+// records built by the archivist.
+type FlowInterface interface {
+	// StoreFlows creates or replaces the records
+	StoreFlows(context.Context, []*models.FlowRecord) error
+	FindFlows(context.Context, *FlowQuery) ([]*models.FlowRecord, error)
+}
+
+// AuditInterface is implemented by the audit log backends, the entries are
+// only appended.
+type AuditInterface interface {
+	StoreAuditEntries(context.Context, []*models.AuditEntry) error
+	// FindAuditEntries returns the most recent entries first
+	FindAuditEntries(context.Context, *AuditQuery) ([]*models.AuditEntry, error)
+}
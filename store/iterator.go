@@ -0,0 +1,166 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+// PacketIterator allows reading packets one by one without loading the whole
+// result in memory, it is used like sql.Rows:
+//
+//	for it.Next() {
+//		pkt := it.Packet()
+//	}
+//	err := it.Err()
+//
+// Close must always be called once done.
+type PacketIterator interface {
+	Next() bool
+	Packet() *models.Packet
+	Err() error
+	Close() error
+}
+
+// CollectPackets reads all the remaining packets from the iterator and closes it.
+func CollectPackets(it PacketIterator) (ret []*models.Packet, err error) {
+	defer func() {
+		closeErr := it.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	ret = []*models.Packet{}
+
+	for it.Next() {
+		ret = append(ret, it.Packet())
+	}
+
+	err = it.Err()
+	return
+}
+
+// FetchPacketFunc loads a single packet, it returns nil if the packet does not exist.
+type FetchPacketFunc func(id string) (*models.Packet, error)
+
+type idsIterator struct {
+	ids   []string
+	q     *FindQuery
+	fetch FetchPacketFunc
+
+	// number of packets left to return, -1 for no limit
+	remaining int
+
+	current *models.Packet
+	err     error
+}
+
+// PacketRefs returns the refs of packets whose capture time is unknown.
+func PacketRefs(ids []string) []PacketRef {
+	ret := make([]PacketRef, len(ids))
+	for i, id := range ids {
+		ret[i] = PacketRef{Id: id}
+	}
+
+	return ret
+}
+
+// NewIdsIterator returns an iterator loading the packets one by one with fetch, packets
+// not matching the query are skipped.
+// Without their capture time the packets are returned in id order, xids sort
+// in creation order so this is close to the chronological order.
+func NewIdsIterator(ids []string, q *FindQuery, fetch FetchPacketFunc) PacketIterator {
+	return NewRefsIterator(PacketRefs(ids), q, fetch)
+}
+
+// NewRefsIterator returns an iterator loading the packets one by one with fetch,
+// packets not matching the query are skipped.
+// The packets are returned in capture time order (or the reverse with
+// q.Descending), the refs without timestamp come first ordered by id, and the
+// refs outside of the query time range are dropped before loading anything.
+// Each packet is loaded independently so no transaction is held open while the
+// caller is processing the results.
+func NewRefsIterator(refs []PacketRef, q *FindQuery, fetch FetchPacketFunc) PacketIterator {
+	sorted := make([]PacketRef, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Timestamp.IsZero() || q.matchTime(ref.Timestamp) {
+			sorted = append(sorted, ref)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].Timestamp.Equal(sorted[j].Timestamp) {
+			return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+		}
+
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	// the same packet can be indexed multiple times, always with the same
+	// timestamp so the copies are next to each other
+	ret := &idsIterator{
+		ids:   make([]string, 0, len(sorted)),
+		q:     q,
+		fetch: fetch,
+	}
+
+	for i, ref := range sorted {
+		if (i == 0) || (ref.Id != sorted[i-1].Id) {
+			ret.ids = append(ret.ids, ref.Id)
+		}
+	}
+
+	if (q != nil) && q.Descending {
+		for i, j := 0, len(ret.ids)-1; i < j; i, j = i+1, j-1 {
+			ret.ids[i], ret.ids[j] = ret.ids[j], ret.ids[i]
+		}
+	}
+
+	if (q != nil) && (q.MaxCount > 0) {
+		ret.remaining = q.MaxCount
+	} else {
+		ret.remaining = -1
+	}
+
+	return ret
+}
+
+func (it *idsIterator) Next() bool {
+	it.current = nil
+
+	for (it.err == nil) && (it.remaining != 0) && (len(it.ids) > 0) {
+		id := it.ids[0]
+		it.ids = it.ids[1:]
+
+		pkt, err := it.fetch(id)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		if (pkt != nil) && it.q.Match(pkt) {
+			if it.remaining > 0 {
+				it.remaining--
+			}
+
+			it.current = pkt
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *idsIterator) Packet() *models.Packet {
+	return it.current
+}
+
+func (it *idsIterator) Err() error {
+	return it.err
+}
+
+func (it *idsIterator) Close() error {
+	it.ids = nil
+	return nil
+}
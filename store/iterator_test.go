@@ -0,0 +1,65 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+func TestRefsIterator(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("refs iterator", func() {
+		now := time.Now()
+
+		var fetched []string
+
+		fetch := func(id string) (*models.Packet, error) {
+			fetched = append(fetched, id)
+			return &models.Packet{Id: id, Timestamp: now}, nil
+		}
+
+		scan := func(refs []PacketRef, q *FindQuery) []string {
+			fetched = nil
+
+			pkts, err := CollectPackets(NewRefsIterator(refs, q, fetch))
+			require.Nil(g, err)
+
+			ids := []string{}
+			for _, pkt := range pkts {
+				ids = append(ids, pkt.Id)
+			}
+
+			return ids
+		}
+
+		g.It("should order the packets on their capture time", func() {
+			refs := []PacketRef{
+				{Id: "a", Timestamp: now},
+				{Id: "b", Timestamp: now.Add(-time.Minute)},
+				{Id: "c"},
+				{Id: "b", Timestamp: now.Add(-time.Minute)},
+			}
+
+			// refs without timestamp come first
+			assert.Equal(g, []string{"c", "b", "a"}, scan(refs, nil))
+			assert.Equal(g, []string{"a", "b"}, scan(refs, &FindQuery{Descending: true, MaxCount: 2}))
+		})
+
+		g.It("should not load the packets outside of the time range", func() {
+			refs := []PacketRef{
+				{Id: "old", Timestamp: now.Add(-time.Hour)},
+				{Id: "recent", Timestamp: now},
+				{Id: "legacy"},
+			}
+
+			assert.Equal(g, []string{"legacy", "recent"}, scan(refs, &FindQuery{From: now.Add(-time.Minute)}))
+			assert.Equal(g, []string{"legacy", "recent"}, fetched)
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/schmurfy/sniffit/models"
+)
+
+// UpgradeIPv4Key returns the index key with its address in the 16 bytes form
+// when it was written with a 4 bytes IPv4 address, before IPv4 and IPv6 keys
+// shared the same layout. Keys are "<hex address>-<suffix>".
+func UpgradeIPv4Key(key string) (string, bool) {
+	addr, suffix, found := strings.Cut(key, "-")
+	if !found || (len(addr) != net.IPv4len*2) {
+		return "", false
+	}
+
+	ip, err := hex.DecodeString(addr)
+	if err != nil {
+		return "", false
+	}
+
+	return hex.EncodeToString(models.NormalizeIP(ip)) + "-" + suffix, true
+}
+
+// KeyStatsInterface is implemented by the stores able to summarize the
+// traffic of each indexed address.
+type KeyStatsInterface interface {
+	KeyStats(context.Context, *KeysQuery) ([]*KeyStats, error)
+}
+
+type KeysQuery struct {
+	// only count the packets received in this time range (zero matches everything)
+	From time.Time
+	To   time.Time
+
+	// only return the IP addresses of this network (nil matches everything,
+	// MAC addresses included)
+	Network *net.IPNet
+}
+
+// MatchTime returns true if a packet received at t is in the query time range.
+func (q *KeysQuery) MatchTime(t time.Time) bool {
+	if q == nil {
+		return true
+	}
+
+	if !q.From.IsZero() && t.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && t.After(q.To) {
+		return false
+	}
+
+	return true
+}
+
+// MatchAddress returns true if the address, in its stored form, is in the
+// query network.
+func (q *KeysQuery) MatchAddress(addr []byte) bool {
+	if (q == nil) || (q.Network == nil) {
+		return true
+	}
+
+	return (len(addr) == net.IPv6len) && models.NormalizeNetwork(q.Network).Contains(addr)
+}
+
+// KeyStats summarizes the packets sent from or to an address, the address
+// is an IP address in its 16 bytes form or a MAC address for non IP frames.
+type KeyStats struct {
+	Address   []byte
+	Packets   uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// SortKeyStats orders the IP addresses first then the MAC addresses, in
+// address order so the pages of a listing are stable.
+func SortKeyStats(keys []*KeyStats) {
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i].Address) != len(keys[j].Address) {
+			return len(keys[i].Address) > len(keys[j].Address)
+		}
+
+		return bytes.Compare(keys[i].Address, keys[j].Address) < 0
+	})
+}
+
+// Add counts a packet.
+func (ks *KeyStats) Add(t time.Time, length int) {
+	ks.Packets++
+	ks.Bytes += uint64(length)
+
+	if ks.FirstSeen.IsZero() || t.Before(ks.FirstSeen) {
+		ks.FirstSeen = t
+	}
+
+	if t.After(ks.LastSeen) {
+		ks.LastSeen = t
+	}
+}
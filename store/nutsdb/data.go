@@ -62,31 +62,36 @@ func (n *NutsStore) GetPackets(ctx context.Context, ids []string, q *store.FindQ
 		span.End()
 	}()
 
-	pkts = make([]*models.Packet, 0, len(ids))
+	it, err := n.ScanPackets(ctx, ids, q)
+	if err != nil {
+		return
+	}
 
-	err = n.db.View(func(tx *nutsdb.Tx) error {
-		var err error
-		var entry *nutsdb.Entry
+	pkts, err = store.CollectPackets(it)
+	return
+}
 
-		for _, id := range ids {
-			entry, err = tx.Get(_dataBucket, []byte(id))
-			if err != nil {
-				if err == nutsdb.ErrNotFoundKey {
-					continue
-				}
+func (n *NutsStore) ScanPackets(ctx context.Context, ids []string, q *store.FindQuery) (store.PacketIterator, error) {
+	return store.NewIdsIterator(ids, q, n.getPacket), nil
+}
 
-				return err
-			}
+func (n *NutsStore) ScanPacketRefs(ctx context.Context, refs []store.PacketRef, q *store.FindQuery) (store.PacketIterator, error) {
+	return store.NewRefsIterator(refs, q, n.getPacket), nil
+}
 
-			pp, err := models.UnserializePacket(entry.Value)
-			if err != nil {
-				return err
+func (n *NutsStore) getPacket(id string) (pkt *models.Packet, err error) {
+	err = n.db.View(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(_dataBucket, []byte(id))
+		if err != nil {
+			if err == nutsdb.ErrNotFoundKey {
+				return nil
 			}
 
-			pkts = append(pkts, pp)
+			return err
 		}
 
-		return nil
+		pkt, err = models.UnserializePacket(entry.Value)
+		return err
 	})
 
 	return
@@ -5,9 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/schmurfy/sniffit/index_encoder"
 	"github.com/schmurfy/sniffit/models"
@@ -26,16 +26,30 @@ var (
 )
 
 const (
-	_indexBucket = "index"
+	_indexBucket   = "index"
+	_portKeyPrefix = "p"
 )
 
-func (n *NutsStore) buildKey(t time.Time, addr net.IP) *key {
+// IP addresses are always stored in their 16 bytes form so IPv4 and IPv6
+// keys share the same layout, MAC addresses (6 bytes) are used for non IP
+// frames.
+func (n *NutsStore) buildPrefix(addr []byte) string {
+	return fmt.Sprintf("%s-", hex.EncodeToString(addr))
+}
+
+// ports are indexed with their transport protocol, the "p" prefix cannot be
+// confused with an hex encoded address.
+func (n *NutsStore) buildPortPrefix(proto layers.IPProtocol, port uint16) string {
+	return fmt.Sprintf("%s%02x%04x-", _portKeyPrefix, uint8(proto), port)
+}
+
+func (n *NutsStore) buildKey(t time.Time, prefix string) *key {
 	strTime := t.Format(n.timeFormat)
 
 	tt, _ := time.Parse(n.timeFormat, strTime)
 
 	return &key{
-		name:      fmt.Sprintf("%s-%s", hex.EncodeToString(addr), strTime),
+		name:      fmt.Sprintf("%s%s", prefix, strTime),
 		timestamp: tt,
 	}
 }
@@ -45,17 +59,25 @@ func (n *NutsStore) buildKeys(pkts []*models.Packet) map[string]*key {
 
 	for _, pkt := range pkts {
 		// extract packet data
-		packet := gopacket.NewPacket(pkt.Data, layers.LayerTypeEthernet, gopacket.Default)
-		ipLayer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		pkt.Decode()
+
+		prefixes := []string{}
+		for _, addr := range pkt.IndexedAddresses() {
+			prefixes = append(prefixes, n.buildPrefix(addr))
+		}
+
+		for _, port := range pkt.IndexedPorts() {
+			prefixes = append(prefixes, n.buildPortPrefix(pkt.IPProto, port))
+		}
 
-		for _, addr := range []net.IP{ipLayer.SrcIP, ipLayer.DstIP} {
-			key := n.buildKey(pkt.Timestamp, addr)
+		for _, prefix := range prefixes {
+			key := n.buildKey(pkt.Timestamp, prefix)
 			k := ret[key.name]
 			if k == nil {
 				ret[key.name] = key
 				k = key
 			}
-			k.ids = append(key.ids, pkt.Id)
+			k.ids = append(k.ids, pkt.Id)
 		}
 	}
 
@@ -197,7 +219,18 @@ func (n *NutsStore) IndexKeys(ctx context.Context) (ret []string, err error) {
 		span.End()
 	}()
 
-	ret, err = n.listKeys(_indexBucket)
+	keys, err := n.listKeys(_indexBucket)
+	if err != nil {
+		return
+	}
+
+	ret = make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !strings.HasPrefix(k, _portKeyPrefix) {
+			ret = append(ret, k)
+		}
+	}
+
 	return
 }
 
@@ -210,9 +243,101 @@ func (n *NutsStore) FindPacketsByAddress(ctx context.Context, ip net.IP) (ret []
 		span.End()
 	}()
 
+	ret, err = n.findByPrefix(n.buildPrefix(models.NormalizeIP(ip)))
+	return
+}
+
+func (n *NutsStore) FindPacketsByMAC(ctx context.Context, mac net.HardwareAddr) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByMAC")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = n.findByPrefix(n.buildPrefix(mac))
+	return
+}
+
+func (n *NutsStore) FindPacketsByNetwork(ctx context.Context, network *net.IPNet) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByNetwork",
+		trace.WithAttributes(
+			attribute.String("request.network", network.String()),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	network = models.NormalizeNetwork(network)
+	ones, _ := network.Mask.Size()
+
+	// the prefix can be shared with addresses outside of the network when
+	// the mask does not end on an hex digit so each key is checked
+	prefix := hex.EncodeToString(network.IP)[:ones/4]
+	found := map[string]struct{}{}
+
+	err = n.db.View(func(tx *nutsdb.Tx) error {
+		entries, _, err := tx.PrefixScan(_indexBucket, []byte(prefix), 0, 20000)
+		if err != nil {
+			if err == nutsdb.ErrPrefixScan {
+				return nil
+			}
+
+			return err
+		}
+
+		for _, data := range entries {
+			addr, err := hex.DecodeString(strings.Split(string(data.Key), "-")[0])
+			if (err != nil) || (len(addr) != net.IPv6len) || !network.Contains(addr) {
+				continue
+			}
+
+			list, err := n.encoder.NewFromData(data.Value)
+			if err != nil {
+				return err
+			}
+
+			ids, err := list.GetIds()
+			if err != nil {
+				return err
+			}
+
+			// packets are indexed with both of their addresses
+			for _, id := range ids {
+				if _, exists := found[id]; !exists {
+					found[id] = struct{}{}
+					ret = append(ret, id)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (n *NutsStore) FindPacketsByPort(ctx context.Context, proto layers.IPProtocol, port uint16) (ret []string, err error) {
+	ctx, span := _tracer.Start(ctx, "FindPacketsByPort")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	ret, err = n.findByPrefix(n.buildPortPrefix(proto, port))
+	return
+}
+
+func (n *NutsStore) findByPrefix(prefix string) (ret []string, err error) {
 	err = n.db.View(func(tx *nutsdb.Tx) error {
 
-		entries, _, err := tx.PrefixScan(_indexBucket, ip, 0, 20000)
+		entries, _, err := tx.PrefixScan(_indexBucket, []byte(prefix), 0, 20000)
 
 		if err != nil {
 			return err
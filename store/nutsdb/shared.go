@@ -1,6 +1,7 @@
 package nuts
 
 import (
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -43,13 +44,149 @@ func New(o *NutsStoreOptions) (*NutsStore, error) {
 		return nil, err
 	}
 
-	return &NutsStore{
+	ret := &NutsStore{
 		db:          db,
 		encoder:     o.Encoder,
 		timeFormat:  o.TimeFormat,
 		currentTime: o.CurrentTime,
 		ttl:         o.TTL,
-	}, nil
+	}
+
+	err = ret.upgradeIPv4Keys()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+const (
+	// bucket holding the state of the store itself
+	_metaBucket = "meta"
+
+	// written once the index keys are all in their 16 bytes form
+	_ipv4KeysUpgradedKey = "ipv4_keys_upgraded"
+
+	// number of index keys upgraded in each transaction
+	_upgradeBatchSize = 1000
+)
+
+// upgradeIPv4Keys rewrites the index keys written when IPv4 addresses were
+// indexed in their 4 bytes form, their ids are merged in the list of the new
+// key. The bucket is read in batches and a marker is written once done so
+// it is only scanned once.
+func (n *NutsStore) upgradeIPv4Keys() error {
+	var upgraded bool
+
+	err := n.db.View(func(tx *nutsdb.Tx) error {
+		_, err := tx.Get(_metaBucket, []byte(_ipv4KeysUpgradedKey))
+		upgraded = (err == nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if upgraded {
+		return nil
+	}
+
+	// the deleted keys stay in the index until the files are merged so
+	// the offsets of the other keys do not move, the new keys may move them
+	// forward but they no longer need an upgrade
+	for offset := 0; ; offset += _upgradeBatchSize {
+		var skipped int
+
+		err = n.db.Update(func(tx *nutsdb.Tx) error {
+			var entries nutsdb.Entries
+			var err error
+
+			entries, skipped, err = tx.PrefixScan(_indexBucket, []byte{}, offset, _upgradeBatchSize)
+			if err == nutsdb.ErrPrefixScan {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			return n.upgradeIPv4Entries(tx, entries)
+		})
+		if err != nil {
+			return err
+		}
+
+		// fewer keys than the offset, the whole bucket was read
+		if skipped < offset {
+			break
+		}
+	}
+
+	return n.db.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(_metaBucket, []byte(_ipv4KeysUpgradedKey), []byte{1}, nutsdb.Persistent)
+	})
+}
+
+// upgradeIPv4Entries upgrades the keys of the entries in their 4 bytes form.
+func (n *NutsStore) upgradeIPv4Entries(tx *nutsdb.Tx, entries nutsdb.Entries) error {
+	for _, e := range entries {
+		key, upgrade := store.UpgradeIPv4Key(string(e.Key))
+		if !upgrade {
+			continue
+		}
+
+		legacy, err := n.encoder.NewFromData(e.Value)
+		if err != nil {
+			return err
+		}
+
+		ids, err := legacy.GetIds()
+		if err != nil {
+			return err
+		}
+
+		var list index_encoder.ValueInterface
+
+		data, err := tx.Get(_indexBucket, []byte(key))
+		switch {
+		case err == nil:
+			list, err = n.encoder.NewFromData(data.Value)
+		case (err == nutsdb.ErrKeyNotFound) || (err == nutsdb.ErrNotFoundKey):
+			list, err = n.encoder.NewEmpty()
+		}
+		if err != nil {
+			return err
+		}
+
+		err = list.Add(ids...)
+		if err != nil {
+			return err
+		}
+
+		newData, err := list.Serialize()
+		if err != nil {
+			return err
+		}
+
+		// the key ends with the day the packets were received
+		_, day, _ := strings.Cut(key, "-")
+		timestamp, err := time.Parse(n.timeFormat, day)
+		if err != nil {
+			timestamp = n.currentTime()
+		}
+
+		err = tx.PutWithTimestamp(_indexBucket, []byte(key), newData, e.Meta.TTL, uint64(timestamp.Unix()))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(_indexBucket, e.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (b *NutsStore) GetStats() (*store.Stats, error) {
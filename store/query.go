@@ -1,8 +1,11 @@
 package store
 
 import (
+	"bytes"
+	"net"
 	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/schmurfy/sniffit/models"
 )
 
@@ -10,20 +13,205 @@ type FindQuery struct {
 	From     time.Time
 	To       time.Time
 	MaxCount int
+
+	// return the most recent packets first
+	Descending bool
+
+	// only return the packets captured by this agent (empty matches everything)
+	Agent string
+
+	// do not return the packets captured by several agents more than once
+	SkipDuplicates bool
+
+	// only return frames with this ethertype (0 matches everything)
+	EtherType uint16
+
+	// only return packets sent from or to these addresses (nil matches everything)
+	SrcIP  net.IP
+	DstIP  net.IP
+	SrcMAC net.HardwareAddr
+	DstMAC net.HardwareAddr
+
+	// only return packets sent from or to one of these networks (empty
+	// matches everything)
+	Networks []*net.IPNet
+
+	// transport filters (0 matches everything), Port matches either the
+	// source or the destination port
+	Protocol layers.IPProtocol
+	Port     uint16
+	SrcPort  uint16
+	DstPort  uint16
+
+	// only return the packets of this conversation, in both directions
+	Flow *models.Flow
+}
+
+// HasPortFilter returns true if the query filters packets by port.
+func (q *FindQuery) HasPortFilter() bool {
+	return (q.Port != 0) || (q.SrcPort != 0) || (q.DstPort != 0)
 }
 
-func (q *FindQuery) match(p *models.Packet) bool {
+// needsDecode returns true if the query filters on decoded fields.
+func (q *FindQuery) needsDecode() bool {
+	return (q.EtherType != 0) || (q.Protocol != 0) || q.HasPortFilter() ||
+		(q.SrcIP != nil) || (q.DstIP != nil) || (q.SrcMAC != nil) || (q.DstMAC != nil) || (len(q.Networks) > 0) || (q.Flow != nil)
+}
+
+// matchTime returns true if the time is in the query range.
+func (q *FindQuery) matchTime(t time.Time) bool {
 	if q == nil {
 		return true
 	}
 
-	if !q.From.IsZero() && p.Timestamp.Before(q.From) {
+	if !q.From.IsZero() && t.Before(q.From) {
 		return false
 	}
 
-	if !q.To.IsZero() && p.Timestamp.After(q.To) {
+	return q.To.IsZero() || !t.After(q.To)
+}
+
+// Match returns true if the packet matches the query filters.
+func (q *FindQuery) Match(p *models.Packet) bool {
+	if q == nil {
+		return true
+	}
+
+	if !q.matchTime(p.Timestamp) {
+		return false
+	}
+
+	if (q.Agent != "") && (p.Agent != q.Agent) {
 		return false
 	}
 
+	if q.SkipDuplicates && (p.DuplicateOf != "") {
+		return false
+	}
+
+	if !q.needsDecode() {
+		return true
+	}
+
+	p.Decode()
+
+	if (q.EtherType != 0) && (p.EtherType != q.EtherType) {
+		return false
+	}
+
+	if (q.SrcIP != nil) && !models.NormalizeIP(q.SrcIP).Equal(p.SrcIP) {
+		return false
+	}
+
+	if (q.DstIP != nil) && !models.NormalizeIP(q.DstIP).Equal(p.DstIP) {
+		return false
+	}
+
+	if (q.SrcMAC != nil) && !bytes.Equal(q.SrcMAC, p.SrcMAC) {
+		return false
+	}
+
+	if (q.DstMAC != nil) && !bytes.Equal(q.DstMAC, p.DstMAC) {
+		return false
+	}
+
+	if (len(q.Networks) > 0) && !q.matchNetworks(p) {
+		return false
+	}
+
+	if (q.Protocol != 0) && (p.IPProto != q.Protocol) {
+		return false
+	}
+
+	if (q.Port != 0) && (p.SrcPort != q.Port) && (p.DstPort != q.Port) {
+		return false
+	}
+
+	if (q.SrcPort != 0) && (p.SrcPort != q.SrcPort) {
+		return false
+	}
+
+	if (q.DstPort != 0) && (p.DstPort != q.DstPort) {
+		return false
+	}
+
+	if (q.Flow != nil) && !q.Flow.Equal(p.Flow()) {
+		return false
+	}
+
+	return true
+}
+
+func (q *FindQuery) matchNetworks(p *models.Packet) bool {
+	if !p.HasIP() {
+		return false
+	}
+
+	for _, n := range q.Networks {
+		n = models.NormalizeNetwork(n)
+		if n.Contains(p.SrcIP) || n.Contains(p.DstIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type FlowQuery struct {
+	// only return the flows with this endpoint (nil matches everything)
+	IP       net.IP
+	From     time.Time
+	To       time.Time
+	MaxCount int
+}
+
+// Match returns true if the flow was active during the query time range
+// and has the query IP as one of its endpoints.
+func (q *FlowQuery) Match(fr *models.FlowRecord) bool {
+	if q == nil {
+		return true
+	}
+
+	if !q.From.IsZero() && fr.LastSeen.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && fr.FirstSeen.After(q.To) {
+		return false
+	}
+
+	if q.IP != nil {
+		ip := models.NormalizeIP(q.IP)
+		if !ip.Equal(fr.A.IP) && !ip.Equal(fr.B.IP) {
+			return false
+		}
+	}
+
 	return true
 }
+
+type AuditQuery struct {
+	// only return the requests of this user (empty matches everything)
+	User     string
+	From     time.Time
+	To       time.Time
+	MaxCount int
+}
+
+// Match returns true if the request was made by the query user during the
+// query time range.
+func (q *AuditQuery) Match(e *models.AuditEntry) bool {
+	if q == nil {
+		return true
+	}
+
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+
+	return (q.User == "") || (q.User == e.User)
+}
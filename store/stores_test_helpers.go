@@ -6,6 +6,7 @@ import (
 	"context"
 	"net"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/franela/goblin"
@@ -52,6 +53,149 @@ func BuildPacket(ipSource, ipDest net.IP) []byte {
 	return buf.Bytes()
 }
 
+// BuildUDPPacket returns an ethernet frame carrying an IPv4 UDP datagram
+func BuildUDPPacket(ipSource, ipDest net.IP, srcPort, dstPort uint16) []byte {
+	mac, err := net.ParseMAC("02:00:5e:10:00:00")
+	if err != nil {
+		panic(err)
+	}
+
+	eth := &layers.Ethernet{
+		EthernetType: layers.EthernetTypeIPv4,
+		SrcMAC:       mac,
+		DstMAC:       mac,
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    ipSource,
+		DstIP:    ipDest,
+	}
+
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+
+	err = udp.SetNetworkLayerForChecksum(ip)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	err = gopacket.SerializeLayers(buf, opts,
+		eth,
+		ip,
+		udp,
+		gopacket.Payload([]byte("data")),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// BuildRawPacket returns an IPv4 packet without link layer (tun devices)
+func BuildRawPacket(ipSource, ipDest net.IP) []byte {
+	ip := &layers.IPv4{
+		Version: 4,
+		IHL:     5,
+		TTL:     64,
+		SrcIP:   ipSource,
+		DstIP:   ipDest,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	err := gopacket.SerializeLayers(buf, opts,
+		ip,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func BuildPacket6(ipSource, ipDest net.IP) []byte {
+	mac, err := net.ParseMAC("02:00:5e:10:00:00")
+	if err != nil {
+		panic(err)
+	}
+
+	eth := &layers.Ethernet{
+		EthernetType: layers.EthernetTypeIPv6,
+		SrcMAC:       mac,
+		DstMAC:       mac,
+	}
+
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolNoNextHeader,
+		SrcIP:      ipSource,
+		DstIP:      ipDest,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	err = gopacket.SerializeLayers(buf, opts,
+		eth,
+		ip,
+	)
+
+	return buf.Bytes()
+}
+
+func BuildARPPacket(srcMAC, dstMAC net.HardwareAddr) []byte {
+	eth := &layers.Ethernet{
+		EthernetType: layers.EthernetTypeARP,
+		SrcMAC:       srcMAC,
+		DstMAC:       dstMAC,
+	}
+
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: []byte{172, 16, 0, 1},
+		DstHwAddress:      dstMAC,
+		DstProtAddress:    []byte{172, 16, 0, 2},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+
+	err := gopacket.SerializeLayers(buf, opts,
+		eth,
+		arp,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
 const (
 	_day  = 24 * time.Hour
 	_week = 7 * _day
@@ -125,6 +269,168 @@ func TestIndex(g *goblin.G, f initFunc) {
 
 			})
 
+			g.It("should find indexed IPv6 packets", func() {
+				addr6 := net.ParseIP("2001:db8::1")
+				addr6Bis := net.ParseIP("2001:db8::2")
+
+				p6 := &models.Packet{Id: "p6", Data: BuildPacket6(addr6, addr6Bis),
+					Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, p6,
+				})
+				require.Nil(g, err)
+
+				ids, err := store.FindPacketsByAddress(ctx, addr6)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"p6"}, ids)
+
+				ids, err = store.FindPacketsByAddress(ctx, addr6Bis)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"p6"}, ids)
+
+				// IPv4 addresses are still found with their 4 bytes form
+				ids, err = store.FindPacketsByAddress(ctx, addr1)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"p1"}, ids)
+			})
+
+			g.It("should decode packets with their link type", func() {
+				raw := &models.Packet{Id: "raw", Data: BuildRawPacket(addr2, addr3),
+					LinkType: layers.LinkTypeRaw, Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, raw,
+				})
+				require.Nil(g, err)
+
+				ids, err := store.FindPacketsByAddress(ctx, addr2)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"raw"}, ids)
+			})
+
+			g.It("should index non IP frames by MAC address", func() {
+				mac1, _ := net.ParseMAC("02:00:5e:10:00:01")
+				mac2, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+				arp := &models.Packet{Id: "arp", Data: BuildARPPacket(mac1, mac2),
+					Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, arp,
+				})
+				require.Nil(g, err)
+
+				ids, err := store.FindPacketsByMAC(ctx, mac1)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"arp"}, ids)
+
+				ids, err = store.FindPacketsByMAC(ctx, mac2)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"arp"}, ids)
+
+				// IP packets are only indexed by IP addresses
+				mac, _ := net.ParseMAC("02:00:5e:10:00:00")
+				ids, err = store.FindPacketsByMAC(ctx, mac)
+				require.Nil(g, err)
+				assert.Empty(g, ids)
+			})
+
+			g.It("should index packets by port", func() {
+				dns := &models.Packet{Id: "dns", Data: BuildUDPPacket(addr1, addr3, 5353, 53),
+					Timestamp: now}
+				ntp := &models.Packet{Id: "ntp", Data: BuildUDPPacket(addr1, addr3, 123, 123),
+					Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, dns, ntp,
+				})
+				require.Nil(g, err)
+
+				ids, err := store.FindPacketsByPort(ctx, layers.IPProtocolUDP, 53)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"dns"}, ids)
+
+				ids, err = store.FindPacketsByPort(ctx, layers.IPProtocolUDP, 123)
+				require.Nil(g, err)
+				assert.Equal(g, []string{"ntp"}, ids)
+
+				ids, err = store.FindPacketsByPort(ctx, layers.IPProtocolTCP, 53)
+				require.Nil(g, err)
+				assert.Empty(g, ids)
+
+				// ports are not listed as index keys
+				keys, err := store.IndexKeys(ctx)
+				require.Nil(g, err)
+				assert.Len(g, keys, 2)
+			})
+
+			g.It("should find packets by network", func() {
+				p6 := &models.Packet{Id: "p6", Data: BuildPacket6(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8:1::1")),
+					Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, p2, p3, p6,
+				})
+				require.Nil(g, err)
+
+				find := func(cidr string) []string {
+					_, network, err := net.ParseCIDR(cidr)
+					require.Nil(g, err)
+
+					ids, err := store.FindPacketsByNetwork(ctx, network)
+					require.Nil(g, err)
+
+					sort.Strings(ids)
+					return ids
+				}
+
+				assert.Equal(g, []string{"p1", "p2", "p3"}, find("172.16.0.0/16"))
+				assert.Equal(g, []string{"p1", "p2"}, find("172.16.0.0/31"))
+				assert.Equal(g, []string{"p3"}, find("172.16.0.2/32"))
+				assert.Equal(g, []string{"p1", "p2", "p3"}, find("1.2.3.0/24"))
+				assert.Empty(g, find("172.17.0.0/16"))
+				assert.Equal(g, []string{"p6"}, find("2001:db8::/48"))
+				// both addresses of p6 are in the network
+				assert.Equal(g, []string{"p6"}, find("2001:db8::/32"))
+			})
+
+			g.It("should find packets with their capture time", func() {
+				timedIndex, ok := store.(TimedIndexInterface)
+				if !ok {
+					return
+				}
+
+				dns := &models.Packet{Id: "dns", Data: BuildUDPPacket(addr1, addr3, 5353, 53),
+					Timestamp: now}
+
+				err := store.IndexPackets(ctx, []*models.Packet{p1, p2, dns})
+				require.Nil(g, err)
+
+				refs, err := timedIndex.FindPacketRefsByAddress(ctx, addr1)
+				require.Nil(g, err)
+				require.Len(g, refs, 3)
+
+				times := map[string]time.Time{}
+				for _, ref := range refs {
+					times[ref.Id] = ref.Timestamp
+				}
+
+				assert.True(g, p1.Timestamp.Equal(times["p1"]))
+				assert.True(g, p2.Timestamp.Equal(times["p2"]))
+				assert.True(g, dns.Timestamp.Equal(times["dns"]))
+
+				refs, err = timedIndex.FindPacketRefsByPort(ctx, layers.IPProtocolUDP, 53)
+				require.Nil(g, err)
+				require.Len(g, refs, 1)
+				assert.True(g, dns.Timestamp.Equal(refs[0].Timestamp))
+
+				_, network, _ := net.ParseCIDR("172.16.0.0/16")
+				refs, err = timedIndex.FindPacketRefsByNetwork(ctx, network)
+				require.Nil(g, err)
+				assert.Len(g, refs, 3)
+			})
+
 			g.It("should expire packets from index", func() {
 				// add packets
 				err := store.IndexPackets(ctx, []*models.Packet{
@@ -140,6 +446,186 @@ func TestIndex(g *goblin.G, f initFunc) {
 			})
 		})
 
+		g.Describe("key stats", func() {
+			var keyStore KeyStatsInterface
+
+			g.BeforeEach(func() {
+				var ok bool
+
+				// key stats are optional
+				keyStore, ok = store.(KeyStatsInterface)
+				if !ok {
+					return
+				}
+
+				err := store.IndexPackets(ctx, []*models.Packet{
+					p1, p2, p3,
+				})
+				require.Nil(g, err)
+			})
+
+			keyStats := func(q *KeysQuery) map[string]*KeyStats {
+				keys, err := keyStore.KeyStats(ctx, q)
+				require.Nil(g, err)
+
+				ret := map[string]*KeyStats{}
+				for _, ks := range keys {
+					ret[net.IP(ks.Address).String()] = ks
+				}
+
+				return ret
+			}
+
+			g.It("should summarize the indexed addresses", func() {
+				if keyStore == nil {
+					return
+				}
+
+				keys := keyStats(&KeysQuery{})
+				require.Len(g, keys, 3)
+
+				ks := keys[addr1.String()]
+				require.NotNil(g, ks)
+				assert.Equal(g, uint64(2), ks.Packets)
+				assert.Equal(g, uint64(len(p1.Data)+len(p2.Data)), ks.Bytes)
+				assert.Equal(g, p1.Timestamp.UnixNano(), ks.FirstSeen.UnixNano())
+				assert.Equal(g, p2.Timestamp.UnixNano(), ks.LastSeen.UnixNano())
+
+				assert.Equal(g, uint64(3), keys[addr3.String()].Packets)
+			})
+
+			g.It("should filter the addresses by time and network", func() {
+				if keyStore == nil {
+					return
+				}
+
+				keys := keyStats(&KeysQuery{From: now.Add(-36 * time.Hour)})
+				require.Len(g, keys, 3)
+				assert.Equal(g, uint64(1), keys[addr1.String()].Packets)
+				assert.Equal(g, uint64(2), keys[addr3.String()].Packets)
+
+				_, network, _ := net.ParseCIDR("172.16.0.0/30")
+				keys = keyStats(&KeysQuery{Network: network, To: now.Add(-36 * time.Hour)})
+				require.Len(g, keys, 1)
+				assert.Equal(g, uint64(1), keys[addr1.String()].Packets)
+			})
+		})
+
+		g.Describe("flows", func() {
+			var flowStore FlowInterface
+			var f1, f2 *models.FlowRecord
+
+			g.BeforeEach(func() {
+				var ok bool
+
+				// flows are optional
+				flowStore, ok = store.(FlowInterface)
+				if !ok {
+					return
+				}
+
+				dns := &models.Packet{Data: BuildUDPPacket(addr1, addr3, 5353, 53),
+					Timestamp: now.Add(-1 * time.Hour), Agent: "agent1"}
+				dns.Decode()
+				f1 = models.NewFlowRecord(dns)
+
+				ntp := &models.Packet{Data: BuildUDPPacket(addr2, addr3, 123, 123),
+					Timestamp: now, Agent: "agent1"}
+				ntp.Decode()
+				f2 = models.NewFlowRecord(ntp)
+
+				err := flowStore.StoreFlows(ctx, []*models.FlowRecord{f2, f1})
+				require.Nil(g, err)
+			})
+
+			g.It("should return stored flows", func() {
+				if flowStore == nil {
+					return
+				}
+
+				flows, err := flowStore.FindFlows(ctx, &FlowQuery{})
+				require.Nil(g, err)
+				require.Len(g, flows, 2)
+				assert.Equal(g, f1.ID(), flows[0].ID())
+				assert.Equal(g, f2.ID(), flows[1].ID())
+				assert.Equal(g, uint64(1), flows[0].Packets)
+				assert.Equal(g, "agent1", flows[0].Agent)
+			})
+
+			g.It("should replace updated flows", func() {
+				if flowStore == nil {
+					return
+				}
+
+				f1.Packets = 10
+				err := flowStore.StoreFlows(ctx, []*models.FlowRecord{f1})
+				require.Nil(g, err)
+
+				flows, err := flowStore.FindFlows(ctx, &FlowQuery{IP: addr1})
+				require.Nil(g, err)
+				require.Len(g, flows, 1)
+				assert.Equal(g, uint64(10), flows[0].Packets)
+			})
+
+			g.It("should not replace flows with an older version", func() {
+				if flowStore == nil {
+					return
+				}
+
+				older := *f1
+				f1.Packets = 10
+				err := flowStore.StoreFlows(ctx, []*models.FlowRecord{f1})
+				require.Nil(g, err)
+
+				err = flowStore.StoreFlows(ctx, []*models.FlowRecord{&older})
+				require.Nil(g, err)
+
+				flows, err := flowStore.FindFlows(ctx, &FlowQuery{IP: addr1})
+				require.Nil(g, err)
+				require.Len(g, flows, 1)
+				assert.Equal(g, uint64(10), flows[0].Packets)
+			})
+
+			g.It("should filter flows", func() {
+				if flowStore == nil {
+					return
+				}
+
+				flows, err := flowStore.FindFlows(ctx, &FlowQuery{IP: addr3})
+				require.Nil(g, err)
+				assert.Len(g, flows, 2)
+
+				flows, err = flowStore.FindFlows(ctx, &FlowQuery{IP: addr2})
+				require.Nil(g, err)
+				require.Len(g, flows, 1)
+				assert.Equal(g, f2.ID(), flows[0].ID())
+
+				flows, err = flowStore.FindFlows(ctx, &FlowQuery{From: now.Add(-30 * time.Minute)})
+				require.Nil(g, err)
+				require.Len(g, flows, 1)
+				assert.Equal(g, f2.ID(), flows[0].ID())
+
+				flows, err = flowStore.FindFlows(ctx, &FlowQuery{MaxCount: 1})
+				require.Nil(g, err)
+				require.Len(g, flows, 1)
+				assert.Equal(g, f1.ID(), flows[0].ID())
+			})
+
+			g.It("should not list flows as packets", func() {
+				if flowStore == nil {
+					return
+				}
+
+				keys, err := store.DataKeys(ctx)
+				require.Nil(g, err)
+				assert.Empty(g, keys)
+
+				keys, err = store.IndexKeys(ctx)
+				require.Nil(g, err)
+				assert.Empty(g, keys)
+			})
+		})
+
 		g.Describe("data", func() {
 
 			g.BeforeEach(func() {
@@ -163,6 +649,165 @@ func TestIndex(g *goblin.G, f initFunc) {
 				assert.Len(g, packets, 1)
 			})
 
+			g.It("should scan stored packets", func() {
+				it, err := store.ScanPackets(ctx, []string{"p1", "unknown", "exp1", "p3"}, &FindQuery{})
+				require.Nil(g, err)
+
+				ids := []string{}
+				for it.Next() {
+					ids = append(ids, it.Packet().Id)
+				}
+
+				require.Nil(g, it.Err())
+				require.Nil(g, it.Close())
+				assert.Equal(g, []string{"p1", "p3"}, ids)
+			})
+
+			g.It("should scan packet refs in capture time order", func() {
+				// the ids and the capture times are not in the same order
+				a := &models.Packet{Id: "a", Data: BuildPacket(addr1, addr3),
+					Timestamp: now.Add(-1 * time.Hour)}
+				z := &models.Packet{Id: "z", Data: BuildPacket(addr1, addr3),
+					Timestamp: now.Add(-3 * _day)}
+
+				err := store.StorePackets(ctx, []*models.Packet{a, z})
+				require.Nil(g, err)
+
+				refs := []PacketRef{}
+				for _, pkt := range []*models.Packet{p3, a, p1, z, p1} {
+					refs = append(refs, PacketRef{Id: pkt.Id, Timestamp: pkt.Timestamp})
+				}
+
+				scan := func(q *FindQuery) []string {
+					it, err := store.ScanPacketRefs(ctx, refs, q)
+					require.Nil(g, err)
+
+					pkts, err := CollectPackets(it)
+					require.Nil(g, err)
+
+					ids := []string{}
+					for _, pkt := range pkts {
+						ids = append(ids, pkt.Id)
+					}
+
+					return ids
+				}
+
+				assert.Equal(g, []string{"z", "p1", "a", "p3"}, scan(&FindQuery{}))
+				assert.Equal(g, []string{"p3", "a"}, scan(&FindQuery{MaxCount: 2, Descending: true}))
+				assert.Equal(g, []string{"a", "p3"}, scan(&FindQuery{From: now.Add(-36 * time.Hour)}))
+			})
+
+			g.It("should filter scanned packets by address and transport", func() {
+				dns := &models.Packet{Id: "dns", Data: BuildUDPPacket(addr1, addr3, 5353, 53),
+					Timestamp: now}
+				reply := &models.Packet{Id: "reply", Data: BuildUDPPacket(addr3, addr1, 53, 5353),
+					Timestamp: now}
+
+				err := store.StorePackets(ctx, []*models.Packet{dns, reply})
+				require.Nil(g, err)
+
+				scan := func(q *FindQuery) []string {
+					pkts, err := store.GetPackets(ctx, []string{"p1", "dns", "reply"}, q)
+					require.Nil(g, err)
+
+					ids := []string{}
+					for _, pkt := range pkts {
+						ids = append(ids, pkt.Id)
+					}
+
+					return ids
+				}
+
+				assert.Equal(g, []string{"dns", "reply"}, scan(&FindQuery{Port: 53}))
+				assert.Equal(g, []string{"dns"}, scan(&FindQuery{DstPort: 53}))
+				assert.Equal(g, []string{"reply"}, scan(&FindQuery{SrcPort: 53, Protocol: layers.IPProtocolUDP}))
+				assert.Empty(g, scan(&FindQuery{Port: 53, Protocol: layers.IPProtocolTCP}))
+				assert.Equal(g, []string{"dns", "p1"}, scan(&FindQuery{SrcIP: addr1}))
+				assert.Equal(g, []string{"reply"}, scan(&FindQuery{DstIP: addr1}))
+
+				flow := models.NewFlow(layers.IPProtocolUDP,
+					models.FlowEndpoint{IP: addr3, Port: 53},
+					models.FlowEndpoint{IP: addr1, Port: 5353},
+				)
+				assert.Equal(g, []string{"dns", "reply"}, scan(&FindQuery{Flow: flow}))
+
+				flow.B.Port = 5354
+				assert.Empty(g, scan(&FindQuery{Flow: flow}))
+
+				_, network, _ := net.ParseCIDR("172.16.0.0/24")
+				_, other, _ := net.ParseCIDR("10.0.0.0/8")
+				assert.Equal(g, []string{"dns", "p1", "reply"}, scan(&FindQuery{Networks: []*net.IPNet{other, network}}))
+				assert.Equal(g, []string{"dns"}, scan(&FindQuery{Networks: []*net.IPNet{network}, DstPort: 53}))
+				assert.Empty(g, scan(&FindQuery{Networks: []*net.IPNet{other}}))
+			})
+
+			g.It("should record the agent of each packet", func() {
+				s1 := &models.Packet{Id: "s1", Data: BuildPacket(addr1, addr3),
+					Timestamp: now, Agent: "sensor1", Interface: "eth0"}
+				s2 := &models.Packet{Id: "s2", Data: BuildPacket(addr1, addr3),
+					Timestamp: now, Agent: "sensor2", Interface: "eth1"}
+
+				err := store.StorePackets(ctx, []*models.Packet{s1, s2})
+				require.Nil(g, err)
+
+				pkts, err := store.GetPackets(ctx, []string{"p1", "s1", "s2"}, &FindQuery{Agent: "sensor2"})
+				require.Nil(g, err)
+				require.Len(g, pkts, 1)
+
+				assert.Equal(g, "s2", pkts[0].Id)
+				assert.Equal(g, "sensor2", pkts[0].Agent)
+				assert.Equal(g, "eth1", pkts[0].Interface)
+
+				pkts, err = store.GetPackets(ctx, []string{"p1", "s1", "s2"}, &FindQuery{Agent: "sensor1", SrcIP: addr1})
+				require.Nil(g, err)
+				require.Len(g, pkts, 1)
+				assert.Equal(g, "s1", pkts[0].Id)
+			})
+
+			g.It("should skip the duplicates", func() {
+				s1 := &models.Packet{Id: "s1", Data: BuildPacket(addr1, addr3),
+					Timestamp: now, Agent: "sensor1"}
+				s2 := &models.Packet{Id: "s2", Data: BuildPacket(addr1, addr3),
+					Timestamp: now, Agent: "sensor2", DuplicateOf: "s1"}
+
+				err := store.StorePackets(ctx, []*models.Packet{s1, s2})
+				require.Nil(g, err)
+
+				pkts, err := store.GetPackets(ctx, []string{"s1", "s2"}, &FindQuery{})
+				require.Nil(g, err)
+				require.Len(g, pkts, 2)
+				assert.Equal(g, "s1", pkts[1].DuplicateOf)
+
+				pkts, err = store.GetPackets(ctx, []string{"s1", "s2"}, &FindQuery{SkipDuplicates: true})
+				require.Nil(g, err)
+				require.Len(g, pkts, 1)
+				assert.Equal(g, "s1", pkts[0].Id)
+			})
+
+			g.It("should scan packets in order with a limit", func() {
+				scan := func(q *FindQuery) []string {
+					it, err := store.ScanPackets(ctx, []string{"p3", "p1", "p2", "p1"}, q)
+					require.Nil(g, err)
+
+					pkts, err := CollectPackets(it)
+					require.Nil(g, err)
+
+					ids := []string{}
+					for _, pkt := range pkts {
+						ids = append(ids, pkt.Id)
+					}
+
+					return ids
+				}
+
+				assert.Equal(g, []string{"p1", "p2", "p3"}, scan(&FindQuery{}))
+				assert.Equal(g, []string{"p1", "p2"}, scan(&FindQuery{MaxCount: 2}))
+				assert.Equal(g, []string{"p3", "p2"}, scan(&FindQuery{MaxCount: 2, Descending: true}))
+				assert.Equal(g, []string{"p2", "p3"}, scan(&FindQuery{From: now.Add(-36 * time.Hour)}))
+				assert.Equal(g, []string{"p1"}, scan(&FindQuery{To: now.Add(-36 * time.Hour)}))
+			})
+
 		})
 
 	})